@@ -2,9 +2,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -16,6 +22,7 @@ var version = "v0.3.0"
 
 var (
 	log      = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	fileLog  = slog.New(slog.DiscardHandler) // the log file only; see setupLogging
 	cfg      = &cmd.Config{}
 	cfgFile  string
 	cacheDir string
@@ -52,30 +59,57 @@ func saveConfig(cfg *cmd.Config) error {
 	return cmd.SaveConfig(cfgFile, cfg)
 }
 
-// setupLogging configures JSON logging to the configured log file, falling back
-// to stderr if the file cannot be opened.
+// setupLogging configures logging to the configured log file in log_format at
+// log_level, rotating it first (see cmd.RotateLog), and falls back to stderr if
+// the file cannot be opened. Unless quiet, warnings (and with verbose, info
+// records) are also shown on the console as short lines; fileLog gets the file
+// alone.
 //
 // Logging is operational, not a security control, and encrypt/decrypt do not
 // depend on it — so a bad log_file_path degrades to stderr rather than bricking
 // every command (including `config`, the only way to fix the path). It never
 // returns an error.
-func setupLogging(verbose bool) error {
-	level := slog.LevelInfo
+func setupLogging(verbose, quiet bool) error {
+	level, consoleLevel := cmd.LogLevel(cfg), slog.LevelWarn
 	if verbose {
-		level = slog.LevelDebug
+		level, consoleLevel = slog.LevelDebug, slog.LevelInfo
 	}
 	opts := &slog.HandlerOptions{Level: level}
+	fileHandler := func(w io.Writer) slog.Handler {
+		if cfg.LogFormat == cmd.LogFormatText {
+			return slog.NewTextHandler(w, opts)
+		}
+		return slog.NewJSONHandler(w, opts)
+	}
+
+	// A failed rotation must not stop logging; it is reported once the logger
+	// is set up.
+	rotateErr := cmd.RotateLog(cfg, time.Now())
 
-	logFile, err := os.OpenFile(cfg.LogFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	// Mutate the shared loggers in place (rather than reassigning the pointers)
+	// so the subcommands, which captured the log pointer at construction time,
+	// observe the configured handlers and level.
+	logFile, err := cmd.OpenLogWriter(cfg.LogFilePath)
 	if err != nil {
-		// Mutate the shared logger in place (rather than reassigning the pointer)
-		// so the subcommands, which captured the log pointer at construction time,
-		// observe the configured handler and level.
-		*log = *slog.New(slog.NewJSONHandler(os.Stderr, opts))
+		// Without a log file the console is all there is, filtered by
+		// --verbose and --quiet like any other console output.
+		if quiet {
+			consoleLevel = slog.LevelError
+		}
+		*log = *slog.New(cmd.NewConsoleHandler(os.Stderr, consoleLevel))
+		*fileLog = *slog.New(slog.DiscardHandler)
 		log.Warn("could not open log file; logging to stderr", "path", cfg.LogFilePath, "error", err)
 		return nil
 	}
-	*log = *slog.New(slog.NewJSONHandler(logFile, opts))
+	*fileLog = *slog.New(fileHandler(logFile))
+	if quiet {
+		*log = *fileLog
+	} else {
+		*log = *slog.New(slog.NewMultiHandler(fileHandler(logFile), cmd.NewConsoleHandler(os.Stderr, consoleLevel)))
+	}
+	if rotateErr != nil {
+		log.Warn("could not rotate log file", "path", cfg.LogFilePath, "error", rotateErr)
+	}
 	return nil
 }
 
@@ -86,14 +120,16 @@ func main() {
 		Use:     "a",
 		Short:   "CLI wrapper for age encryption using SSH/GitHub keys",
 		Version: version,
-		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+		// main prints the error itself, so it goes through the console styling.
+		SilenceErrors: true,
+		PersistentPreRunE: func(c *cobra.Command, _ []string) error {
 			if err := initConfigPaths(); err != nil {
-				return fmt.Errorf("error initializing paths: %w", err)
+				return cmd.ConfigError(fmt.Errorf("error initializing paths: %w", err))
 			}
 			if err := loadConfig(); err != nil {
-				return fmt.Errorf("error loading config: %w", err)
+				return cmd.ConfigError(fmt.Errorf("error loading config: %w", err))
 			}
-			return setupLogging(verbose)
+			return setupLogging(verbose, cmd.Quiet(c))
 		},
 	}
 
@@ -104,18 +140,42 @@ func main() {
 		false,
 		"Enable verbose output",
 	)
+	cmd.AddOutputFormatFlag(rootCmd)
+	cmd.AddQuietFlag(rootCmd)
 
 	// Add subcommands from cmd/*
 	rootCmd.AddCommand(
 		cmd.ConfigCmd(cfg, saveConfig),
 		cmd.Encrypt(cfg, log),
 		cmd.Decrypt(cfg, log),
+		cmd.Keygen(cfg, saveConfig),
+		cmd.Whoami(cfg, log),
+		cmd.Verify(cfg, log),
+		cmd.Audit(cfg),
+		cmd.GitFilter(cfg, log),
+		cmd.GitCmd(),
 		cmd.Completion(rootCmd),
 	)
 
-	// Execute the root command
-	if err := rootCmd.Execute(); err != nil {
-		log.Error("Command execution failed", "error", err)
-		os.Exit(1)
+	// The first SIGINT/SIGTERM cancels the context, so copies stop and temp
+	// files are removed. stop then restores the default handlers at once, so a
+	// second Ctrl-C kills a command stuck in something that ignores the
+	// context, such as a plugin's PIN prompt or an ssh-agent request. os.Exit
+	// skips deferred calls, so stop is also called explicitly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	// Each class of failure exits with its own status (see cmd.ExitCode).
+	switch code := cmd.ExitCode(err); code {
+	case cmd.ExitOK:
+	case cmd.ExitInterrupted:
+		fileLog.Warn("Command interrupted")
+		cmd.PrintError(rootCmd, errors.New("interrupted"))
+		os.Exit(code)
+	default:
+		fileLog.Error("Command execution failed", "error", err, "exitCode", code)
+		cmd.PrintError(rootCmd, err)
+		os.Exit(code)
 	}
 }
@@ -6,7 +6,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -57,8 +60,8 @@ func TestConfigWrappers(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "wrapped", reloaded.GitHubUser)
 
-	assert.NoError(t, setupLogging(true))
-	assert.NoError(t, setupLogging(false))
+	assert.NoError(t, setupLogging(true, false))
+	assert.NoError(t, setupLogging(false, true))
 }
 
 func TestLoadAndSaveConfig(t *testing.T) {
@@ -106,11 +109,11 @@ func TestCmdConfig(t *testing.T) {
 	require.NotNil(t, cmdObj, "ConfigCmd should return a non-nil cobra command")
 	assert.Contains(t, cmdObj.Aliases, "c", "config should be aliased to c")
 
-	names := make([]string, 0, 3)
+	names := make([]string, 0, 5)
 	for _, sub := range cmdObj.Commands() {
 		names = append(names, sub.Name())
 	}
-	assert.ElementsMatch(t, []string{"set", "rem", "show"}, names, "config subcommands")
+	assert.ElementsMatch(t, []string{"set", "rem", "show", "export", "import"}, names, "config subcommands")
 }
 
 // Helper to generate a temporary SSH keypair for testing.
@@ -241,7 +244,7 @@ func TestSetupLoggingFallback(t *testing.T) {
 	// every command (including the `config` command needed to fix it).
 	dir := t.TempDir()
 	cfg = &cmd.Config{LogFilePath: dir}
-	assert.NoError(t, setupLogging(false), "bad log path should fall back to stderr, not error")
+	assert.NoError(t, setupLogging(false, false), "bad log path should fall back to stderr, not error")
 }
 
 func TestInitConfigPathsWrapperError(t *testing.T) {
@@ -334,6 +337,31 @@ func TestCLIIntegration(t *testing.T) {
 	out, err = run("e", sh) // encrypt shorthand, output note.txt.age
 	require.NoError(t, err, out)
 	assert.FileExists(t, sh+".age")
+	assert.Contains(t, out, "encrypted "+sh+" → "+sh+".age for 1 recipient\n", "console status line")
+
+	// log_format text switches the log file; --quiet silences the console.
+	out, err = run("config", "set", "log_format", "text")
+	require.NoError(t, err, out)
+	require.NoError(t, os.Remove(sh+".age"))
+	out, err = run("e", sh, "--quiet")
+	require.NoError(t, err, out)
+	assert.Empty(t, out)
+	logData, err := os.ReadFile(filepath.Join(home, ".state", "a", "cli.log")) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Contains(t, string(logData), `level=INFO msg="Encryption successful"`)
+
+	// Without a usable log file the console handler still applies, --quiet too.
+	out, err = run("config", "set", "log_file_path", home) // a directory cannot be appended to
+	require.NoError(t, err, out)
+	out, err = run("e", sh, "--force", "--quiet")
+	require.NoError(t, err, out)
+	assert.Empty(t, out)
+	out, err = run("e", sh, "--force")
+	require.NoError(t, err, out)
+	assert.Contains(t, out, "could not open log file")
+	assert.NotContains(t, out, `"level"`)
+	out, err = run("config", "rem", "log_file_path")
+	require.NoError(t, err, out)
 
 	require.NoError(t, os.Remove(sh)) // decrypt shorthand recreates note.txt
 	out, err = run("d", sh+".age")
@@ -341,4 +369,83 @@ func TestCLIIntegration(t *testing.T) {
 	got, err = os.ReadFile(sh) // #nosec G304 -- test temp path
 	require.NoError(t, err)
 	assert.Equal(t, "shorthand secret", string(got))
+
+	// Transparent encryption of repository files through the git filter.
+	if _, err := exec.LookPath("git"); err == nil {
+		repo := filepath.Join(home, "repo")
+		require.NoError(t, os.MkdirAll(repo, 0o700))
+		git := func(args ...string) string {
+			// #nosec G204 -- git with literal args in a temp repository
+			c := exec.Command("git", append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"},
+				args...)...)
+			c.Dir, c.Env = repo, env
+			out, err := c.CombinedOutput()
+			require.NoError(t, err, "git %v: %s", args, out)
+			return string(out)
+		}
+		git("init", "-q")
+		// #nosec G204 -- launches the freshly built test binary with controlled args
+		initFilter := exec.Command(binPath, "git", "init-filter", "-r", priv+".pub")
+		initFilter.Dir, initFilter.Env = repo, env
+		out, err := initFilter.CombinedOutput()
+		require.NoError(t, err, string(out))
+		attrs := []byte("*.env filter=a diff=a\n")
+		require.NoError(t, os.WriteFile(filepath.Join(repo, ".gitattributes"), attrs, 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(repo, "prod.env"), []byte("TOKEN=abc\n"), 0o600))
+		git("add", ".")
+		git("commit", "-q", "-m", "secrets")
+		assert.True(t, strings.HasPrefix(git("cat-file", "blob", "HEAD:prod.env"), "age-encryption.org/v1\n"))
+		assert.Contains(t, git("cat-file", "blob", "HEAD:.a-recipients"), priv+".pub")
+
+		// Touching the file or re-adding it must not produce a new ciphertext.
+		now := time.Now().Add(time.Second)
+		require.NoError(t, os.Chtimes(filepath.Join(repo, "prod.env"), now, now))
+		git("add", "prod.env")
+		assert.Empty(t, git("status", "--porcelain"))
+
+		require.NoError(t, os.Remove(filepath.Join(repo, "prod.env")))
+		git("checkout", "--", "prod.env")
+		got, err := os.ReadFile(filepath.Join(repo, "prod.env")) // #nosec G304 -- test temp path
+		require.NoError(t, err)
+		assert.Equal(t, "TOKEN=abc\n", string(got))
+
+		require.NoError(t, os.WriteFile(filepath.Join(repo, "prod.env"), []byte("TOKEN=xyz\n"), 0o600))
+		assert.Contains(t, git("diff"), "+TOKEN=xyz")
+	}
+
+	// SIGINT at a prompt cancels the command and exits with exitInterrupted.
+	if runtime.GOOS != "windows" {
+		bundle := filepath.Join(home, "bundle.yaml")
+		require.NoError(t, os.WriteFile(bundle, []byte("version: 1\ngithub_user: octocat\n"), 0o600))
+		assert.Equal(t, cmd.ExitInterrupted, interruptAtPrompt(t, binPath, env, "config", "import", bundle))
+	}
+}
+
+// interruptAtPrompt starts the binary with a stdin that never answers, sends
+// SIGINT once the confirmation prompt appears, and returns the exit code.
+func interruptAtPrompt(t *testing.T, binPath string, env []string, args ...string) int {
+	t.Helper()
+	// #nosec G204 -- launches the freshly built test binary with controlled args
+	c := exec.Command(binPath, args...)
+	c.Env = env
+	stdin, err := c.StdinPipe()
+	require.NoError(t, err)
+	defer func() { _ = stdin.Close() }()
+	stdout, err := c.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, c.Start())
+
+	var seen strings.Builder
+	buf := make([]byte, 256)
+	for !strings.Contains(seen.String(), "[y/N]") {
+		n, err := stdout.Read(buf)
+		require.NoError(t, err, seen.String())
+		seen.Write(buf[:n])
+	}
+	require.NoError(t, c.Process.Signal(os.Interrupt))
+	_, _ = io.Copy(io.Discard, stdout)
+
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, c.Wait(), &exitErr)
+	return exitErr.ExitCode()
 }
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// errNoAgent is returned when an ssh-agent is requested but SSH_AUTH_SOCK is unset.
+var errNoAgent = errors.New("no ssh-agent available: SSH_AUTH_SOCK is not set")
+
+// listAgentKeys returns the public keys held by the ssh-agent at SSH_AUTH_SOCK.
+func listAgentKeys() ([]*agent.Key, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errNoAgent
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to ssh-agent: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("listing ssh-agent keys: %w", err)
+	}
+	return keys, nil
+}
+
+// agentRecipients returns the agent's ed25519 and RSA public keys as recipient
+// lines. Other key types (ECDSA, security keys) are skipped with a warning.
+func agentRecipients(log *slog.Logger) ([]string, error) {
+	keys, err := listAgentKeys()
+	if err != nil {
+		return nil, err
+	}
+	var recipients []string
+	for _, k := range keys {
+		if !agewrap.SSHKeyTypeSupported(k.Type()) {
+			log.Warn("Skipping ssh-agent key type not supported by age", "type", k.Type(), "comment", k.Comment)
+			continue
+		}
+		recipients = append(recipients, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k))))
+	}
+	return recipients, nil
+}
+
+// agentKeyFiles maps the agent's keys to private key files on disk.
+//
+// The ssh-agent protocol can only sign: it never reveals a private key or
+// performs the X25519 / RSA-OAEP decryption age's ssh-ed25519 and ssh-rsa
+// stanzas need. So an agent key can decrypt only through its key file, located
+// here via the agent comment (often the path it was added from) or a matching
+// .pub under ~/.ssh. Keys with no file are returned as agentOnly.
+func agentKeyFiles(log *slog.Logger) (paths []string, agentOnly []*agent.Key, err error) {
+	keys, err := listAgentKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, k := range keys {
+		if !agewrap.SSHKeyTypeSupported(k.Type()) {
+			log.Debug("Skipping ssh-agent key type not supported by age", "type", k.Type())
+			continue
+		}
+		if p := findKeyFile(k); p != "" {
+			log.Debug("Found key file for ssh-agent key", "path", p, "comment", k.Comment)
+			paths = append(paths, p)
+			continue
+		}
+		agentOnly = append(agentOnly, k)
+	}
+	return paths, agentOnly, nil
+}
+
+// findKeyFile returns the private key file whose .pub matches k, or "".
+func findKeyFile(k *agent.Key) string {
+	candidates := []string{k.Comment}
+	if pubs, err := filepath.Glob(filepath.Join(os.Getenv("HOME"), ".ssh", "*.pub")); err == nil {
+		for _, pub := range pubs {
+			candidates = append(candidates, strings.TrimSuffix(pub, ".pub"))
+		}
+	}
+	for _, priv := range candidates {
+		if priv == "" || !filepath.IsAbs(priv) {
+			continue
+		}
+		// #nosec G304 -- candidate paths come from the agent comment or a ~/.ssh glob
+		data, err := os.ReadFile(priv + ".pub")
+		if err != nil {
+			continue
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil || !bytes.Equal(pub.Marshal(), k.Marshal()) {
+			continue
+		}
+		if _, err := os.Stat(priv); err == nil {
+			return priv
+		}
+	}
+	return ""
+}
+
+// explainAgentOnly returns a descriptive error when input is encrypted to one
+// of the agent-only keys, so the user learns why their loaded key did not
+// work; it returns nil when none of them is a recipient of input.
+func explainAgentOnly(input string, agentOnly []*agent.Key) error {
+	if len(agentOnly) == 0 {
+		return nil
+	}
+	tags, err := stanzaTags(input)
+	if err != nil {
+		return nil
+	}
+	for _, k := range agentOnly {
+		if slices.Contains(tags, ageSSHTag(k)) {
+			return fmt.Errorf("%s is encrypted to the ssh-agent key %s (%s, %s), but agent-held keys cannot "+
+				"decrypt age files: the agent protocol only signs, and %s stanzas need the private key itself; "+
+				"pass the key file with --ssh-key", input, ssh.FingerprintSHA256(k), k.Type(), k.Comment, k.Type())
+		}
+	}
+	return nil
+}
+
+// ageSSHTag is the key tag agessh writes in ssh-ed25519/ssh-rsa stanzas: the
+// first four bytes of the key's SHA-256, unpadded base64.
+func ageSSHTag(k ssh.PublicKey) string {
+	h := sha256.Sum256(k.Marshal())
+	return base64.RawStdEncoding.EncodeToString(h[:4])
+}
+
+// stanzaTags returns the first argument of every ssh-ed25519/ssh-rsa stanza in
+// the age header of the file at path.
+func stanzaTags(path string) ([]string, error) {
+	// #nosec G304 -- input path is a validated CLI flag/argument
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	hdr, err := age.ExtractHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for line := range strings.SplitSeq(string(hdr), "\n") {
+		f := strings.Fields(line)
+		if len(f) >= 3 && f[0] == "->" && agewrap.SSHKeyTypeSupported(f[1]) {
+			tags = append(tags, f[2])
+		}
+	}
+	return tags, nil
+}
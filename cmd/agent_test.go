@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startTestAgent serves an in-process keyring on a unix socket and points
+// SSH_AUTH_SOCK at it for the duration of the test.
+func startTestAgent(t *testing.T, keys ...agent.AddedKey) {
+	t.Helper()
+	// Unix socket paths are length-limited, so avoid the long t.TempDir path.
+	dir, err := os.MkdirTemp("", "agent")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	keyring := agent.NewKeyring()
+	for _, k := range keys {
+		require.NoError(t, keyring.Add(k))
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+}
+
+// newAgentEd25519 returns a fresh ed25519 key ready to add to an agent, and
+// writes its private/.pub files into dir when dir is non-empty.
+func newAgentEd25519(t *testing.T, dir, comment string) (agent.AddedKey, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	path := ""
+	if dir != "" {
+		path = filepath.Join(dir, "id_ed25519")
+		block, err := ssh.MarshalPrivateKey(priv, comment)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+		require.NoError(t, os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(sshPub), 0o600))
+	}
+	return agent.AddedKey{PrivateKey: priv, Comment: comment}, path
+}
+
+func TestAgentRecipients(t *testing.T) {
+	edKey, _ := newAgentEd25519(t, "", "laptop")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	startTestAgent(t, edKey, agent.AddedKey{PrivateKey: ecKey, Comment: "ecdsa"})
+
+	got, err := agentRecipients(discardLogger())
+	require.NoError(t, err)
+	require.Len(t, got, 1, "the ECDSA key is skipped")
+	_, err = resolveRefs(t, got, discardLogger())
+	assert.NoError(t, err)
+}
+
+func TestListAgentKeys_Errors(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, err := listAgentKeys()
+	assert.ErrorIs(t, err, errNoAgent)
+
+	t.Setenv("SSH_AUTH_SOCK", filepath.Join(t.TempDir(), "missing.sock"))
+	_, err = listAgentKeys()
+	assert.ErrorContains(t, err, "connecting to ssh-agent")
+	_, _, err = agentKeyFiles(discardLogger())
+	assert.Error(t, err)
+}
+
+// An agent key with its key file on disk decrypts through that file.
+func TestDecryptCmd_AgentKeyFile(t *testing.T) {
+	home := t.TempDir() // no ~/.ssh: the agent supplies the only key
+	t.Setenv("HOME", home)
+	keyDir := t.TempDir()
+	added, priv := newAgentEd25519(t, keyDir, "")
+	added.Comment = priv // ssh-add records the path it loaded the key from
+	startTestAgent(t, added)
+
+	recipients, err := agentRecipients(discardLogger())
+	require.NoError(t, err)
+	recips, err := resolveRefs(t, recipients, discardLogger())
+	require.NoError(t, err)
+	plain := filepath.Join(home, "in.txt")
+	require.NoError(t, os.WriteFile(plain, []byte("agent secret"), 0o600))
+	enc := filepath.Join(home, "in.age")
+	require.NoError(t, encryptFile(context.Background(), plain, enc, recips, outputOptions{}))
+
+	dec := filepath.Join(home, "out.txt")
+	c := Decrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", enc))
+	require.NoError(t, c.Flags().Set("output", dec))
+	require.NoError(t, c.Flags().Set("agent", "true"))
+	require.NoError(t, c.RunE(c, nil))
+	got, err := os.ReadFile(dec) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "agent secret", string(got))
+}
+
+// An agent-only key that the file is encrypted to produces an explanation
+// rather than the generic "no key matched".
+func TestDecryptCmd_AgentOnlyKeyExplained(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	added, _ := newAgentEd25519(t, "", "yubikey-less laptop key")
+	startTestAgent(t, added)
+
+	recipients, err := agentRecipients(discardLogger())
+	require.NoError(t, err)
+	recips, err := resolveRefs(t, recipients, discardLogger())
+	require.NoError(t, err)
+	plain := filepath.Join(home, "in.txt")
+	require.NoError(t, os.WriteFile(plain, []byte("x"), 0o600))
+	enc := filepath.Join(home, "in.age")
+	require.NoError(t, encryptFile(context.Background(), plain, enc, recips, outputOptions{}))
+
+	c := Decrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", enc))
+	require.NoError(t, c.Flags().Set("output", filepath.Join(home, "out.txt")))
+	require.NoError(t, c.Flags().Set("agent", "true"))
+	err = c.RunE(c, nil)
+	assert.ErrorContains(t, err, "agent-held keys cannot decrypt age files")
+	assert.ErrorContains(t, err, "yubikey-less laptop key")
+
+	// A file not encrypted to the agent key gets the generic error.
+	assert.NoError(t, explainAgentOnly(plain, nil))
+	other, _ := newAgentEd25519(t, "", "other")
+	otherPub, err := ssh.NewPublicKey(other.PrivateKey.(ed25519.PrivateKey).Public())
+	require.NoError(t, err)
+	assert.NoError(t, explainAgentOnly(enc, []*agent.Key{{Format: otherPub.Type(), Blob: otherPub.Marshal()}}))
+	assert.NoError(t, explainAgentOnly(plain, []*agent.Key{{Format: otherPub.Type(), Blob: otherPub.Marshal()}}),
+		"a non-age input is not explained")
+}
+
+func TestEncryptCmd_AgentRecipientsError(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	in := filepath.Join(t.TempDir(), "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("data"), 0o600))
+	c := Encrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("agent-recipients", "true"))
+	assert.ErrorIs(t, c.RunE(c, nil), errNoAgent)
+}
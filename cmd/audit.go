@@ -0,0 +1,591 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// maxAuditEntryBytes caps one audit entry (line); appends read back this much
+// of the log's tail to find the previous entry.
+const maxAuditEntryBytes = 1 << 20 // 1 MiB
+
+// auditEntry is one line of the audit log (JSON Lines). Each entry's Hash
+// covers all its other fields, Prev included, so editing, removing or
+// reordering an entry breaks the chain from that point on.
+type auditEntry struct {
+	Seq          int64     `json:"seq"`
+	Time         time.Time `json:"time"`
+	Operation    string    `json:"operation"`
+	User         string    `json:"user,omitempty"`
+	Host         string    `json:"host,omitempty"`
+	Input        string    `json:"input"`
+	InputSHA256  string    `json:"input_sha256"`
+	Output       string    `json:"output"`
+	OutputSHA256 string    `json:"output_sha256"`
+	// Recipients are the fingerprints of encrypt's recipients (see
+	// agewrap.Fingerprint).
+	Recipients []string `json:"recipients,omitempty"`
+	// IdentityFile is the key file that decrypted; Identity holds the
+	// fingerprints of its keys.
+	IdentityFile string   `json:"identity_file,omitempty"`
+	Identity     []string `json:"identity,omitempty"`
+	// Note says what a repair entry removed (see repairAudit).
+	Note string `json:"note,omitempty"`
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// auditHead is the <audit log>.head file: the last entry's sequence number and
+// hash. The chain alone cannot show entries cut off the end; the head can,
+// unless it is rewritten too, which is why `audit verify --expect` checks a
+// hash recorded somewhere else.
+type auditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// computeHash returns the hash of e with its Hash field left out.
+func (e auditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// newAuditEntry starts an entry for op with the current user and host, and
+// the SHA-256 of input and output.
+func newAuditEntry(op, input, output string) (auditEntry, error) {
+	e := auditEntryBy(op)
+	e.Input, e.Output = input, output
+	var err error
+	if e.InputSHA256, err = fileSHA256(input); err != nil {
+		return auditEntry{}, err
+	}
+	if e.OutputSHA256, err = fileSHA256(output); err != nil {
+		return auditEntry{}, err
+	}
+	return e, nil
+}
+
+// auditEntryBy starts an entry for op with the current time, user and host.
+func auditEntryBy(op string) auditEntry {
+	e := auditEntry{Time: time.Now().UTC(), Operation: op}
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		e.Host = host
+	}
+	return e
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	// #nosec G304 -- path is an input or output of the operation being audited
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("hashing %s for the audit log: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashing %s for the audit log: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recipientFingerprints names each recipient (see agewrap.Fingerprint).
+func recipientFingerprints(recipients []age.Recipient) []string {
+	fps := make([]string, len(recipients))
+	for i, r := range recipients {
+		fps[i] = agewrap.Fingerprint(r)
+	}
+	return fps
+}
+
+// identityFingerprints names the keys in the key file at keyPath: SHA256
+// fingerprints for SSH keys, recipient strings for age identities. A key whose
+// public half cannot be derived (a plugin identity) yields none; the entry
+// still records the file.
+func identityFingerprints(keyPath string) []string {
+	recipients, err := identityRecipients(keyPath)
+	if err != nil {
+		return nil
+	}
+	fps := make([]string, len(recipients))
+	for i, r := range recipients {
+		fps[i] = r
+		if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r)); err == nil {
+			fps[i] = ssh.FingerprintSHA256(pub)
+		}
+	}
+	return fps
+}
+
+// appendAudit chains e onto the audit log at path and updates its head. The
+// log is append-only (O_APPEND, 0600) and the append runs under the same kind
+// of lock as log rotation, so concurrent runs cannot fork the chain.
+func appendAudit(path string, e auditEntry) error {
+	return withAuditLog(path, func(f *os.File) error {
+		return appendAuditLocked(f, path, e)
+	})
+}
+
+// withAuditLog runs fn on the audit log at path, opened for appending, while
+// holding the lock on <path>.lock.
+func withAuditLog(path string, fn func(f *os.File) error) (err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("creating audit log directory: %w", err)
+	}
+	// #nosec G304 -- the lock file sits next to the configured audit log
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit lock: %w", err)
+	}
+	defer func() { _ = lock.Close() }()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("locking audit log: %w", err)
+	}
+
+	// #nosec G304 -- audit_log_path comes from the config
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return fn(f)
+}
+
+// appendAuditLocked is appendAudit once the log f is open and locked.
+func appendAuditLocked(f *os.File, path string, e auditEntry) error {
+	// The previous entry is read from the log itself rather than the head, so
+	// a head left behind by a crash between the two writes cannot fork the
+	// chain.
+	last, ok, err := lastAuditEntry(f)
+	if err != nil {
+		return err
+	}
+	if ok {
+		e.Seq, e.Prev = last.Seq+1, last.Hash
+	} else {
+		e.Seq = 1
+	}
+	if e.Hash, err = e.computeHash(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing audit log: %w", err)
+	}
+	return writeAuditHead(path, auditHead{Seq: e.Seq, Hash: e.Hash})
+}
+
+// lastAuditEntry returns the last complete entry of the log f, read from its
+// tail; ok is false for an empty log.
+func lastAuditEntry(f *os.File) (last auditEntry, ok bool, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return auditEntry{}, false, fmt.Errorf("reading audit log: %w", err)
+	}
+	size := info.Size()
+	if size == 0 {
+		return auditEntry{}, false, nil
+	}
+	n := min(size, maxAuditEntryBytes)
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, size-n); err != nil {
+		return auditEntry{}, false, fmt.Errorf("reading audit log: %w", err)
+	}
+	if !bytes.HasSuffix(buf, []byte("\n")) {
+		return auditEntry{}, false, errors.New("audit log ends in a partial entry; run `a audit repair`")
+	}
+	buf = bytes.TrimSuffix(buf, []byte("\n"))
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	if err := json.Unmarshal(buf, &last); err != nil {
+		return auditEntry{}, false, fmt.Errorf("parsing the last audit entry: %w", err)
+	}
+	return last, true, nil
+}
+
+// repairAudit cuts a partial entry, left by a run that stopped mid-append, off
+// the end of the audit log at path and appends a repair entry recording its
+// size and SHA-256, so the removal itself stays in the chain. It returns the
+// repair entry, or ok false when the log ends in a complete entry.
+func repairAudit(path string) (e auditEntry, ok bool, err error) {
+	err = withAuditLog(path, func(f *os.File) error {
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("reading audit log: %w", err)
+		}
+		size := info.Size()
+		n := min(size, maxAuditEntryBytes)
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, size-n); err != nil {
+			return fmt.Errorf("reading audit log: %w", err)
+		}
+		if n == 0 || bytes.HasSuffix(buf, []byte("\n")) {
+			return nil
+		}
+		i := bytes.LastIndexByte(buf, '\n')
+		if i < 0 && size > n {
+			return fmt.Errorf("audit log ends in a partial entry over %d bytes; not removing it", n)
+		}
+		partial := buf[i+1:]
+		if err := f.Truncate(size - int64(len(partial))); err != nil {
+			return fmt.Errorf("repairing audit log: %w", err)
+		}
+		sum := sha256.Sum256(partial)
+		e = auditEntryBy("repair")
+		e.Input, e.InputSHA256, e.Output = path, hex.EncodeToString(sum[:]), path
+		e.Note = fmt.Sprintf("removed a partial entry of %d bytes", len(partial))
+		if err := appendAuditLocked(f, path, e); err != nil {
+			return err
+		}
+		last, _, err := lastAuditEntry(f)
+		e, ok = last, true
+		return err
+	})
+	return e, ok, err
+}
+
+// writeAuditHead replaces the head file next to the audit log at path.
+func writeAuditHead(path string, head auditHead) (err error) {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".a-audit-head-*")
+	if err != nil {
+		return fmt.Errorf("writing audit head: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(append(data, '\n')); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing audit head: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path+".head"); err != nil {
+		return fmt.Errorf("writing audit head: %w", err)
+	}
+	return nil
+}
+
+// recordAudit appends an entry for a finished encrypt or decrypt of input to
+// output to the configured audit log, with set filling in the operation's
+// details; without audit_log_path it does nothing. Both files are read again
+// for their hashes, which costs a second pass over large files but only when
+// auditing is on. The operation has already succeeded, so the error says so.
+func recordAudit(cfg *Config, op, input, output string, set func(*auditEntry), log *slog.Logger) error {
+	if cfg.AuditLogPath == "" {
+		return nil
+	}
+	e, err := newAuditEntry(op, input, output)
+	if err == nil {
+		set(&e)
+		err = appendAudit(cfg.AuditLogPath, e)
+	}
+	if err != nil {
+		log.Error("Audit log not updated", "path", cfg.AuditLogPath, "error", err)
+		return fmt.Errorf("%s succeeded, but the audit log was not updated: %w", op, err)
+	}
+	log.Debug("Audit entry written", "path", cfg.AuditLogPath, "operation", op)
+	return nil
+}
+
+// readAuditLog reads the entries of the audit log at path; a log not written
+// yet has none. A malformed or partial line is an error naming its line number.
+func readAuditLog(path string) ([]auditEntry, error) {
+	// #nosec G304 -- audit_log_path comes from the config
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var entries []auditEntry
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				return entries, fmt.Errorf("line %d: truncated entry", n)
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return entries, fmt.Errorf("reading audit log: %w", err)
+		}
+		var e auditEntry
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return entries, fmt.Errorf("line %d: malformed entry: %w", n, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// verifyAuditChain checks that entries are numbered from 1, that each links
+// to the hash of the one before and that each hash matches its contents.
+func verifyAuditChain(entries []auditEntry) error {
+	prev := ""
+	for i, e := range entries {
+		if e.Seq != int64(i+1) {
+			return fmt.Errorf("entry %d: sequence number %d (entries removed or reordered)", i+1, e.Seq)
+		}
+		if e.Prev != prev {
+			return fmt.Errorf("entry %d: does not link to entry %d (entries removed, reordered or edited)", e.Seq, i)
+		}
+		sum, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+		if sum != e.Hash {
+			return fmt.Errorf("entry %d: contents do not match its hash (edited)", e.Seq)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// checkAuditHead compares the chain with the head file: entries missing from
+// the end show as a head past the last entry or a hash that differs. A head
+// behind the log only means a run stopped between its two writes.
+func checkAuditHead(path string, entries []auditEntry) error {
+	data, err := os.ReadFile(path + ".head") // #nosec G304 -- next to the configured audit log
+	if errors.Is(err, fs.ErrNotExist) {
+		if len(entries) > 0 {
+			return errors.New("the head file is missing; entries cut off the end would go unnoticed")
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading audit head: %w", err)
+	}
+	var head auditHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return fmt.Errorf("parsing audit head: %w", err)
+	}
+	if head.Seq > int64(len(entries)) {
+		return fmt.Errorf("truncated: the head records %d entries, the log has %d", head.Seq, len(entries))
+	}
+	if head.Seq > 0 && entries[head.Seq-1].Hash != head.Hash {
+		return fmt.Errorf("entry %d does not match the head's hash", head.Seq)
+	}
+	return nil
+}
+
+// parseSince parses --since: an RFC 3339 time, a date (YYYY-MM-DD, local
+// time), or an age such as 36h or 7d.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf(
+		"invalid --since %q: want a time (RFC 3339), a date (YYYY-MM-DD) or an age (36h, 7d)", s)
+}
+
+// Audit returns the `audit` command for checking and reading the audit log
+// that encrypt and decrypt append to when audit_log_path is set.
+func Audit(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Verify, show or repair the audit log of encrypt and decrypt operations",
+	}
+	logPath := func() (string, error) {
+		if cfg.AuditLogPath == "" {
+			return "", withClass(classConfig,
+				errors.New("no audit log: set one with `a config set audit_log_path <file>`"))
+		}
+		return cfg.AuditLogPath, nil
+	}
+
+	verify := &cobra.Command{
+		Use:   "verify",
+		Short: "Check the audit log's hash chain for edits, removals and truncation",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			path, err := logPath()
+			if err != nil {
+				return err
+			}
+			entries, err := readAuditLog(path)
+			if err != nil {
+				return withClass(classTampered, err)
+			}
+			if err := verifyAuditChain(entries); err != nil {
+				return withClass(classTampered, err)
+			}
+			if err := checkAuditHead(path, entries); err != nil {
+				return withClass(classTampered, err)
+			}
+			if expect, _ := cmd.Flags().GetString("expect"); expect != "" &&
+				!slices.ContainsFunc(entries, func(e auditEntry) bool { return e.Hash == expect }) {
+				return withClass(classTampered, fmt.Errorf("no entry has the expected hash %s (truncated?)", expect))
+			}
+			head := ""
+			if len(entries) > 0 {
+				head = entries[len(entries)-1].Hash
+			}
+			_, err = fmt.Fprintf(cmd.OutOrStdout(), "OK\t%d entries\thead %s\n", len(entries), head)
+			return err
+		},
+	}
+	verify.Flags().String("expect", "",
+		"Also require an entry with this hash, e.g. a head printed earlier and kept elsewhere")
+
+	show := &cobra.Command{
+		Use:   "show",
+		Short: "Print audit log entries",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			path, err := logPath()
+			if err != nil {
+				return err
+			}
+			var since time.Time
+			if s, _ := cmd.Flags().GetString("since"); s != "" {
+				if since, err = parseSince(s, time.Now()); err != nil {
+					return err
+				}
+			}
+			asJSON, err := jsonOutput(cmd)
+			if err != nil {
+				return err
+			}
+			if jsonFlag, _ := cmd.Flags().GetBool("json"); jsonFlag {
+				asJSON = true
+			}
+			// A damaged log is still shown up to the damage; verify reports it.
+			entries, readErr := readAuditLog(path)
+			if err := printAuditEntries(cmd.OutOrStdout(), entries, since, asJSON); err != nil {
+				return err
+			}
+			return readErr
+		},
+	}
+	show.Flags().String("since", "",
+		"Only entries from this time on: RFC 3339, YYYY-MM-DD, or an age such as 24h or 7d")
+	show.Flags().Bool("json", false, "Print entries as JSON Lines")
+
+	repair := &cobra.Command{
+		Use:   "repair",
+		Short: "Remove a partial entry left at the end of the audit log by an interrupted run",
+		Long: `Remove a partial entry left at the end of the audit log by an interrupted run.
+
+Encrypt and decrypt refuse to append to a log that ends in a partial entry.
+repair cuts it off and appends a "repair" entry with its size and SHA-256, so
+the removal is itself part of the chain. Run ` + "`a audit verify`" + ` afterwards.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			path, err := logPath()
+			if err != nil {
+				return err
+			}
+			e, ok, err := repairAudit(path)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				_, err = fmt.Fprintln(cmd.OutOrStdout(), "Nothing to repair: the audit log ends in a complete entry")
+				return err
+			}
+			_, err = fmt.Fprintf(cmd.OutOrStdout(), "Repaired: %s (sha256 %s); recorded as entry %d\n",
+				e.Note, e.InputSHA256, e.Seq)
+			return err
+		},
+	}
+
+	cmd.AddCommand(verify, show, repair)
+	return cmd
+}
+
+// printAuditEntries prints the entries at or after since, one per line.
+func printAuditEntries(w io.Writer, entries []auditEntry, since time.Time, asJSON bool) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if e.Time.Before(since) {
+			continue
+		}
+		var err error
+		if asJSON {
+			err = enc.Encode(e)
+		} else {
+			who := e.User
+			if e.Host != "" {
+				who += "@" + e.Host
+			}
+			detail := strings.Join(e.Recipients, ",")
+			switch e.Operation {
+			case "decrypt":
+				detail = strings.Join(e.Identity, ",")
+			case "repair":
+				detail = e.Note
+			}
+			_, err = fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s → %s\t%s\n", e.Seq, e.Time.Format(time.RFC3339),
+				e.Operation, who, e.Input, e.Output, detail)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// auditRoundTrip encrypts and decrypts a file with auditing on and returns the
+// config and the SSH key pair used.
+func auditRoundTrip(t *testing.T) (cfg *Config, priv, pub string) {
+	t.Helper()
+	dir := t.TempDir()
+	priv, pub = makeSSHKey(t, dir)
+	cfg = &Config{AuditLogPath: filepath.Join(dir, "audit", "audit.jsonl")}
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("audited"), 0o600))
+
+	_, err := runRoot(t, Encrypt(cfg, discardLogger()), "encrypt", in, "-r", pub)
+	require.NoError(t, err)
+	_, err = runRoot(t, Decrypt(cfg, discardLogger()),
+		"decrypt", in+".age", "-o", filepath.Join(dir, "out.txt"), "--ssh-key", priv)
+	require.NoError(t, err)
+	return cfg, priv, pub
+}
+
+func TestAudit_RecordsOperations(t *testing.T) {
+	cfg, priv, pub := auditRoundTrip(t)
+	entries, err := readAuditLog(cfg.AuditLogPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	pubData, err := os.ReadFile(pub) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+	require.NoError(t, err)
+	fp := ssh.FingerprintSHA256(key)
+
+	enc, dec := entries[0], entries[1]
+	assert.Equal(t, int64(1), enc.Seq)
+	assert.Equal(t, "encrypt", enc.Operation)
+	assert.Equal(t, []string{fp}, enc.Recipients)
+	assert.Empty(t, enc.Prev)
+	sum, err := fileSHA256(enc.Input)
+	require.NoError(t, err)
+	assert.Equal(t, sum, enc.InputSHA256)
+	assert.WithinDuration(t, time.Now(), enc.Time, time.Minute)
+
+	assert.Equal(t, int64(2), dec.Seq)
+	assert.Equal(t, "decrypt", dec.Operation)
+	assert.Equal(t, enc.Hash, dec.Prev)
+	assert.Equal(t, enc.OutputSHA256, dec.InputSHA256)
+	assert.Equal(t, enc.InputSHA256, dec.OutputSHA256)
+	assert.Equal(t, priv, dec.IdentityFile)
+	assert.Equal(t, []string{fp}, dec.Identity)
+
+	out, err := runRoot(t, Audit(cfg), "audit", "verify", "--expect", enc.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, "OK\t2 entries\thead "+dec.Hash+"\n", out)
+
+	info, err := os.Stat(cfg.AuditLogPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+// Without audit_log_path nothing is written and the audit commands say how to
+// turn it on.
+func TestAudit_Disabled(t *testing.T) {
+	_, err := runRoot(t, Audit(&Config{}), "audit", "verify")
+	require.ErrorContains(t, err, "audit_log_path")
+	assert.Equal(t, ExitConfig, ExitCode(err))
+}
+
+func TestAuditVerify_DetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, path string, lines []string)
+		want   string
+	}{
+		{
+			name: "edited entry",
+			tamper: func(t *testing.T, path string, lines []string) {
+				lines[0] = strings.Replace(lines[0], `"operation":"encrypt"`, `"operation":"decrypt"`, 1)
+				writeLines(t, path, lines)
+			},
+			want: "entry 1: contents do not match",
+		},
+		{
+			name: "removed entry",
+			tamper: func(t *testing.T, path string, lines []string) {
+				writeLines(t, path, lines[1:])
+			},
+			want: "sequence number 2",
+		},
+		{
+			name: "truncated log",
+			tamper: func(t *testing.T, path string, lines []string) {
+				writeLines(t, path, lines[:1])
+			},
+			want: "truncated: the head records 2 entries, the log has 1",
+		},
+		{
+			name: "truncated log and head",
+			tamper: func(t *testing.T, path string, lines []string) {
+				writeLines(t, path, nil)
+				require.NoError(t, os.Remove(path+".head"))
+			},
+			want: "no entry has the expected hash",
+		},
+		{
+			name: "partial last entry",
+			tamper: func(t *testing.T, path string, lines []string) {
+				require.NoError(t, os.WriteFile(path, []byte(lines[0]+"\n"+lines[1][:20]), 0o600))
+			},
+			want: "line 2: truncated entry",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, _ := auditRoundTrip(t)
+			data, err := os.ReadFile(cfg.AuditLogPath)
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			require.Len(t, lines, 2)
+			var last auditEntry
+			require.NoError(t, json.Unmarshal([]byte(lines[1]), &last))
+
+			tt.tamper(t, cfg.AuditLogPath, lines)
+			_, err = runRoot(t, Audit(cfg), "audit", "verify", "--expect", last.Hash)
+			require.ErrorContains(t, err, tt.want)
+			assert.Equal(t, ExitTampered, ExitCode(err))
+		})
+	}
+}
+
+// A run that stops mid-append leaves a partial entry that blocks auditing until
+// `audit repair` cuts it off and records that in the chain.
+func TestAuditRepair(t *testing.T) {
+	cfg, priv, pub := auditRoundTrip(t)
+	out, err := runRoot(t, Audit(cfg), "audit", "repair")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Nothing to repair")
+
+	data, err := os.ReadFile(cfg.AuditLogPath)
+	require.NoError(t, err)
+	partial := `{"seq":3,"time":"2026-`
+	require.NoError(t, os.WriteFile(cfg.AuditLogPath, append(data, partial...), 0o600))
+
+	dir := filepath.Dir(priv)
+	in := filepath.Join(dir, "more.txt")
+	require.NoError(t, os.WriteFile(in, []byte("more"), 0o600))
+	_, err = runRoot(t, Encrypt(cfg, discardLogger()), "encrypt", in, "-r", pub)
+	require.ErrorContains(t, err, "run `a audit repair`")
+
+	out, err = runRoot(t, Audit(cfg), "audit", "repair")
+	require.NoError(t, err)
+	sum := sha256.Sum256([]byte(partial))
+	assert.Equal(t, fmt.Sprintf("Repaired: removed a partial entry of %d bytes (sha256 %s); recorded as entry 3\n",
+		len(partial), hex.EncodeToString(sum[:])), out)
+
+	_, err = runRoot(t, Encrypt(cfg, discardLogger()), "encrypt", in, "-r", pub, "--force")
+	require.NoError(t, err)
+	entries, err := readAuditLog(cfg.AuditLogPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.Equal(t, "repair", entries[2].Operation)
+	assert.Equal(t, "encrypt", entries[3].Operation)
+	_, err = runRoot(t, Audit(cfg), "audit", "verify")
+	require.NoError(t, err)
+}
+
+// writeLines replaces the file at path with lines, each newline-terminated.
+func writeLines(t *testing.T, path string, lines []string) {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l + "\n")
+	}
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600))
+}
+
+func TestAuditShow_Since(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	old := time.Now().Add(-72 * time.Hour).UTC()
+	require.NoError(t, appendAudit(path, auditEntry{Time: old, Operation: "encrypt", Input: "old.txt"}))
+	require.NoError(t, appendAudit(path, auditEntry{Time: time.Now().UTC(), Operation: "decrypt", Input: "new.age"}))
+	cfg := &Config{AuditLogPath: path}
+
+	out, err := runRoot(t, Audit(cfg), "audit", "show")
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(out, "\n"))
+
+	out, err = runRoot(t, Audit(cfg), "audit", "show", "--since", "1d")
+	require.NoError(t, err)
+	assert.NotContains(t, out, "old.txt")
+	assert.Contains(t, out, "new.age")
+
+	out, err = runRoot(t, Audit(cfg), "audit", "show", "--since", old.Format(time.RFC3339), "--json")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+	var e auditEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &e))
+	assert.Equal(t, int64(2), e.Seq)
+
+	_, err = runRoot(t, Audit(cfg), "audit", "show", "--since", "yesterday")
+	assert.ErrorContains(t, err, "invalid --since")
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"2026-03-01T08:00:00Z", time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)},
+		{"2026-03-01", time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)},
+		{"36h", now.Add(-36 * time.Hour)},
+		{"7d", now.AddDate(0, 0, -7)},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.in, now)
+		require.NoError(t, err, tt.in)
+		assert.True(t, tt.want.Equal(got), "%s: got %v", tt.in, got)
+	}
+	for _, bad := range []string{"", "-1h", "7w", "x"} {
+		_, err := parseSince(bad, now)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRecipients_AuthorizedKeysFile(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	_, caPub := makeSSHKey(t, t.TempDir())
+	key, ca := pubKeyLine(t, pub), pubKeyLine(t, caPub)
+	ecdsaPriv := filepath.Join(t.TempDir(), "id_ecdsa")
+	// #nosec G204 -- test helper; the path is a test temp dir
+	out, err := exec.Command("ssh-keygen", "-t", "ecdsa", "-N", "", "-f", ecdsaPriv).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	ak := filepath.Join(dir, "authorized_keys")
+	require.NoError(t, os.WriteFile(ak, []byte(strings.Join([]string{
+		"# team keys",
+		`from="10.0.0.0/8",no-pty,command="echo \"hi there\"" ` + key + " alice@laptop",
+		"cert-authority " + ca + " corp-ca",
+		pubKeyLine(t, ecdsaPriv+".pub") + " bob@old",
+		"",
+	}, "\n")), 0o600))
+
+	var logs bytes.Buffer
+	recips, err := resolveRefs(t, []string{ak}, slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	})))
+	require.NoError(t, err)
+	require.Len(t, recips, 1, "the cert-authority and ECDSA lines are skipped")
+	assert.Contains(t, logs.String(), "name=alice@laptop", "the comment names the recipient")
+	assert.Contains(t, logs.String(), "name=corp-ca")
+	assert.Contains(t, logs.String(), "cert-authority keys sign certificates")
+	assert.Contains(t, logs.String(), "ecdsa-sha2-nistp256 is not supported")
+
+	plain := filepath.Join(dir, "msg.txt")
+	require.NoError(t, os.WriteFile(plain, []byte("via authorized_keys"), 0o600))
+	enc := filepath.Join(dir, "msg.age")
+	require.NoError(t, encryptFile(context.Background(), plain, enc, recips, outputOptions{}))
+	_, err = decryptFile(context.Background(), priv, filepath.Join(dir, "msg.dec"), enc, outputOptions{})
+	require.NoError(t, err)
+}
+
+func TestParseRecipients_OnlyUnsupportedKeys(t *testing.T) {
+	_, caPub := makeSSHKey(t, t.TempDir())
+	_, err := resolveRefs(t, []string{"cert-authority " + pubKeyLine(t, caPub)}, discardLogger())
+	assert.ErrorContains(t, err, "no valid recipients found")
+}
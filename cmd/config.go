@@ -17,6 +17,14 @@ var configKeys = []string{
 	"default_recipients",
 	"cache_ttl_minutes",
 	"log_file_path",
+	"log_format",
+	"log_level",
+	"log_max_size_mb",
+	"log_max_files",
+	"log_max_age_days",
+	"audit_log_path",
+	"identity_files",
+	"recipient_aliases.<name>",
 }
 
 // ConfigCmd returns the `config` command (alias `c`) for viewing and changing
@@ -26,12 +34,14 @@ func ConfigCmd(cfg *Config, saveConfig func(*Config) error) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:     "config",
 		Aliases: []string{"c"},
-		Short:   "View or change configuration (set|rem|show)",
+		Short:   "View or change configuration (set|rem|show|export|import)",
 		RunE: func(cmd *cobra.Command, _ []string) error {
 			_, err := fmt.Fprintf(cmd.OutOrStdout(), "Usage:\n"+
 				"  a config show             Show current configuration\n"+
 				"  a config set <key> <val>  Set a configuration value\n"+
-				"  a config rem <key>        Reset a configuration value to its default\n\n"+
+				"  a config rem <key>        Reset a configuration value to its default\n"+
+				"  a config export           Print a shareable bundle of settings and recipients\n"+
+				"  a config import <file|->  Merge a bundle into the configuration\n\n"+
 				"Keys: %s\n\n"+
 				"Current configuration:\n%s",
 				strings.Join(configKeys, ", "), formatConfig(cfg))
@@ -41,7 +51,7 @@ func ConfigCmd(cfg *Config, saveConfig func(*Config) error) *cobra.Command {
 
 	save := func(cmd *cobra.Command) error {
 		if err := saveConfig(cfg); err != nil {
-			return err
+			return withClass(classConfig, err)
 		}
 		_, err := fmt.Fprint(cmd.OutOrStdout(), formatConfig(cfg))
 		return err
@@ -63,7 +73,7 @@ func ConfigCmd(cfg *Config, saveConfig func(*Config) error) *cobra.Command {
 			Args:  cobra.MinimumNArgs(2),
 			RunE: func(cmd *cobra.Command, args []string) error {
 				if err := setConfigKey(cfg, args[0], strings.Join(args[1:], " ")); err != nil {
-					return err
+					return withClass(classConfig, err)
 				}
 				return save(cmd)
 			},
@@ -74,11 +84,13 @@ func ConfigCmd(cfg *Config, saveConfig func(*Config) error) *cobra.Command {
 			Args:  cobra.ExactArgs(1),
 			RunE: func(cmd *cobra.Command, args []string) error {
 				if err := setConfigKey(cfg, args[0], ""); err != nil {
-					return err
+					return withClass(classConfig, err)
 				}
 				return save(cmd)
 			},
 		},
+		configExportCmd(cfg),
+		configImportCmd(cfg, saveConfig),
 	)
 
 	return cmd
@@ -87,6 +99,10 @@ func ConfigCmd(cfg *Config, saveConfig func(*Config) error) *cobra.Command {
 // setConfigKey sets one configuration field by its YAML key name. An empty value
 // resets the field to its zero value (used by `rem`).
 func setConfigKey(cfg *Config, key, value string) error {
+	if name, ok := strings.CutPrefix(key, "recipient_aliases."); ok && name != "" {
+		setRecipientAlias(cfg, name, splitList(value))
+		return nil
+	}
 	switch key {
 	case "ssh_key_path":
 		cfg.SSHKeyPath = value
@@ -94,22 +110,28 @@ func setConfigKey(cfg *Config, key, value string) error {
 		cfg.GitHubUser = value
 	case "log_file_path":
 		cfg.LogFilePath = value
-	case "default_recipients":
-		if value == "" {
-			cfg.DefaultRecipients = nil
-			break
+	case "audit_log_path":
+		cfg.AuditLogPath = value
+	case "log_format":
+		if value != "" && value != LogFormatJSON && value != LogFormatText {
+			return fmt.Errorf("log_format must be %s or %s", LogFormatJSON, LogFormatText)
 		}
-		var recipients []string
-		for _, p := range strings.Split(value, ",") {
-			if p = strings.TrimSpace(p); p != "" {
-				recipients = append(recipients, p)
-			}
+		cfg.LogFormat = value
+	case "log_level":
+		if _, ok := logLevels[value]; value != "" && !ok {
+			return fmt.Errorf("log_level must be debug, info, warn or error")
 		}
-		cfg.DefaultRecipients = recipients
+		cfg.LogLevel = value
+	case "log_max_size_mb", "log_max_files", "log_max_age_days":
+		return setLogLimit(cfg, key, value)
+	case "default_recipients":
+		cfg.DefaultRecipients = splitList(value)
+	case "identity_files":
+		cfg.IdentityFiles = splitList(value)
 	case "cache_ttl_minutes":
 		if value == "" {
 			// `rem` resets to the documented default; an explicit `set ... 0`
-			// still disables caching (see fetchGitHubKeys).
+			// still disables caching (see agewrap.GitHubSource).
 			cfg.CacheTTLMinutes = defaultCacheTTLMinutes
 			break
 		}
@@ -124,6 +146,55 @@ func setConfigKey(cfg *Config, key, value string) error {
 	return nil
 }
 
+// setLogLimit sets one of the log rotation limits; an empty value or 0 resets
+// it to the default.
+func setLogLimit(cfg *Config, key, value string) error {
+	n := 0
+	if value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("%s must be a non-negative integer", key)
+		}
+	}
+	switch key {
+	case "log_max_size_mb":
+		cfg.LogMaxSizeMB = n
+	case "log_max_files":
+		cfg.LogMaxFiles = n
+	default:
+		cfg.LogMaxAgeDays = n
+	}
+	return nil
+}
+
+// setRecipientAlias sets the members of the alias name, or removes it when
+// members is empty.
+func setRecipientAlias(cfg *Config, name string, members []string) {
+	if len(members) == 0 {
+		delete(cfg.RecipientAliases, name)
+		if len(cfg.RecipientAliases) == 0 {
+			cfg.RecipientAliases = nil
+		}
+		return
+	}
+	if cfg.RecipientAliases == nil {
+		cfg.RecipientAliases = map[string][]string{}
+	}
+	cfg.RecipientAliases[name] = members
+}
+
+// splitList splits a comma-separated value into trimmed, non-empty items; an
+// empty value yields nil.
+func splitList(value string) []string {
+	var items []string
+	for p := range strings.SplitSeq(value, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			items = append(items, p)
+		}
+	}
+	return items
+}
+
 // formatConfig renders the config as YAML for display.
 func formatConfig(cfg *Config) string {
 	data, err := yaml.Marshal(cfg)
@@ -0,0 +1,421 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// configBundle is the shareable subset of Config exchanged by `config export`
+// and `config import`. It deliberately has no private key or log paths: those
+// are machine-local and must never travel with a bundle.
+type configBundle struct {
+	Version           int      `yaml:"version"                      json:"version"`
+	GitHubUser        string   `yaml:"github_user,omitempty"        json:"github_user,omitempty"`
+	DefaultRecipients []string `yaml:"default_recipients,omitempty" json:"default_recipients,omitempty"`
+	CacheTTLMinutes   int      `yaml:"cache_ttl_minutes,omitempty"  json:"cache_ttl_minutes,omitempty"`
+
+	RecipientAliases map[string][]string `yaml:"recipient_aliases,omitempty" json:"recipient_aliases,omitempty"`
+}
+
+// maxBundleBytes caps how much of an imported bundle we read into memory.
+const maxBundleBytes = 1 << 20 // 1 MiB
+
+// configExportCmd returns `config export`, which prints a shareable bundle.
+func configExportCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Print a shareable bundle of settings and recipients",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			only, _ := cmd.Flags().GetString("only")
+			format, _ := cmd.Flags().GetString("format")
+			bundle, err := exportBundle(cfg, only)
+			if err != nil {
+				return err
+			}
+			data, err := marshalBundle(bundle, format)
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(data)
+			return err
+		},
+	}
+	cmd.Flags().String("only", "", "Export only one section (recipients)")
+	cmd.Flags().String("format", "yaml", "Bundle format (yaml|json)")
+	return cmd
+}
+
+// configImportCmd returns `config import`, which merges a bundle into cfg after
+// showing the resulting changes and asking for confirmation.
+func configImportCmd(cfg *Config, saveConfig func(*Config) error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <file|->",
+		Short: "Merge a bundle from a file or stdin (-) into the configuration",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			yes, _ := cmd.Flags().GetBool("yes")
+			fromStdin := args[0] == "-"
+			if fromStdin && !yes {
+				// stdin carries the bundle, so there is nothing left to answer the prompt with.
+				return errors.New("reading the bundle from stdin leaves no way to confirm; pass --yes")
+			}
+			data, err := readBundleSource(cmd.InOrStdin(), args[0])
+			if err != nil {
+				return err
+			}
+			bundle, err := parseBundle(data)
+			if err != nil {
+				return err
+			}
+
+			merged := *cfg
+			mergeBundle(&merged, bundle)
+			diff := diffLines(formatConfig(cfg), formatConfig(&merged))
+			out := cmd.OutOrStdout()
+			if diff == "" {
+				_, err := fmt.Fprintln(out, "No changes.")
+				return err
+			}
+			if _, err := fmt.Fprint(out, diff); err != nil {
+				return err
+			}
+			if !yes {
+				ok, err := confirm(commandContext(cmd), cmd.InOrStdin(), out, "Apply these changes?")
+				if err != nil {
+					return err
+				}
+				if !ok {
+					_, err := fmt.Fprintln(out, "Aborted.")
+					return err
+				}
+			}
+			*cfg = merged
+			if err := saveConfig(cfg); err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(out, "Configuration updated.")
+			return err
+		},
+	}
+	cmd.Flags().BoolP("yes", "y", false, "Apply without asking for confirmation")
+	return cmd
+}
+
+// exportBundle builds the bundle for cfg. Recipient entries that name local
+// files are expanded to the key lines they contain, so the bundle is usable on
+// a machine that does not have those files. References resolved on each
+// machine ("github:", "@" and "host:") are kept as they are, with the aliases
+// they may name.
+func exportBundle(cfg *Config, only string) (*configBundle, error) {
+	recipients, err := exportRecipients(cfg.DefaultRecipients)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &configBundle{Version: currentConfigVersion, DefaultRecipients: recipients}
+	for name, members := range cfg.RecipientAliases {
+		expanded, err := exportRecipients(members)
+		if err != nil {
+			return nil, fmt.Errorf("alias %q: %w", name, err)
+		}
+		if bundle.RecipientAliases == nil {
+			bundle.RecipientAliases = map[string][]string{}
+		}
+		bundle.RecipientAliases[name] = expanded
+	}
+	switch only {
+	case "recipients":
+	case "":
+		bundle.GitHubUser = cfg.GitHubUser
+		bundle.CacheTTLMinutes = cfg.CacheTTLMinutes
+	default:
+		return nil, fmt.Errorf("unknown export section %q: want recipients", only)
+	}
+	return bundle, nil
+}
+
+// exportRecipients turns recipient entries into bundle entries: references
+// stay, files are inlined, and authorized_keys lines lose their options, which
+// mean nothing to age. Keys that cannot be recipients (cert-authority lines,
+// unsupported key types) are left out.
+func exportRecipients(entries []string) ([]string, error) {
+	var out []string
+	for _, in := range entries {
+		if isRecipientReference(in) {
+			out = append(out, in)
+			continue
+		}
+		lines, err := agewrap.ReadRecipientLines(in)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			k, isKey, err := agewrap.ParseAuthorizedKey(line)
+			switch {
+			case !isKey:
+				out = append(out, line)
+			case err != nil:
+				return nil, fmt.Errorf("recipient %q: %w", line, err)
+			case k.Skip == "":
+				out = append(out, bareAuthorizedKey(line))
+			}
+		}
+	}
+	return out, nil
+}
+
+// isRecipientReference reports whether a recipient entry is resolved on each
+// machine rather than being a key or a file.
+func isRecipientReference(ref string) bool {
+	for _, prefix := range []string{agewrap.GitHubPrefix, aliasRecipientPrefix, hostRecipientPrefix} {
+		if strings.HasPrefix(ref, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// bareAuthorizedKey returns an authorized_keys line without its options: the
+// key type, the key and the comment.
+func bareAuthorizedKey(line string) string {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return line
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		key += " " + comment
+	}
+	return key
+}
+
+// marshalBundle renders a bundle as YAML or JSON.
+func marshalBundle(bundle *configBundle, format string) ([]byte, error) {
+	switch format {
+	case "yaml":
+		return yaml.Marshal(bundle)
+	case "json":
+		data, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unsupported bundle format %q: want yaml or json", format)
+	}
+}
+
+// readBundleSource reads a bundle from path, or from stdin when path is "-".
+func readBundleSource(stdin io.Reader, path string) ([]byte, error) {
+	src := stdin
+	if path != "-" {
+		// #nosec G304 -- the bundle path is user-provided by design
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening bundle: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		src = f
+	}
+	data, err := io.ReadAll(io.LimitReader(src, maxBundleBytes))
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle: %w", err)
+	}
+	return data, nil
+}
+
+// parseBundle decodes a YAML or JSON bundle (JSON is valid YAML). Unknown keys,
+// including machine-local ones such as ssh_key_path, are rejected, and every
+// recipient must parse.
+func parseBundle(data []byte) (*configBundle, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var bundle configBundle
+	if err := dec.Decode(&bundle); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("bundle is empty")
+		}
+		return nil, fmt.Errorf("parsing bundle: %w", err)
+	}
+	if bundle.Version > currentConfigVersion {
+		return nil, fmt.Errorf("bundle version %d is newer than this build supports (%d)",
+			bundle.Version, currentConfigVersion)
+	}
+	if bundle.GitHubUser != "" && !agewrap.ValidGitHubUser(bundle.GitHubUser) {
+		return nil, fmt.Errorf("bundle has an invalid github_user %q", bundle.GitHubUser)
+	}
+	for _, r := range bundle.DefaultRecipients {
+		if err := checkBundleRecipient(&bundle, r); err != nil {
+			return nil, fmt.Errorf("bundle has an invalid recipient %q: %w", r, err)
+		}
+	}
+	for name, members := range bundle.RecipientAliases {
+		if name == "" || len(members) == 0 {
+			return nil, fmt.Errorf("bundle has an invalid alias %q: it needs a name and members", name)
+		}
+		for _, r := range members {
+			if err := checkBundleRecipient(&bundle, r); err != nil {
+				return nil, fmt.Errorf("bundle alias %q has an invalid recipient %q: %w", name, r, err)
+			}
+		}
+	}
+	return &bundle, nil
+}
+
+// checkBundleRecipient validates one bundle recipient without reading any
+// file: a bundle must not point at local files. Keys must parse, "github:"
+// must name a valid user, "@" an alias defined in the bundle, and "host:" a
+// host, which is looked up in the importer's own known_hosts when used.
+func checkBundleRecipient(bundle *configBundle, ref string) error {
+	ref = strings.TrimSpace(ref)
+	if user, ok := strings.CutPrefix(ref, agewrap.GitHubPrefix); ok {
+		if !agewrap.ValidGitHubUser(user) {
+			return errors.New("not a valid GitHub username")
+		}
+		return nil
+	}
+	if name, ok := strings.CutPrefix(ref, aliasRecipientPrefix); ok {
+		if _, ok := bundle.RecipientAliases[name]; !ok {
+			return errors.New("the alias is not defined in the bundle")
+		}
+		return nil
+	}
+	if host, ok := strings.CutPrefix(ref, hostRecipientPrefix); ok {
+		if host == "" || strings.ContainsAny(host, " \t") {
+			return errors.New("not a host name")
+		}
+		return nil
+	}
+	if k, isKey, err := agewrap.ParseAuthorizedKey(ref); isKey {
+		if err == nil && k.Skip != "" {
+			err = errors.New(k.Skip)
+		}
+		return err
+	}
+	_, err := parseRecipient(ref)
+	return err
+}
+
+// mergeBundle folds a bundle into cfg: recipients are added when not already
+// present, and aliases and scalar settings present in the bundle replace the
+// local values.
+func mergeBundle(cfg *Config, bundle *configBundle) {
+	recipients := slices.Clone(cfg.DefaultRecipients)
+	for _, r := range bundle.DefaultRecipients {
+		if r = strings.TrimSpace(r); !slices.Contains(recipients, r) {
+			recipients = append(recipients, r)
+		}
+	}
+	cfg.DefaultRecipients = recipients
+	// merged configs are shallow copies, so the alias map is copied before it
+	// changes: declining an import must leave the original untouched.
+	cfg.RecipientAliases = maps.Clone(cfg.RecipientAliases)
+	for name, members := range bundle.RecipientAliases {
+		trimmed := make([]string, len(members))
+		for i, m := range members {
+			trimmed[i] = strings.TrimSpace(m)
+		}
+		setRecipientAlias(cfg, name, trimmed)
+	}
+	if bundle.GitHubUser != "" {
+		cfg.GitHubUser = bundle.GitHubUser
+	}
+	if bundle.CacheTTLMinutes > 0 {
+		cfg.CacheTTLMinutes = bundle.CacheTTLMinutes
+	}
+}
+
+// diffLines returns a minimal line diff from a to b ("-" removed, "+" added,
+// " " unchanged), or "" when they are equal.
+func diffLines(a, b string) string {
+	if a == b {
+		return ""
+	}
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			sb.WriteString("  " + x[i] + "\n")
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("- " + x[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+ " + y[j] + "\n")
+			j++
+		}
+	}
+	return sb.String()
+}
+
+// confirm asks a yes/no question on out and reads the answer from in. Anything
+// other than "y" or "yes" (including EOF) is a no.
+func confirm(ctx context.Context, in io.Reader, out io.Writer, question string) (bool, error) {
+	if _, err := fmt.Fprintf(out, "%s [y/N] ", question); err != nil {
+		return false, err
+	}
+	// The read cannot be interrupted, so it runs aside: an interrupt at the
+	// prompt returns at once rather than waiting for a line that never comes.
+	type reply struct {
+		answer string
+		err    error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		answer, err := bufio.NewReader(in).ReadString('\n')
+		replies <- reply{answer, err}
+	}()
+	var r reply
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case r = <-replies:
+	}
+	if r.err != nil && !errors.Is(r.err, io.EOF) {
+		return false, r.err
+	}
+	switch strings.ToLower(strings.TrimSpace(r.answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
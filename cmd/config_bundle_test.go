@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBundleKey = "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+
+// runConfigIO is runConfig with stdin and a recording save callback.
+func runConfigIO(t *testing.T, cfg *Config, stdin string, args ...string) (out string, saved bool, err error) {
+	t.Helper()
+	c := ConfigCmd(cfg, func(*Config) error { saved = true; return nil })
+	var buf bytes.Buffer
+	c.SetOut(&buf)
+	c.SetErr(&buf)
+	c.SetIn(strings.NewReader(stdin))
+	c.SetArgs(args)
+	err = c.Execute()
+	return buf.String(), saved, err
+}
+
+func TestConfigExport_OmitsLocalPathsAndInlinesFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	pubLine, err := os.ReadFile(pub) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+
+	cfg := &Config{
+		SSHKeyPath:        "/home/me/.ssh/id_ed25519",
+		LogFilePath:       "/home/me/.state/a/cli.log",
+		GitHubUser:        "octocat",
+		DefaultRecipients: []string{pub, testBundleKey},
+		CacheTTLMinutes:   60,
+	}
+	out, _, err := runConfigIO(t, cfg, "", "export")
+	require.NoError(t, err)
+	assert.NotContains(t, out, "ssh_key_path")
+	assert.NotContains(t, out, "cli.log")
+	assert.NotContains(t, out, pub, "file paths are replaced by their contents")
+	assert.Contains(t, out, strings.TrimSpace(string(pubLine)))
+	assert.Contains(t, out, "github_user: octocat")
+
+	out, _, err = runConfigIO(t, cfg, "", "export", "--only", "recipients", "--format", "json")
+	require.NoError(t, err)
+	assert.Contains(t, out, `"default_recipients"`)
+	assert.NotContains(t, out, "github_user")
+
+	_, _, err = runConfigIO(t, cfg, "", "export", "--only", "keys")
+	assert.ErrorContains(t, err, "unknown export section")
+	_, _, err = runConfigIO(t, cfg, "", "export", "--format", "toml")
+	assert.ErrorContains(t, err, "unsupported bundle format")
+}
+
+func TestConfigImport_ConfirmAndMerge(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "team.yaml")
+	require.NoError(t, os.WriteFile(bundle,
+		[]byte("version: 1\ngithub_user: team\ndefault_recipients:\n  - "+testBundleKey+"\n  - existing\n"), 0o600))
+
+	// Declining leaves the config untouched and does not save.
+	cfg := &Config{DefaultRecipients: []string{"existing"}}
+	_, saved, err := runConfigIO(t, cfg, "n\n", "import", bundle)
+	require.ErrorContains(t, err, "invalid recipient", "'existing' is not a literal key")
+	assert.False(t, saved)
+
+	require.NoError(t, os.WriteFile(bundle,
+		[]byte("version: 1\ngithub_user: team\ndefault_recipients:\n  - "+testBundleKey+"\n"), 0o600))
+	out, saved, err := runConfigIO(t, cfg, "n\n", "import", bundle)
+	require.NoError(t, err)
+	assert.False(t, saved)
+	assert.Regexp(t, `(?m)^\+ +- `+testBundleKey+`$`, out)
+	assert.Contains(t, out, `- github_user: ""`)
+	assert.Contains(t, out, "Aborted.")
+	assert.Equal(t, []string{"existing"}, cfg.DefaultRecipients)
+
+	out, saved, err = runConfigIO(t, cfg, "yes\n", "import", bundle)
+	require.NoError(t, err)
+	assert.True(t, saved)
+	assert.Contains(t, out, "Configuration updated.")
+	assert.Equal(t, []string{"existing", testBundleKey}, cfg.DefaultRecipients)
+	assert.Equal(t, "team", cfg.GitHubUser)
+
+	// Importing the same bundle again is a no-op.
+	out, saved, err = runConfigIO(t, cfg, "", "import", bundle)
+	require.NoError(t, err)
+	assert.False(t, saved)
+	assert.Contains(t, out, "No changes.")
+}
+
+func TestConfigImport_Stdin(t *testing.T) {
+	cfg := &Config{}
+	stdin := `{"version": 1, "default_recipients": ["` + testBundleKey + `"]}`
+	_, _, err := runConfigIO(t, cfg, stdin, "import", "-")
+	assert.ErrorContains(t, err, "pass --yes")
+
+	_, saved, err := runConfigIO(t, cfg, stdin, "import", "-", "--yes")
+	require.NoError(t, err)
+	assert.True(t, saved)
+	assert.Equal(t, []string{testBundleKey}, cfg.DefaultRecipients)
+}
+
+func TestParseBundle_Rejects(t *testing.T) {
+	_, err := parseBundle(nil)
+	assert.ErrorContains(t, err, "empty")
+	_, err = parseBundle([]byte("ssh_key_path: /home/me/.ssh/id_rsa\n"))
+	assert.ErrorContains(t, err, "parsing bundle", "machine-local keys are not part of a bundle")
+	_, err = parseBundle([]byte("version: 99\n"))
+	assert.ErrorContains(t, err, "newer than this build")
+	_, err = parseBundle([]byte("github_user: 'bad user'\n"))
+	assert.ErrorContains(t, err, "invalid github_user")
+
+	_, err = readBundleSource(nil, filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorContains(t, err, "opening bundle")
+}
+
+func TestDiffLines(t *testing.T) {
+	assert.Empty(t, diffLines("a\nb\n", "a\nb\n"))
+	assert.Equal(t, "  a\n- b\n+ c\n", diffLines("a\nb\n", "a\nc\n"))
+}
+
+// Everything export writes, import must accept: references stay references,
+// aliases travel with them, and authorized_keys options are dropped.
+func TestConfigBundle_ExportImportRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	pubLine, err := os.ReadFile(pub) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	key := strings.TrimSpace(string(pubLine))
+
+	cfg := &Config{
+		GitHubUser: "octocat",
+		DefaultRecipients: []string{
+			"github:octocat", "@team", "host:db1.example.com", `from="10.0.0.0/8",no-pty ` + key,
+		},
+		RecipientAliases: map[string][]string{"team": {pub, testBundleKey}},
+	}
+	out, _, err := runConfigIO(t, cfg, "", "export")
+	require.NoError(t, err)
+	assert.NotContains(t, out, "no-pty")
+	assert.NotContains(t, out, pub)
+
+	bundle := filepath.Join(t.TempDir(), "b.yaml")
+	require.NoError(t, os.WriteFile(bundle, []byte(out), 0o600))
+	imported := &Config{RecipientAliases: map[string][]string{"mine": {"github:me"}}}
+	_, saved, err := runConfigIO(t, imported, "", "import", bundle, "--yes")
+	require.NoError(t, err)
+	assert.True(t, saved)
+	assert.Equal(t, []string{"github:octocat", "@team", "host:db1.example.com", key}, imported.DefaultRecipients)
+	assert.Equal(t, map[string][]string{"team": {key, testBundleKey}, "mine": {"github:me"}},
+		imported.RecipientAliases)
+
+	// Declining an import leaves the aliases alone.
+	declined := &Config{RecipientAliases: map[string][]string{"mine": {"github:me"}}}
+	_, _, err = runConfigIO(t, declined, "n\n", "import", bundle)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"mine": {"github:me"}}, declined.RecipientAliases)
+
+	for _, bad := range []string{
+		"default_recipients: ['@nobody']",
+		"default_recipients: ['github:bad user']",
+		"default_recipients: ['host:']",
+		"default_recipients: ['cert-authority " + key + "']",
+		"recipient_aliases: {team: ['/etc/passwd']}",
+	} {
+		_, err := parseBundle([]byte(bad))
+		assert.ErrorContains(t, err, "invalid", bad)
+	}
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// currentConfigVersion is the config schema version this build reads and writes.
+// It must equal len(configMigrations).
+const currentConfigVersion = 1
+
+// configMigration upgrades a raw config document by one schema version, in place.
+type configMigration func(raw map[string]any) error
+
+// configMigrations[i] upgrades a document from version i to version i+1. To
+// change the schema, append a migration and bump currentConfigVersion; never
+// edit or reorder an existing entry, since old files on disk depend on them.
+var configMigrations = []configMigration{
+	// 0 -> 1: unversioned files predate the version key; the layout is unchanged.
+	func(map[string]any) error { return nil },
+}
+
+// decodeConfig parses a config file's contents, upgrading older schema versions.
+//
+// Unknown keys are rejected (with a suggestion when one is close to a known key)
+// rather than silently ignored, so a typo such as "default_recipient" cannot
+// quietly drop a setting. The boolean reports whether a migration ran, in which
+// case the caller should persist the upgraded config.
+func decodeConfig(data []byte) (*Config, bool, error) {
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, false, err
+	}
+	if raw == nil {
+		raw = map[string]any{}
+	}
+
+	version, err := rawConfigVersion(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	if version > currentConfigVersion {
+		return nil, false, fmt.Errorf(
+			"config version %d is newer than this build supports (%d); upgrade a", version, currentConfigVersion)
+	}
+	migrated := version < currentConfigVersion
+	for v := version; v < currentConfigVersion; v++ {
+		if err := configMigrations[v](raw); err != nil {
+			return nil, false, fmt.Errorf("migrating config from version %d to %d: %w", v, v+1, err)
+		}
+	}
+	raw["version"] = currentConfigVersion
+
+	if err := checkConfigKeys(raw); err != nil {
+		return nil, false, err
+	}
+
+	// Round-trip the upgraded document through a strict decoder so type errors
+	// are reported against the current schema.
+	upgraded, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(upgraded))
+	dec.KnownFields(true)
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, false, err
+	}
+	return &cfg, migrated, nil
+}
+
+// rawConfigVersion reads the version key from a raw document; absent means 0.
+func rawConfigVersion(raw map[string]any) (int, error) {
+	v, ok := raw["version"]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	n, ok := v.(int)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("config version must be a non-negative integer, got %v", v)
+	}
+	return n, nil
+}
+
+// checkConfigKeys reports every top-level key that is not part of the schema.
+func checkConfigKeys(raw map[string]any) error {
+	known := knownConfigKeys()
+	var errs []error
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if slices.Contains(known, k) {
+			continue
+		}
+		if s := suggestKey(k, known); s != "" {
+			errs = append(errs, fmt.Errorf("unknown config key %q (did you mean %q?)", k, s))
+		} else {
+			errs = append(errs, fmt.Errorf("unknown config key %q", k))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// knownConfigKeys returns the YAML keys of every persisted Config field.
+func knownConfigKeys() []string {
+	t := reflect.TypeFor[Config]()
+	keys := make([]string, 0, t.NumField())
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name != "" && name != "-" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// suggestKey returns the known key closest to key, or "" when none is close
+// enough to plausibly be what the user meant.
+func suggestKey(key string, known []string) string {
+	best, bestDist := "", 0
+	for _, k := range known {
+		d := editDistance(key, k)
+		if best == "" || d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	if best == "" || bestDist > max(2, len(key)/3) {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// backupConfig copies the pre-migration config to cfgFile.bak (0600) so a user
+// can recover it if the upgraded file is not what they expected.
+func backupConfig(cfgFile string, data []byte) error {
+	// #nosec G703 -- cfgFile is supplied by InitConfigPaths (os.UserConfigDir-derived), not user input
+	if err := os.WriteFile(cfgFile+".bak", data, 0o600); err != nil {
+		return fmt.Errorf("backing up config before migration: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigMigrationsMatchVersion(t *testing.T) {
+	assert.Len(t, configMigrations, currentConfigVersion, "one migration per schema version")
+}
+
+func TestDecodeConfig_UnknownKeySuggestion(t *testing.T) {
+	_, _, err := decodeConfig([]byte("version: 1\ndefault_recipient: [a.pub]\nbogus_setting: 1\n"))
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `unknown config key "default_recipient" (did you mean "default_recipients"?)`)
+	assert.ErrorContains(t, err, `unknown config key "bogus_setting"`)
+	assert.NotContains(t, err.Error(), `"bogus_setting" (did you mean`, "no suggestion for a distant key")
+}
+
+func TestDecodeConfig_Versions(t *testing.T) {
+	cfg, migrated, err := decodeConfig([]byte("github_user: old\n"))
+	require.NoError(t, err)
+	assert.True(t, migrated, "an unversioned file must be migrated")
+	assert.Equal(t, currentConfigVersion, cfg.Version)
+	assert.Equal(t, "old", cfg.GitHubUser)
+
+	_, migrated, err = decodeConfig([]byte("version: 1\ngithub_user: cur\n"))
+	require.NoError(t, err)
+	assert.False(t, migrated, "a current file needs no migration")
+
+	_, _, err = decodeConfig([]byte("version: 99\n"))
+	assert.ErrorContains(t, err, "newer than this build supports")
+
+	_, _, err = decodeConfig([]byte("version: -1\n"))
+	assert.ErrorContains(t, err, "non-negative integer")
+
+	_, _, err = decodeConfig([]byte("version: 1\ncache_ttl_minutes: soon\n"))
+	assert.Error(t, err, "type errors are reported against the schema")
+
+	cfg, _, err = decodeConfig(nil)
+	require.NoError(t, err, "an empty file is a valid, unversioned config")
+	assert.Equal(t, currentConfigVersion, cfg.Version)
+}
+
+func TestDecodeConfig_MigrationError(t *testing.T) {
+	orig := configMigrations
+	t.Cleanup(func() { configMigrations = orig })
+	configMigrations = []configMigration{func(map[string]any) error { return assert.AnError }}
+
+	_, _, err := decodeConfig([]byte("github_user: x\n"))
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.ErrorContains(t, err, "from version 0 to 1")
+}
+
+// Loading an old file rewrites it at the current version and keeps the original
+// bytes as a .bak.
+func TestLoadConfig_MigratesInPlaceWithBackup(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	orig := []byte("github_user: legacy\n")
+	require.NoError(t, os.WriteFile(p, orig, 0o600))
+
+	cfg, err := LoadConfig(p)
+	require.NoError(t, err)
+	assert.Equal(t, "legacy", cfg.GitHubUser)
+
+	bak, err := os.ReadFile(p + ".bak") // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, orig, bak, "backup holds the pre-migration bytes")
+
+	data, err := os.ReadFile(p) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "version: 1")
+
+	info, err := os.Stat(p)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestLoadConfig_RejectsUnknownKeys(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(p, []byte("version: 1\ngithub_usr: x\n"), 0o600))
+	_, err := LoadConfig(p)
+	assert.ErrorContains(t, err, `did you mean "github_user"`)
+}
+
+func TestLoadConfig_BackupError(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(p, []byte("github_user: x\n"), 0o600))
+	require.NoError(t, os.Mkdir(p+".bak", 0o700)) // a directory blocks the backup write
+	_, err := LoadConfig(p)
+	assert.ErrorContains(t, err, "backing up config")
+}
+
+func TestSuggestKey(t *testing.T) {
+	known := []string{"ssh_key_path", "github_user"}
+	assert.Equal(t, "ssh_key_path", suggestKey("ssh_keypath", known))
+	assert.Empty(t, suggestKey("colour", known))
+	assert.Empty(t, suggestKey("x", nil))
+}
@@ -17,17 +17,48 @@ const defaultCacheTTLMinutes = 120
 
 // Config represents the application's YAML configuration.
 type Config struct {
+	// Version is the schema version of the file; see configMigrations.
+	Version int `yaml:"version"`
+
 	SSHKeyPath        string   `yaml:"ssh_key_path"`
 	GitHubUser        string   `yaml:"github_user"`
 	DefaultRecipients []string `yaml:"default_recipients"`
 	CacheTTLMinutes   int      `yaml:"cache_ttl_minutes"`
 	LogFilePath       string   `yaml:"log_file_path"`
+	// LogFormat is the log file's format, LogFormatJSON (the default when
+	// empty) or LogFormatText.
+	LogFormat string `yaml:"log_format,omitempty"`
+	// LogLevel is the log file's minimum level (debug, info, warn or error);
+	// info when empty. -v lowers it to debug.
+	LogLevel string `yaml:"log_level,omitempty"`
+	// The log file is rotated once it reaches LogMaxSizeMB (default 10), and
+	// LogMaxFiles rotated segments (default 5) are kept, none older than
+	// LogMaxAgeDays when that is set. See RotateLog.
+	LogMaxSizeMB  int `yaml:"log_max_size_mb,omitempty"`
+	LogMaxFiles   int `yaml:"log_max_files,omitempty"`
+	LogMaxAgeDays int `yaml:"log_max_age_days,omitempty"`
+	// AuditLogPath is the hash-chained audit log that encrypt and decrypt
+	// append to; empty disables auditing. See appendAudit.
+	AuditLogPath string `yaml:"audit_log_path,omitempty"`
+	// IdentityFiles are age identity files (native or plugin identities) tried
+	// when decrypting, in addition to the SSH key.
+	IdentityFiles []string `yaml:"identity_files,omitempty"`
+	// RecipientAliases names groups of recipients, used as "@<name>" wherever a
+	// recipient is accepted. Members are any recipient references, including
+	// other aliases.
+	RecipientAliases map[string][]string `yaml:"recipient_aliases,omitempty"`
 
 	// CacheDir is the runtime cache directory (from InitConfigPaths). It is not
 	// persisted to the YAML file; it is populated after loading.
 	CacheDir string `yaml:"-"`
 }
 
+// Values of log_format.
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
 // ConfigPaths holds config and cache file paths.
 type ConfigPaths struct {
 	ConfigFile string
@@ -84,7 +115,8 @@ func InitConfigPaths() (ConfigPaths, error) {
 //
 // cfgFile is supplied by InitConfigPaths (derived from os.UserConfigDir), not from
 // user input, so it is trusted. A missing file yields a default config so callers
-// can bootstrap one.
+// can bootstrap one. Unknown keys are an error, and a file written by an older
+// schema version is upgraded in place (keeping the original as cfgFile.bak).
 func LoadConfig(cfgFile string) (*Config, error) {
 	info, err := os.Stat(cfgFile)
 	if errors.Is(err, os.ErrNotExist) {
@@ -106,14 +138,22 @@ func LoadConfig(cfgFile string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	cfg, migrated, err := decodeConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", cfgFile, err)
+	}
+	if migrated {
+		if err := backupConfig(cfgFile, data); err != nil {
+			return nil, err
+		}
+		if err := SaveConfig(cfgFile, cfg); err != nil {
+			return nil, fmt.Errorf("saving migrated config: %w", err)
+		}
 	}
-	if err := applyConfigDefaults(&cfg); err != nil {
+	if err := applyConfigDefaults(cfg); err != nil {
 		return nil, err
 	}
-	return &cfg, nil
+	return cfg, nil
 }
 
 // applyConfigDefaults fills in derived defaults for any unset fields.
@@ -134,7 +174,9 @@ func applyConfigDefaults(cfg *Config) error {
 // It writes to a temp file (created 0600) in the config directory and renames it
 // over cfgFile, so an interrupted or disk-full write cannot truncate or lose the
 // existing config, and the result is always 0600 (which LoadConfig requires).
+// The file is always written at currentConfigVersion, which is recorded on cfg.
 func SaveConfig(cfgFile string, cfg *Config) (err error) {
+	cfg.Version = currentConfigVersion
 	data, err := yaml.Marshal(cfg)
 	if err != nil {
 		return err
@@ -51,6 +51,10 @@ func TestConfig_SetEachKey(t *testing.T) {
 	_, err = runConfig(t, cfg, "set", "default_recipients", "a.pub,, b.pub,")
 	require.NoError(t, err)
 	assert.Equal(t, []string{"a.pub", "b.pub"}, cfg.DefaultRecipients, "comma-split, trimmed, empties dropped")
+
+	_, err = runConfig(t, cfg, "set", "identity_files", "yubikey.txt, keys.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"yubikey.txt", "keys.txt"}, cfg.IdentityFiles)
 }
 
 func TestConfig_SetRejectsBadKeyAndValue(t *testing.T) {
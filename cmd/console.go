@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// ANSI escapes used on the console.
+const (
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+)
+
+// AddQuietFlag registers the global --quiet flag on root.
+func AddQuietFlag(root *cobra.Command) {
+	root.PersistentFlags().BoolP("quiet", "q", false, "Print only errors on the console")
+}
+
+// Quiet reports whether --quiet is set on cmd or one of its parents.
+func Quiet(cmd *cobra.Command) bool {
+	flag := cmd.Flag("quiet")
+	return flag != nil && flag.Value.String() == "true"
+}
+
+// colorEnabled reports whether w gets ANSI colors: only a terminal does, and
+// never when NO_COLOR is set (https://no-color.org) or TERM is "dumb".
+func colorEnabled(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(w)
+}
+
+// paint wraps s in the given ANSI codes when color is on.
+func paint(color bool, s string, codes ...string) string {
+	if !color {
+		return s
+	}
+	return strings.Join(codes, "") + s + ansiReset
+}
+
+// console prints short status lines for the person at the terminal on stderr.
+// It is separate from the log file, which keeps the full record in log_format.
+type console struct {
+	w     io.Writer
+	color bool
+	quiet bool
+}
+
+// newConsole returns the console for cmd: its stderr, colored when that is a
+// terminal, and silent with --quiet.
+func newConsole(cmd *cobra.Command) *console {
+	w := cmd.ErrOrStderr()
+	return &console{w: w, color: colorEnabled(w), quiet: Quiet(cmd)}
+}
+
+// done prints a success line whose first word, the verb, is highlighted, e.g.
+// "encrypted message.txt → message.txt.age for 3 recipients".
+func (c *console) done(verb, format string, args ...any) {
+	if c.quiet {
+		return
+	}
+	_, _ = fmt.Fprintf(c.w, "%s %s\n", paint(c.color, verb, ansiBold, ansiGreen), fmt.Sprintf(format, args...))
+}
+
+// PrintError prints a command's error on cmd's stderr, even with --quiet.
+func PrintError(cmd *cobra.Command, err error) {
+	w := cmd.ErrOrStderr()
+	_, _ = fmt.Fprintf(w, "%s %v\n", paint(colorEnabled(w), "error:", ansiBold, ansiRed), err)
+}
+
+// plural returns "<n> <noun>" with an "s" unless n is 1.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// consoleHandler is a slog.Handler that shows log records as one short line
+// each: "warning: Failed to fetch GitHub keys user=octocat error=...". main
+// pairs it with the log file's handler so warnings reach the terminal too.
+type consoleHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	color bool
+	attrs string // preformatted " key=value" pairs from WithAttrs
+	group string // key prefix from WithGroup
+}
+
+// NewConsoleHandler returns a handler writing records at level or above to w,
+// colored when w is a terminal and NO_COLOR is unset.
+func NewConsoleHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return &consoleHandler{mu: &sync.Mutex{}, w: w, level: level, color: colorEnabled(w)}
+}
+
+// Enabled implements slog.Handler.
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle implements slog.Handler.
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var sb strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		sb.WriteString(paint(h.color, "error:", ansiBold, ansiRed) + " ")
+	case r.Level >= slog.LevelWarn:
+		sb.WriteString(paint(h.color, "warning:", ansiBold, ansiYellow) + " ")
+	}
+	sb.WriteString(r.Message)
+	sb.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&sb, h.group, a)
+		return true
+	})
+	sb.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, sb.String())
+	return err
+}
+
+// WithAttrs implements slog.Handler.
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var sb strings.Builder
+	for _, a := range attrs {
+		writeAttr(&sb, h.group, a)
+	}
+	h2 := *h
+	h2.attrs += sb.String()
+	return &h2
+}
+
+// WithGroup implements slog.Handler.
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group += name + "."
+	return &h2
+}
+
+// writeAttr appends " key=value", flattening groups into dotted keys.
+func writeAttr(sb *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			writeAttr(sb, prefix, ga)
+		}
+		return
+	}
+	fmt.Fprintf(sb, " %s%s=%v", prefix, a.Key, a.Value)
+}
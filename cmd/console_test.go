@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsoleHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(NewConsoleHandler(&buf, slog.LevelWarn))
+
+	log.Info("hidden below the level")
+	log.Warn("Failed to fetch GitHub keys", "user", "octocat")
+	log.With("key", "/k").WithGroup("req").Error("Decryption failed", "status", 404)
+	assert.Equal(t,
+		"warning: Failed to fetch GitHub keys user=octocat\n"+
+			"error: Decryption failed key=/k req.status=404\n",
+		buf.String(), "a buffer is not a terminal, so no colors")
+}
+
+func TestConsole_DoneAndQuiet(t *testing.T) {
+	root := &cobra.Command{Use: "a"}
+	AddQuietFlag(root)
+	sub := &cobra.Command{Use: "sub"}
+	root.AddCommand(sub)
+	var stderr bytes.Buffer
+	root.SetErr(&stderr)
+
+	newConsole(sub).done("encrypted", "%s → %s for %s", "m.txt", "m.txt.age", plural(3, "recipient"))
+	assert.Equal(t, "encrypted m.txt → m.txt.age for 3 recipients\n", stderr.String())
+
+	stderr.Reset()
+	require.NoError(t, root.PersistentFlags().Set("quiet", "true"))
+	assert.True(t, Quiet(sub))
+	newConsole(sub).done("encrypted", "x")
+	assert.Empty(t, stderr.String())
+
+	PrintError(sub, errors.New("boom"))
+	assert.Equal(t, "error: boom\n", stderr.String(), "errors print even with --quiet")
+}
+
+func TestPaint(t *testing.T) {
+	assert.Equal(t, "ok", paint(false, "ok", ansiGreen))
+	assert.Equal(t, ansiBold+ansiGreen+"ok"+ansiReset, paint(true, "ok", ansiBold, ansiGreen))
+	assert.Equal(t, "1 recipient", plural(1, "recipient"))
+
+	t.Setenv("NO_COLOR", "1")
+	assert.False(t, colorEnabled(&bytes.Buffer{}))
+}
+
+func TestSetConfigKey_LogFormat(t *testing.T) {
+	cfg := &Config{}
+	require.NoError(t, setConfigKey(cfg, "log_format", LogFormatText))
+	assert.Equal(t, LogFormatText, cfg.LogFormat)
+	assert.ErrorContains(t, setConfigKey(cfg, "log_format", "xml"), "log_format must be json or text")
+	require.NoError(t, setConfigKey(cfg, "log_format", ""))
+	assert.Empty(t, cfg.LogFormat)
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+)
+
+// commandContext returns the context cmd was executed with, which main cancels
+// on SIGINT or SIGTERM, or context.Background() when RunE is called directly,
+// as tests do.
+//
+// Long operations take this context so an interrupt stops them at the next
+// read and their deferred cleanup (removing .a-encrypt-*/.a-decrypt-* temp
+// files) runs, instead of the default signal handler killing the process
+// mid-write.
+func commandContext(cmd *cobra.Command) context.Context {
+	if ctx := cmd.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
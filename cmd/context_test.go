@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertNoTempFiles fails if dir holds a leftover encrypt/decrypt temp file.
+func assertNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), ".a-"), "temp file %s left behind", e.Name())
+	}
+}
+
+func TestCommandContext_FallsBackToBackground(t *testing.T) {
+	assert.Equal(t, context.Background(), commandContext(&cobra.Command{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &cobra.Command{}
+	c.SetContext(ctx)
+	assert.Equal(t, ctx, commandContext(c))
+}
+
+// An interrupted encrypt or decrypt returns context.Canceled, removes its temp
+// file and leaves the existing output alone.
+func TestCancelledCopy_CleansUp(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	plain := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(plain, []byte("secret"), 0o600))
+	enc := filepath.Join(dir, "in.txt.age")
+	recips, err := resolveRefs(t, []string{pub}, discardLogger())
+	require.NoError(t, err)
+	require.NoError(t, encryptFile(context.Background(), plain, enc, recips, outputOptions{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	out := filepath.Join(dir, "out.age")
+	require.NoError(t, os.WriteFile(out, []byte("PREEXISTING"), 0o600))
+	assert.ErrorIs(t, encryptFile(ctx, plain, out, recips, outputOptions{}), context.Canceled)
+
+	dec := filepath.Join(dir, "out.txt")
+	require.NoError(t, os.WriteFile(dec, []byte("PREEXISTING"), 0o600))
+	_, err = decryptFile(ctx, priv, dec, enc, outputOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	for _, f := range []string{out, dec} {
+		got, err := os.ReadFile(f) // #nosec G304 -- test temp path
+		require.NoError(t, err)
+		assert.Equal(t, "PREEXISTING", string(got))
+	}
+	assertNoTempFiles(t, dir)
+}
+
+// An interrupt at a confirmation prompt returns without waiting for input.
+func TestConfirm_Cancelled(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer func() { _ = pw.Close() }()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ok, err := confirm(ctx, pr, io.Discard, "Proceed?")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, ok)
+}
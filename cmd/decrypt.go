@@ -1,54 +1,93 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
-	"filippo.io/age"
-	"filippo.io/age/agessh"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
 )
 
-// tryDecrypt attempts to decrypt input to output using the SSH private key at
-// keyPath.
-//
-// Plaintext is written to a 0600 temp file in the target directory and renamed
-// onto output only after decryption fully succeeds. This is critical: age
-// authenticates the stream incrementally, so writing straight to output would
-// leave a partial, potentially group/world-readable plaintext fragment on disk
-// (and destroy any pre-existing file) whenever a decrypt fails partway — a
-// tampered or truncated ciphertext, a full disk, or a wrong-but-header-matching
-// attempt. The temp-then-rename keeps failures from ever touching the target.
-func tryDecrypt(keyPath, output, input string) (err error) {
-	if keyPath == "" || output == "" || input == "" {
-		return fmt.Errorf("invalid arguments for decryption: empty path")
-	}
-	// #nosec G304 -- keyPath comes from the --ssh-key flag, config, or a ~/.ssh scan
-	pem, err := os.ReadFile(keyPath)
-	if err != nil {
-		return fmt.Errorf("reading key %s: %w", keyPath, err)
+// decryption is an age file opened with a matching key, its envelope header
+// (if any) already read, so the output can be chosen before anything is written.
+type decryption struct {
+	in   *os.File
+	r    *bufio.Reader
+	p    *progress
+	meta *envelopeMeta // nil for a plain payload
+}
+
+// openDecryption opens input with the key file at keyPath, an SSH private key
+// or an age identity file (see parseIdentityFile), and reads its envelope
+// header. It fails like agewrap.NewDecryptReader when the key does not match or
+// the header was modified. The copy is tracked with progress.
+func openDecryption(
+	ctx context.Context,
+	keyPath, input string,
+	progress *progressOptions,
+) (*decryption, error) {
+	if keyPath == "" || input == "" {
+		return nil, fmt.Errorf("invalid arguments for decryption: empty path")
 	}
-	identity, err := agessh.ParseIdentity(pem)
+	identities, err := parseIdentityFile(keyPath)
 	if err != nil {
-		return fmt.Errorf("parsing key %s: %w", keyPath, err)
+		return nil, err
 	}
-
 	// #nosec G304 -- input path is a validated CLI flag/argument
 	in, err := os.Open(input)
 	if err != nil {
-		return fmt.Errorf("opening input: %w", err)
+		return nil, fmt.Errorf("opening input: %w", err)
+	}
+	d := &decryption{in: in, p: startProgress(progress, "decrypt", in)}
+	ar, err := agewrap.NewDecryptReader(ctx, d.p.reader(in), identities...)
+	if err == nil {
+		d.r = bufio.NewReader(ar)
+		d.meta, _, err = readEnvelope(d.r)
 	}
-	defer func() { _ = in.Close() }()
-
-	r, err := age.Decrypt(in, identity)
 	if err != nil {
-		return err // wrong key or not an age file
+		_ = in.Close()
+		return nil, err
 	}
+	return d, nil
+}
+
+// Close closes the input.
+func (d *decryption) Close() error {
+	return d.in.Close()
+}
 
+// writeTo writes the plaintext to output as opts says. An envelope is
+// unwrapped: the contents are checked against the stored hash, and output gets
+// the stored mode (capped by envelopeModeMask) and mtime.
+//
+// Plaintext is written to a 0600 temp file in the target directory and renamed
+// onto output only after decryption fully succeeds. This is critical: age
+// authenticates the stream incrementally, so writing straight to output would
+// leave a partial, potentially group/world-readable plaintext fragment on disk
+// (and destroy any pre-existing file) whenever a decrypt fails partway — a
+// tampered or truncated ciphertext, a full disk, or a wrong-but-header-matching
+// attempt. The temp-then-rename keeps failures from ever touching the target.
+//
+// A cancelled context stops the copy at the next read; the temp file is
+// removed like on any other failure.
+func (d *decryption) writeTo(output string, opts outputOptions) (err error) {
+	if output == "" {
+		return fmt.Errorf("invalid arguments for decryption: empty path")
+	}
 	// os.CreateTemp creates the file with 0600; the plaintext is never readable
 	// by group/other, even transiently.
 	tmp, err := os.CreateTemp(filepath.Dir(output), ".a-decrypt-*")
@@ -64,15 +103,76 @@ func tryDecrypt(keyPath, output, input string) (err error) {
 		}
 	}()
 
-	if _, err = io.Copy(tmp, r); err != nil {
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), d.r)
+	d.p.finish(err)
+	if err != nil {
 		_ = tmp.Close()
-		return fmt.Errorf("writing plaintext: %w", err)
+		return fmt.Errorf("writing plaintext: %w", payloadError(err))
+	}
+	if d.meta != nil {
+		if err = applyEnvelope(tmp, h.Sum(nil), d.meta); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("syncing plaintext: %w", err)
 	}
 	if err = tmp.Close(); err != nil {
 		return fmt.Errorf("closing temp output: %w", err)
 	}
-	if err = os.Rename(tmpName, output); err != nil {
-		return fmt.Errorf("finalizing output: %w", err)
+	if d.meta != nil {
+		// Closing may update the mtime on some filesystems, so set it last.
+		if err = os.Chtimes(tmpName, d.meta.MTime, d.meta.MTime); err != nil {
+			return fmt.Errorf("restoring mtime: %w", err)
+		}
+	}
+	return replaceOutput(tmpName, output, opts)
+}
+
+// decryptFile decrypts input to output with the key file at keyPath (see
+// openDecryption and decryption.writeTo). It returns the envelope header, or
+// nil for a plain payload.
+func decryptFile(
+	ctx context.Context,
+	keyPath, output, input string,
+	opts outputOptions,
+) (*envelopeMeta, error) {
+	d, err := openDecryption(ctx, keyPath, input, opts.progress)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = d.Close() }()
+	return d.meta, d.writeTo(output, opts)
+}
+
+// payloadError classifies a failed copy of the decrypted payload. The key
+// matched, so anything but a file system error means age rejected a chunk: the
+// ciphertext is truncated or was modified.
+func payloadError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	if _, ok := errors.AsType[*fs.PathError](err); ok {
+		return err
+	}
+	return withClass(classTampered, err)
+}
+
+// applyEnvelope checks the decrypted contents' hash against meta and gives tmp
+// the stored mode.
+func applyEnvelope(tmp *os.File, sum []byte, meta *envelopeMeta) error {
+	if hex.EncodeToString(sum) != meta.SHA256 {
+		return withClass(classTampered, errors.New("envelope content hash mismatch"))
+	}
+	mode, err := meta.fileMode()
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return fmt.Errorf("restoring mode: %w", err)
 	}
 	return nil
 }
@@ -85,20 +185,80 @@ func selectSSHKey(sshKeyFlag string, cfg *Config) string {
 	return cfg.SSHKeyPath
 }
 
-// tryAllKeys attempts decryption with each key in turn, returning the keys it tried
-// and whether one succeeded.
-func tryAllKeys(keys []string, input, output string, log *slog.Logger) (tried []string, ok bool) {
+// decryptKeys lists the key files Decrypt tries, in order.
+//
+// Explicit --identity files replace the configured identity_files. The SSH key
+// comes from --ssh-key or ssh_key_path; when neither is set, ~/.ssh is scanned,
+// and a failed scan is only fatal when no other key source (identity files or
+// --agent) is available. With --agent, the files of agent-held keys are added,
+// and agent keys without a file are returned separately so a failure can name
+// them.
+func decryptKeys(cmd *cobra.Command, cfg *Config, log *slog.Logger) ([]string, []*agent.Key, error) {
+	sshKeyFlag, _ := cmd.Flags().GetString("ssh-key")
+	useAgent, _ := cmd.Flags().GetBool("agent")
+	identityFiles, _ := cmd.Flags().GetStringSlice("identity")
+	if len(identityFiles) == 0 {
+		identityFiles = cfg.IdentityFiles
+	}
+
+	keys := slices.Clone(identityFiles)
+	if sshKey := selectSSHKey(sshKeyFlag, cfg); sshKey != "" {
+		keys = append(keys, sshKey)
+	} else {
+		scanned, err := ScanSSHPrivateKeys()
+		if err != nil && !useAgent && len(identityFiles) == 0 {
+			return nil, nil, fmt.Errorf("could not scan ~/.ssh for private keys: %w", err)
+		}
+		keys = append(keys, scanned...)
+	}
+
+	var agentOnly []*agent.Key
+	if useAgent {
+		agentPaths, only, err := agentKeyFiles(log)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range agentPaths {
+			if !slices.Contains(keys, p) {
+				keys = append(keys, p)
+			}
+		}
+		agentOnly = only
+	}
+	return keys, agentOnly, nil
+}
+
+// tryAllKeys opens input with each key in turn (see openDecryption),
+// returning the keys it tried and the open decryption of the one that matched,
+// which the caller must close; it is nil when none did. The last key tried is
+// the match.
+//
+// A tampered header stops the search with that error in tamperErr: the key
+// matched, so no other key can do better, and reporting "no key matched" would
+// hide the real problem. Payload tampering shows up only while writing.
+func tryAllKeys(
+	ctx context.Context,
+	keys []string,
+	input string,
+	progress *progressOptions,
+	log *slog.Logger,
+) (tried []string, d *decryption, tamperErr error) {
 	for _, keyPath := range keys {
+		if ctx.Err() != nil {
+			break
+		}
 		tried = append(tried, keyPath)
-		log.Info("Trying decryption with SSH key", "input", input, "output", output, "sshKey", keyPath)
-		err := tryDecrypt(keyPath, output, input)
+		log.Info("Trying decryption with key", "input", input, "key", keyPath)
+		d, err := openDecryption(ctx, keyPath, input, progress)
 		if err == nil {
-			log.Info("Decryption successful")
-			return tried, true
+			return tried, d, nil
 		}
 		log.Warn("Decryption failed with key", "key", keyPath, "error", err)
+		if classify(err) == classTampered {
+			return tried, nil, err
+		}
 	}
-	return tried, false
+	return tried, nil, nil
 }
 
 // decryptOutput derives the decrypted filename from the input: it strips a
@@ -111,34 +271,147 @@ func decryptOutput(input string) string {
 }
 
 // Decrypt returns a cobra.Command that decrypts files using age, scanning local SSH keys if needed.
-func Decrypt(cfg *Config, log *slog.Logger) *cobra.Command {
+// extra is added to the agewrap options --verify-from fetches GitHub keys with
+// (see resolverOptions).
+func Decrypt(cfg *Config, log *slog.Logger, extra ...agewrap.Option) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:     "decrypt [input]",
 		Aliases: []string{"d"},
 		Short:   "Decrypt a file (output defaults to <input> without .age)",
 		Args:    cobra.MaximumNArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
-			input, output, err := resolveIO(cmd, args, decryptOutput)
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			op, err := startOperation(cmd, "decrypt")
 			if err != nil {
 				return err
 			}
-			sshKeyFlag, _ := cmd.Flags().GetString("ssh-key")
+			defer func() { err = op.finish(cmd, err) }()
 
-			keys := []string{selectSSHKey(sshKeyFlag, cfg)}
-			if keys[0] == "" {
-				if keys, err = ScanSSHPrivateKeys(); err != nil {
-					return fmt.Errorf("could not scan ~/.ssh for private keys: %w", err)
-				}
+			structured, _ := cmd.Flags().GetString("structured")
+			derive := decryptOutput
+			if structured != "" {
+				derive = structuredDecryptOutput
+			}
+			input, output, err := resolveIO(cmd, args, derive)
+			if err != nil {
+				return err
+			}
+			format, err := structuredFormat(structured, input)
+			if err != nil {
+				return err
+			}
+			op.Input, op.Output = input, output
+			keys, agentOnly, err := decryptKeys(cmd, cfg, log)
+			if err != nil {
+				return err
+			}
+			if err := verifySignature(cmd, cfg, input, log, extra); err != nil {
+				return err
 			}
 
-			if tried, ok := tryAllKeys(keys, input, output, log); !ok {
-				return fmt.Errorf("decryption failed: none of the tried SSH keys matched\nTried keys: %v", tried)
+			opts, err := outputFlags(cmd, log)
+			if err != nil {
+				return err
 			}
+			ctx := commandContext(cmd)
+			if format != "" {
+				if opts.exclusive, err = guardOutput(cmd, output); err != nil {
+					return err
+				}
+				op.Identity, err = decryptStructured(ctx, input, output, format, loadVerifyIdentities(keys, log), opts)
+				if err != nil {
+					return err
+				}
+			} else {
+				tried, d, tamperErr := tryAllKeys(ctx, keys, input, opts.progress, log)
+				if d != nil {
+					defer func() { _ = d.Close() }()
+				}
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if tamperErr != nil {
+					return fmt.Errorf("decryption failed with key %s: %w", tried[len(tried)-1], tamperErr)
+				}
+				if d == nil {
+					if err := explainAgentOnly(input, agentOnly); err != nil {
+						return withClass(classNoMatchingKey, err)
+					}
+					return withClass(classNoMatchingKey,
+						fmt.Errorf("decryption failed: none of the tried keys matched\nTried keys: %v", tried))
+				}
+				keyPath := tried[len(tried)-1]
+				// The output is settled, and checked, only once the envelope
+				// is read: an explicit -o always wins over the stored name.
+				if explicit, _ := cmd.Flags().GetString("output"); d.meta != nil && explicit == "" {
+					if output, err = envelopeOutput(cmd, input, output, d.meta, log); err != nil {
+						return err
+					}
+					op.Output = output
+				}
+				if opts.exclusive, err = guardOutput(cmd, output); err != nil {
+					return err
+				}
+				log.Info("Decrypting file", "input", input, "output", output, "key", keyPath)
+				if err := d.writeTo(output, opts); err != nil {
+					if classify(err) == classTampered {
+						return fmt.Errorf("decryption failed with key %s: %w", keyPath, err)
+					}
+					return err
+				}
+				log.Info("Decryption successful")
+				op.Identity = keyPath
+			}
+			op.Bytes = fileSize(output)
+			if err := recordAudit(cfg, "decrypt", input, op.Output, func(e *auditEntry) {
+				e.IdentityFile, e.Identity = op.Identity, identityFingerprints(op.Identity)
+			}, log); err != nil {
+				return err
+			}
+			newConsole(cmd).done("decrypted", "%s → %s with %s", input, op.Output, op.Identity)
 			return nil
 		},
 	}
 	cmd.Flags().StringP("input", "i", "", "Input file to decrypt")
 	cmd.Flags().StringP("output", "o", "", "Output file for decrypted data")
 	cmd.Flags().String("ssh-key", "", "SSH private key to use for decryption")
+	cmd.Flags().StringSlice("identity", nil,
+		"age identity file (native or plugin identities); replaces identity_files from the config")
+	cmd.Flags().Bool("agent", false, "Also try the key files of keys loaded in ssh-agent (SSH_AUTH_SOCK)")
+	addStructuredFlag(cmd)
+	addOutputFlags(cmd)
+	addProgressFlag(cmd)
+	cmd.Flags().String("verify-from", "",
+		"Require a valid signature by github:<user>, an SSH public key, or a file of them before decrypting")
+	cmd.Flags().String("signature", "", "Signature file for --verify-from (default <input>.sig)")
 	return cmd
 }
+
+// verifySignature enforces decrypt --verify-from: the ciphertext must carry a
+// valid signature by an allowed key before any plaintext is written. Without
+// the flag it does nothing. extra is passed on to allowedSigners.
+func verifySignature(
+	cmd *cobra.Command,
+	cfg *Config,
+	input string,
+	log *slog.Logger,
+	extra []agewrap.Option,
+) error {
+	from, _ := cmd.Flags().GetString("verify-from")
+	if from == "" {
+		return nil
+	}
+	sigPath, _ := cmd.Flags().GetString("signature")
+	if sigPath == "" {
+		sigPath = input + ".sig"
+	}
+	allowed, err := allowedSigners(commandContext(cmd), cfg, from, log, extra...)
+	if err != nil {
+		return err
+	}
+	signer, err := verifyFile(input, sigPath, allowed)
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+	log.Info("Signature verified", "signer", ssh.FingerprintSHA256(signer), "from", from)
+	return nil
+}
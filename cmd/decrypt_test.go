@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,10 +14,10 @@ import (
 
 // A failed decrypt (tampered ciphertext) must not leak plaintext to the output
 // path, must not clobber a pre-existing file there, and must leave no temp files.
-func TestTryDecrypt_FailureLeavesNoPlaintext(t *testing.T) {
+func TestDecryptFile_FailureLeavesNoPlaintext(t *testing.T) {
 	dir := t.TempDir()
 	priv, pub := makeSSHKey(t, dir)
-	recips, err := parseRecipients([]string{pub})
+	recips, err := resolveRefs(t, []string{pub}, discardLogger())
 	require.NoError(t, err)
 
 	// Plaintext larger than one age chunk (64 KiB) so a truncated ciphertext
@@ -24,7 +25,7 @@ func TestTryDecrypt_FailureLeavesNoPlaintext(t *testing.T) {
 	plain := filepath.Join(dir, "secret.txt")
 	require.NoError(t, os.WriteFile(plain, bytes.Repeat([]byte("TOPSECRET"), 20000), 0o600))
 	enc := filepath.Join(dir, "secret.age")
-	require.NoError(t, encryptFile(plain, enc, recips))
+	require.NoError(t, encryptFile(context.Background(), plain, enc, recips, outputOptions{}))
 
 	full, err := os.ReadFile(enc) // #nosec G304 -- test temp path
 	require.NoError(t, err)
@@ -38,7 +39,9 @@ func TestTryDecrypt_FailureLeavesNoPlaintext(t *testing.T) {
 	// #nosec G306 -- intentional loose perms on a pre-existing file (see above)
 	require.NoError(t, os.WriteFile(out, []byte("PREEXISTING"), 0o644))
 
-	assert.Error(t, tryDecrypt(priv, out, tampered), "tampered ciphertext must fail")
+	_, err = decryptFile(context.Background(), priv, out, tampered, outputOptions{})
+	require.Error(t, err, "tampered ciphertext must fail")
+	assert.Equal(t, ExitTampered, ExitCode(err))
 
 	got, err := os.ReadFile(out) // #nosec G304 -- test temp path
 	require.NoError(t, err)
@@ -52,10 +55,51 @@ func TestTryDecrypt_FailureLeavesNoPlaintext(t *testing.T) {
 	}
 }
 
-func TestTryDecrypt_EmptyPath(t *testing.T) {
-	assert.Error(t, tryDecrypt("", "o.txt", "i"))
-	assert.Error(t, tryDecrypt("k", "", "i"))
-	assert.Error(t, tryDecrypt("k", "o.txt", ""))
+func TestDecryptFile_EmptyPath(t *testing.T) {
+	_, err := decryptFile(context.Background(), "", "o.txt", "i", outputOptions{})
+	assert.Error(t, err)
+	_, err = decryptFile(context.Background(), "k", "", "i", outputOptions{})
+	assert.Error(t, err)
+	_, err = decryptFile(context.Background(), "k", "o.txt", "", outputOptions{})
+	assert.Error(t, err)
+}
+
+// flipHeaderMAC changes the first character of the header MAC in the age file
+// at path. It is a full base64 digit, so the MAC always changes.
+func flipHeaderMAC(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	i := bytes.Index(data, []byte("\n--- "))
+	require.Positive(t, i, "no header MAC line")
+	i += len("\n--- ")
+	if data[i] == 'A' {
+		data[i] = 'B'
+	} else {
+		data[i] = 'A'
+	}
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+// A modified header is tampering, not a key mismatch: the first key that
+// unwraps the file key stops the search, and the exit status is 5, not 4.
+func TestDecryptCmd_HeaderMACTampered(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	otherPriv, _ := makeSSHKey(t, t.TempDir())
+	in := filepath.Join(dir, "hdr.txt")
+	require.NoError(t, os.WriteFile(in, []byte("secret"), 0o600))
+	_, err := runRoot(t, Encrypt(&Config{}, discardLogger()), "encrypt", in, "-r", pub)
+	require.NoError(t, err)
+	flipHeaderMAC(t, in+".age")
+
+	out := filepath.Join(dir, "out.txt")
+	_, err = runRoot(t, Decrypt(&Config{}, discardLogger()),
+		"decrypt", in+".age", "-o", out, "--identity", priv, "--ssh-key", otherPriv)
+	require.ErrorContains(t, err, "decryption failed with key "+priv)
+	assert.ErrorContains(t, err, "bad header MAC")
+	assert.Equal(t, ExitTampered, ExitCode(err))
+	assert.NoFileExists(t, out)
 }
 
 func TestSelectSSHKey(t *testing.T) {
@@ -65,13 +109,15 @@ func TestSelectSSHKey(t *testing.T) {
 }
 
 func TestTryAllKeys_NoMatch(t *testing.T) {
-	tried, ok := tryAllKeys(nil, "i", "o.txt", discardLogger())
-	assert.False(t, ok)
+	tried, d, tamperErr := tryAllKeys(context.Background(), nil, "i", nil, discardLogger())
+	assert.Nil(t, d)
 	assert.Empty(t, tried)
+	assert.NoError(t, tamperErr)
 
-	tried, ok = tryAllKeys([]string{"/no/such/id_rsa"}, "i", "o.txt", discardLogger())
-	assert.False(t, ok)
+	tried, d, tamperErr = tryAllKeys(context.Background(), []string{"/no/such/id_rsa"}, "i", nil, discardLogger())
+	assert.Nil(t, d)
 	assert.Equal(t, []string{"/no/such/id_rsa"}, tried)
+	assert.NoError(t, tamperErr)
 }
 
 func TestDecryptCmd_Validation(t *testing.T) {
@@ -128,9 +174,9 @@ func TestDecryptCmd_ScanPathRoundTrip(t *testing.T) {
 	require.NoError(t, os.WriteFile(plain, []byte("scan path secret"), 0o600))
 	enc := filepath.Join(home, "out.age")
 
-	recips, err := parseRecipients([]string{pub})
+	recips, err := resolveRefs(t, []string{pub}, discardLogger())
 	require.NoError(t, err)
-	require.NoError(t, encryptFile(plain, enc, recips))
+	require.NoError(t, encryptFile(context.Background(), plain, enc, recips, outputOptions{}))
 
 	dec := filepath.Join(home, "dec.txt")
 	c := Decrypt(&Config{}, discardLogger()) // no SSHKeyPath -> scans ~/.ssh
@@ -1,26 +1,28 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
 	"slices"
-	"strings"
-	"time"
 
 	"filippo.io/age"
-	"filippo.io/age/agessh"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
 )
 
 // resolveIO determines the input and output files for the encrypt/decrypt
 // commands. Input comes from --input or the first positional arg; when --output
 // is omitted it is derived from the input via deriveOutput. Both must resolve to
-// non-empty values and the input file must exist.
+// non-empty values, the input file must exist, and both must pass the safety
+// checks in checkInput and checkOutput.
 func resolveIO(cmd *cobra.Command, args []string, deriveOutput func(string) string) (input, output string, err error) {
 	input, _ = cmd.Flags().GetString("input")
 	if input == "" && len(args) > 0 {
@@ -36,39 +38,82 @@ func resolveIO(cmd *cobra.Command, args []string, deriveOutput func(string) stri
 	if output == "" {
 		return "", "", fmt.Errorf("output file is required")
 	}
-	if _, err := os.Stat(input); err != nil {
+	inInfo, err := os.Stat(input)
+	if err != nil {
 		return "", "", fmt.Errorf("input file does not exist: %w", err)
 	}
+	if err := checkInput(cmd, input, inInfo); err != nil {
+		return "", "", err
+	}
+	if output, err = checkOutput(cmd, output, inInfo); err != nil {
+		return "", "", err
+	}
 	return input, output, nil
 }
 
 // Encrypt returns a cobra.Command that encrypts files using age, supporting GitHub key fetching.
-func Encrypt(cfg *Config, log *slog.Logger) *cobra.Command {
+// extra is added to the agewrap options recipients are resolved with (see
+// resolverOptions), for example to fetch GitHub keys from another server.
+func Encrypt(cfg *Config, log *slog.Logger, extra ...agewrap.Option) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:     "encrypt [input] [github-user]",
 		Aliases: []string{"e"},
 		Short:   "Encrypt a file (output defaults to <input>.age)",
 		Args:    cobra.MaximumNArgs(2),
-		RunE: func(cmd *cobra.Command, args []string) error {
-			input, output, err := resolveIO(cmd, args, func(in string) string { return in + ".age" })
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			op, err := startOperation(cmd, "encrypt")
 			if err != nil {
 				return err
 			}
-			recipients, _ := cmd.Flags().GetStringSlice("recipient")
-			ghUserFlag, _ := cmd.Flags().GetString("github-user")
-			if ghUserFlag == "" && len(args) > 1 {
-				ghUserFlag = args[1]
-			}
+			defer func() { err = op.finish(cmd, err) }()
 
-			allRecipients, ghUser := collectRecipients(cfg, recipients, ghUserFlag, log)
-			if len(allRecipients) == 0 {
-				return fmt.Errorf("at least one recipient is required")
+			structured, _ := cmd.Flags().GetString("structured")
+			input, output, err := resolveIO(cmd, args, func(in string) string {
+				if structured != "" {
+					return structuredOutput(in)
+				}
+				return in + ".age"
+			})
+			if err != nil {
+				return err
 			}
-
-			recips, err := parseRecipients(allRecipients)
+			format, keyRe, err := encryptStructuredOptions(cmd, input)
+			if err != nil {
+				return err
+			}
+			op.Input, op.Output = input, output
+			opts, err := outputFlags(cmd, log)
+			if err != nil {
+				return err
+			}
+			if opts.exclusive, err = guardOutput(cmd, output); err != nil {
+				return err
+			}
+			recips, allRecipients, ghUser, err := encryptRecipients(cmd, args, cfg, log, extra)
 			if err != nil {
 				return err
 			}
+			op.Recipients = allRecipients
+			if ghUser != "" {
+				op.Recipients = append(op.Recipients, agewrap.GitHubPrefix+ghUser)
+			}
+			if err := checkRemoveSource(cmd, input); err != nil {
+				return err
+			}
+			// The signing key is loaded up front so a bad key fails before
+			// anything is written.
+			var signer ssh.Signer
+			sigOpts := opts
+			if signKey, err := signingKey(cmd, cfg); err != nil {
+				return err
+			} else if signKey != "" {
+				if signer, err = loadSigner(signKey); err != nil {
+					return err
+				}
+				if sigOpts.exclusive, err = guardOutput(cmd, output+".sig"); err != nil {
+					return err
+				}
+			}
 
 			log.Info("Encrypting file",
 				"input", input,
@@ -76,208 +121,251 @@ func Encrypt(cfg *Config, log *slog.Logger) *cobra.Command {
 				"recipients", allRecipients,
 				"githubUser", ghUser)
 
-			if err := encryptFile(input, output, recips); err != nil {
+			encrypt := encryptFile
+			if envelope, _ := cmd.Flags().GetBool("envelope"); envelope {
+				encrypt = encryptEnvelope
+			}
+			if format != "" {
+				encrypt = func(
+					ctx context.Context, input, output string, recips []age.Recipient, opts outputOptions,
+				) error {
+					return encryptStructured(ctx, input, output, format, keyRe, recips, opts)
+				}
+			}
+			if err := encrypt(commandContext(cmd), input, output, recips, opts); err != nil {
 				log.Error("Encryption failed", "error", err)
 				return fmt.Errorf("encryption failed: %w", err)
 			}
+			if signer != nil {
+				if err := signFile(signer, output, output+".sig", sigOpts); err != nil {
+					return err
+				}
+				log.Info("Signed ciphertext", "signature", output+".sig",
+					"key", ssh.FingerprintSHA256(signer.PublicKey()))
+			}
 
 			log.Info("Encryption successful")
-			return nil
+			op.Bytes = fileSize(output)
+			// Recorded before --remove-source, which would leave no input to
+			// hash. The entry is about the encryption, so whether the source
+			// was then removed is left out on purpose; a failure is reported.
+			if err := recordAudit(cfg, "encrypt", input, output, func(e *auditEntry) {
+				e.Recipients = recipientFingerprints(recips)
+			}, log); err != nil {
+				return err
+			}
+			newConsole(cmd).done("encrypted", "%s → %s for %s", input, output, plural(len(recips), "recipient"))
+			return removeSourceAfterEncrypt(cmd, cfg, input, output, log)
 		},
 	}
 	cmd.Flags().StringP("input", "i", "", "Input file to encrypt")
 	cmd.Flags().StringP("output", "o", "", "Output file for encrypted data")
-	cmd.Flags().StringSliceP("recipient", "r", []string{}, "Recipient public key file or string")
+	cmd.Flags().StringSliceP("recipient", "r", []string{},
+		"Recipient public key file or string, github:<user>, host:<name> for an SSH host key, or @<alias>")
 	cmd.Flags().String("github-user", "", "GitHub username to fetch public keys for encryption")
+	cmd.Flags().Bool("agent-recipients", false, "Add the ed25519/RSA keys held by ssh-agent as recipients")
+	cmd.Flags().String("known-hosts", "",
+		"known_hosts file (or ssh-keyscan output) for host: recipients (default ~/.ssh/known_hosts)")
+	cmd.Flags().Bool("envelope", false,
+		"Store the file's name, mode, mtime and hash in the ciphertext, restored by decrypt")
+	addOutputFlags(cmd)
+	addProgressFlag(cmd)
+	cmd.Flags().Bool("remove-source", false, "Delete the input once the ciphertext is safely on disk")
+	cmd.Flags().Bool("verify-decrypt", false,
+		"With --remove-source, first check that one of your local keys decrypts the output")
+	cmd.Flags().Bool("overwrite", false,
+		"With --remove-source, overwrite the input first (best effort; unreliable on SSDs and CoW filesystems)")
+	addStructuredFlag(cmd)
+	cmd.Flags().String("structured-keys", "",
+		"With --structured, encrypt only values under keys matching this regular expression")
+	cmd.Flags().Bool("sign", false, "Write an SSH signature of the ciphertext to <output>.sig")
+	cmd.Flags().String("sign-key", "", "SSH private key to sign with (default: ssh_key_path from config)")
 	return cmd
 }
 
-// collectRecipients gathers recipients from config defaults, the --recipient flag,
-// and (when a GitHub user is set) that user's published keys. It returns the
-// recipient list and the resolved GitHub username.
-func collectRecipients(
-	cfg *Config,
-	recipients []string,
-	ghUserFlag string,
-	log *slog.Logger,
-) ([]string, string) {
-	allRecipients := slices.Concat(cfg.DefaultRecipients, recipients)
-
-	ghUser := ghUserFlag
-	if ghUser == "" && cfg.GitHubUser != "" {
-		ghUser = cfg.GitHubUser
+// signingKey returns the key file for encrypt --sign, or "" without --sign.
+func signingKey(cmd *cobra.Command, cfg *Config) (string, error) {
+	if sign, _ := cmd.Flags().GetBool("sign"); !sign {
+		return "", nil
 	}
-
-	// A valid username is safe to interpolate into the keys URL and cache filename.
-	if ghUser != "" {
-		if !githubUsernameRE.MatchString(ghUser) {
-			log.Warn("Invalid GitHub username", "user", ghUser)
-		} else {
-			allRecipients = append(allRecipients, fetchGitHubKeys(cfg, ghUser, log)...)
-		}
+	keyPath, _ := cmd.Flags().GetString("sign-key")
+	if keyPath == "" {
+		keyPath = cfg.SSHKeyPath
 	}
-	return allRecipients, ghUser
-}
-
-// githubUsernameRE matches a valid GitHub username (alphanumerics and hyphens, no
-// leading/trailing hyphen, max 39 chars).
-var githubUsernameRE = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,37}[a-zA-Z0-9])?$`)
-
-// githubKeysURL builds the URL serving a user's published SSH keys. It is a package
-// variable so tests can redirect it to a local server.
-var githubKeysURL = func(ghUser string) string {
-	return fmt.Sprintf("https://github.com/%s.keys", ghUser)
+	if keyPath == "" {
+		return "", fmt.Errorf("--sign needs an SSH key: set ssh_key_path or pass --sign-key")
+	}
+	return keyPath, nil
 }
 
-// keysHTTPClient bounds how long a GitHub key fetch may block; a slow or hostile
-// server must not hang the CLI indefinitely.
-var keysHTTPClient = &http.Client{Timeout: 30 * time.Second}
-
-// maxKeysResponseBytes caps the GitHub .keys response we will read into memory.
-// Real responses are a few KB; the cap prevents a huge/hostile response from
-// exhausting memory. A user with more than this many keys is not a real case.
-const maxKeysResponseBytes = 1 << 20 // 1 MiB
-
-// fetchGitHubKeys returns the SSH public keys published at github.com/<ghUser>.keys.
-//
-// Results are cached under cfg.CacheDir for cfg.CacheTTLMinutes so repeated
-// encryptions do not hit the network every time. A non-positive TTL or an empty
-// cache dir disables caching. ghUser must already be validated by the caller.
-func fetchGitHubKeys(cfg *Config, ghUser string, log *slog.Logger) []string {
-	cachePath := ""
-	if cfg.CacheDir != "" && cfg.CacheTTLMinutes > 0 {
-		cachePath = filepath.Join(cfg.CacheDir, ghUser+".keys")
-		if keys, ok := readKeyCache(cachePath, cfg.CacheTTLMinutes); ok {
-			log.Debug("Using cached GitHub keys", "user", ghUser)
-			return keys
-		}
+// encryptRecipients resolves encrypt's recipients from the config, flags, the
+// GitHub user and ssh-agent through keySources, configured with extra. It
+// returns the parsed recipients, the references they came from and the
+// resolved GitHub username.
+func encryptRecipients(
+	cmd *cobra.Command,
+	args []string,
+	cfg *Config,
+	log *slog.Logger,
+	extra []agewrap.Option,
+) ([]age.Recipient, []string, string, error) {
+	recipients, _ := cmd.Flags().GetStringSlice("recipient")
+	ghUserFlag, _ := cmd.Flags().GetString("github-user")
+	if ghUserFlag == "" && len(args) > 1 {
+		ghUserFlag = args[1]
 	}
 
-	// #nosec G107 -- the host is fixed by githubKeysURL and ghUser is regex-validated by the caller
-	resp, err := keysHTTPClient.Get(githubKeysURL(ghUser))
-	if err != nil {
-		log.Warn("Failed to fetch GitHub keys", "user", ghUser, "error", err)
-		return nil
-	}
-	defer func() {
-		if closeErr := resp.Body.Close(); closeErr != nil {
-			log.Warn("Failed to close GitHub keys response body", "error", closeErr)
+	refs, ghUser := collectRecipients(cfg, recipients, ghUserFlag, log)
+	if useAgent, _ := cmd.Flags().GetBool("agent-recipients"); useAgent {
+		fromAgent, err := agentRecipients(log)
+		if err != nil {
+			return nil, nil, "", err
 		}
-	}()
-	if resp.StatusCode != http.StatusOK {
-		log.Warn("GitHub returned non-OK status", "status", resp.StatusCode, "user", ghUser)
-		return nil
-	}
-	body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeysResponseBytes))
-	if err != nil {
-		log.Warn("Failed to read GitHub keys response body", "error", err)
-		return nil
+		refs = append(refs, fromAgent...)
 	}
-	if cachePath != "" {
-		writeKeyCache(cachePath, body, log)
+	if len(refs) == 0 && ghUser == "" {
+		return nil, nil, "", withClass(classNoRecipients, errors.New("at least one recipient is required"))
 	}
-	return parseKeyLines(string(body))
-}
-
-// parseKeyLines splits a GitHub .keys response into non-empty, trimmed key lines.
-func parseKeyLines(body string) []string {
-	var keys []string
-	for line := range strings.SplitSeq(body, "\n") {
-		if line = strings.TrimSpace(line); line != "" {
-			keys = append(keys, line)
-		}
+	knownHosts, _ := cmd.Flags().GetString("known-hosts")
+	if knownHosts == "" {
+		knownHosts = defaultKnownHostsPath()
 	}
-	return keys
-}
 
-// readKeyCache returns cached keys when cachePath exists and is younger than
-// ttlMinutes. The boolean is false when the cache is missing, stale, or unreadable.
-func readKeyCache(cachePath string, ttlMinutes int) ([]string, bool) {
-	info, err := os.Stat(cachePath)
+	recips, err := resolveRecipients(commandContext(cmd), keySources(cfg, knownHosts, log, extra...), refs, ghUser, log)
 	if err != nil {
-		return nil, false
+		return nil, nil, "", err
 	}
-	if time.Since(info.ModTime()) > time.Duration(ttlMinutes)*time.Minute {
-		return nil, false
-	}
-	// #nosec G304 -- cachePath is cfg.CacheDir (os.UserCacheDir-derived) joined with a validated GitHub username
-	data, err := os.ReadFile(cachePath)
-	if err != nil {
-		return nil, false
+	if err := checkPostQuantumMix(recips, log); err != nil {
+		return nil, nil, "", err
 	}
-	return parseKeyLines(string(data)), true
+	return recips, refs, ghUser, nil
 }
 
-// writeKeyCache stores the raw .keys response; failures are non-fatal (best effort).
-func writeKeyCache(cachePath string, body []byte, log *slog.Logger) {
-	// #nosec G703 -- cachePath is cfg.CacheDir (os.UserCacheDir-derived) joined with a validated GitHub username
-	if err := os.WriteFile(cachePath, body, 0o600); err != nil {
-		log.Warn("Failed to cache GitHub keys", "path", cachePath, "error", err)
+// collectRecipients gathers recipient references from config defaults and the
+// --recipient flag, and picks the GitHub user from the flag or config. An
+// invalid username is warned about and dropped, so the result is always safe to
+// interpolate into the keys URL and cache filename.
+func collectRecipients(
+	cfg *Config,
+	recipients []string,
+	ghUserFlag string,
+	log *slog.Logger,
+) ([]string, string) {
+	refs := slices.Concat(cfg.DefaultRecipients, recipients)
+	ghUser := ghUserFlag
+	if ghUser == "" {
+		ghUser = cfg.GitHubUser
 	}
-}
-
-// linesForInput resolves a single parseRecipients entry into candidate lines:
-// the literal string itself, or the lines of a file when the entry names one.
-func linesForInput(in string) ([]string, error) {
-	// #nosec G304 G703 -- recipient path is user-provided by design (config/flags/GitHub)
-	if info, statErr := os.Stat(in); statErr == nil && !info.IsDir() {
-		// #nosec G304 G703 -- recipient path is user-provided by design (config/flags/GitHub)
-		data, readErr := os.ReadFile(in)
-		if readErr != nil {
-			return nil, fmt.Errorf("reading recipient file %s: %w", in, readErr)
-		}
-		return strings.Split(string(data), "\n"), nil
+	if ghUser != "" && !agewrap.ValidGitHubUser(ghUser) {
+		log.Warn("Invalid GitHub username", "user", ghUser)
+		ghUser = ""
 	}
-	return []string{in}, nil
+	return refs, ghUser
 }
 
-// parseRecipients resolves each input into one or more age recipients. An input
-// is either a public-key file (an SSH .pub file or a recipients file, one key per
-// line) or a literal recipient string (an "ssh-..." key line or an "age1..." key).
-func parseRecipients(inputs []string) ([]age.Recipient, error) {
+// resolveRecipients resolves refs and the GitHub user's keys through sources.
+// The GitHub user (from --github-user or github_user) is best effort: a failed
+// fetch is logged and skipped so the other recipients still work offline,
+// unlike an explicit github:<user> reference.
+func resolveRecipients(
+	ctx context.Context,
+	sources *agewrap.RecipientResolver,
+	refs []string,
+	ghUser string,
+	log *slog.Logger,
+) ([]age.Recipient, error) {
 	var recipients []age.Recipient
-	for _, in := range inputs {
-		if in == "" {
-			return nil, fmt.Errorf("invalid argument for encryption: empty recipient")
-		}
-		lines, err := linesForInput(in)
+	for _, ref := range refs {
+		resolved, err := sources.ResolveRef(ctx, ref)
 		if err != nil {
 			return nil, err
 		}
-		for _, line := range lines {
-			if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
-				continue
-			}
-			r, err := parseRecipient(line)
-			if err != nil {
-				return nil, fmt.Errorf("invalid recipient %q: %w", line, err)
-			}
-			recipients = append(recipients, r)
+		recipients = append(recipients, resolved...)
+	}
+	if ghUser != "" {
+		resolved, err := sources.ResolveRef(ctx, agewrap.GitHubPrefix+ghUser)
+		if err != nil {
+			log.Warn("Failed to fetch GitHub keys", "user", ghUser, "error", err)
 		}
+		recipients = append(recipients, resolved...)
 	}
 	if len(recipients) == 0 {
-		return nil, fmt.Errorf("no valid recipients found")
+		return nil, agewrap.ErrNoRecipients
 	}
 	return recipients, nil
 }
 
-// parseRecipient parses a single recipient line: an SSH public key ("ssh-...") or
-// a native age recipient ("age1...").
+// fetchGitHubKeys returns the SSH public keys published at github.com/<ghUser>.keys
+// (see agewrap.GitHubSource.Keys). A failed fetch is logged and yields no keys.
+// ghUser must already be validated by the caller. extra is passed on to
+// resolverOptions.
+func fetchGitHubKeys(
+	ctx context.Context,
+	cfg *Config,
+	ghUser string,
+	log *slog.Logger,
+	extra ...agewrap.Option,
+) []string {
+	keys, err := agewrap.NewGitHubSource(resolverOptions(cfg, log, extra...)...).Keys(ctx, ghUser)
+	if err != nil {
+		log.Warn("Failed to fetch GitHub keys", "user", ghUser, "error", err)
+		return nil
+	}
+	return keys
+}
+
+// parseRecipient parses a single recipient line, prompting through pluginUI for
+// plugin recipients.
 func parseRecipient(s string) (age.Recipient, error) {
-	if strings.HasPrefix(s, "ssh-") {
-		return agessh.ParseRecipient(s)
+	return agewrap.ParseRecipient(s, agewrap.WithPluginUI(pluginUI))
+}
+
+// checkPostQuantumMix rejects a recipient set that mixes post-quantum hybrid
+// recipients with classical ones (see agewrap.MixedRecipientsError).
+func checkPostQuantumMix(recipients []age.Recipient, log *slog.Logger) error {
+	err := agewrap.CheckPostQuantumMix(recipients)
+	if mixed, ok := errors.AsType[*agewrap.MixedRecipientsError](err); ok {
+		log.Warn("Post-quantum recipients mixed with classical ones",
+			"postQuantum", mixed.PostQuantum, "classical", mixed.Classical)
 	}
-	return age.ParseX25519Recipient(s)
+	return err
 }
 
 // encryptFile encrypts input to output for the given recipients, writing the age
 // file with 0600 permissions.
 //
 // It writes to a temp file in the target directory and renames onto output only
-// after encryption fully succeeds (mirrors tryDecrypt): a failed or partial
+// after encryption fully succeeds (mirrors decryptFile): a failed or partial
 // encryption never truncates a pre-existing file or leaves a half-written .age at
 // the target path.
-func encryptFile(input, output string, recipients []age.Recipient) (err error) {
+func encryptFile(ctx context.Context, input, output string, recipients []age.Recipient, opts outputOptions) error {
+	return encryptWithHeader(ctx, input, output, recipients, nil, opts)
+}
+
+// encryptEnvelope is encryptFile with the input's name, mode, mtime and hash
+// stored in an envelope header ahead of the contents (see envelopeMarker).
+func encryptEnvelope(ctx context.Context, input, output string, recipients []age.Recipient, opts outputOptions) error {
+	meta, err := newEnvelope(input)
+	if err != nil {
+		return err
+	}
+	header, err := meta.header()
+	if err != nil {
+		return fmt.Errorf("encoding envelope header: %w", err)
+	}
+	return encryptWithHeader(ctx, input, output, recipients, header, opts)
+}
+
+// encryptWithHeader encrypts header followed by the contents of input, writing
+// output as opts says. When ctx is cancelled the copy stops at the next read
+// and the temp file is removed.
+func encryptWithHeader(
+	ctx context.Context,
+	input, output string,
+	recipients []age.Recipient,
+	header []byte,
+	opts outputOptions,
+) (err error) {
 	// #nosec G304 -- input path is a validated CLI flag/argument
 	in, err := os.Open(input)
 	if err != nil {
@@ -297,25 +385,36 @@ func encryptFile(input, output string, recipients []age.Recipient) (err error) {
 		}
 	}()
 
-	w, err := age.Encrypt(tmp, recipients...)
+	p := startProgress(opts.progress, "encrypt", in)
+	err = agewrap.Encrypt(ctx, tmp, io.MultiReader(bytes.NewReader(header), p.reader(in)), recipients)
+	p.finish(err)
 	if err != nil {
 		_ = tmp.Close()
-		return fmt.Errorf("initializing encryption: %w", err)
+		return err
 	}
-	if _, err = io.Copy(w, in); err != nil {
+	// The ciphertext must be on disk before the rename makes it visible, so
+	// that --remove-source never deletes a plaintext whose only other copy is
+	// still in the page cache.
+	if err = tmp.Sync(); err != nil {
 		_ = tmp.Close()
-		return fmt.Errorf("writing ciphertext: %w", err)
-	}
-	// Close the age writer first (flushes the final chunk), then the temp file.
-	if err = w.Close(); err != nil {
-		_ = tmp.Close()
-		return fmt.Errorf("finalizing encryption: %w", err)
+		return fmt.Errorf("syncing ciphertext: %w", err)
 	}
 	if err = tmp.Close(); err != nil {
 		return fmt.Errorf("closing temp output: %w", err)
 	}
-	if err = os.Rename(tmpName, output); err != nil {
-		return fmt.Errorf("finalizing output: %w", err)
+	return replaceOutput(tmpName, output, opts)
+}
+
+// syncDir fsyncs a directory so a rename into it survives a crash.
+func syncDir(dir string) error {
+	// #nosec G304 -- dir is the parent of an output path chosen by the user
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("syncing %s: %w", dir, err)
+	}
+	defer func() { _ = d.Close() }()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", dir, err)
 	}
 	return nil
 }
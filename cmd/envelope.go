@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// The envelope is an opt-in plaintext layout (encrypt --envelope) that carries
+// file metadata inside the encrypted payload:
+//
+//	a-envelope/v1\n
+//	{"name":"report.pdf","mode":"0644","mtime":"2026-01-02T03:04:05Z","sha256":"<hex>"}\n
+//	<file contents>
+//
+// The first line is the marker, the second a single-line JSON header, and the
+// rest the unmodified file. Plain age still decrypts it to that stream, so
+// `age -d file.age | tail -n +3` recovers the contents without this tool.
+const (
+	envelopeMarker = "a-envelope/v1"
+
+	// envelopeModeMask caps the restored mode: no setuid/setgid/sticky bits
+	// and no group/other write, whatever the ciphertext claims.
+	envelopeModeMask fs.FileMode = 0o755
+)
+
+// envelopeMeta is the envelope header.
+type envelopeMeta struct {
+	Name   string    `json:"name"`
+	Mode   string    `json:"mode"`
+	MTime  time.Time `json:"mtime"`
+	SHA256 string    `json:"sha256"`
+}
+
+// newEnvelope describes the file at path. Hashing reads the file once before it
+// is encrypted; a file changed in between fails the hash check on decrypt.
+func newEnvelope(path string) (*envelopeMeta, error) {
+	// #nosec G304 -- input path is a validated CLI flag/argument
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening input: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("reading input metadata: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("hashing input: %w", err)
+	}
+	return &envelopeMeta{
+		Name:   filepath.Base(path),
+		Mode:   fmt.Sprintf("%04o", info.Mode().Perm()),
+		MTime:  info.ModTime().UTC(),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// header returns the marker and header lines that precede the file contents.
+func (m *envelopeMeta) header() ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(envelopeMarker + "\n" + string(data) + "\n"), nil
+}
+
+// fileMode returns the stored mode capped by envelopeModeMask.
+func (m *envelopeMeta) fileMode() (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(m.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid envelope mode %q", m.Mode)
+	}
+	return fs.FileMode(mode) & envelopeModeMask, nil
+}
+
+// readEnvelope consumes the envelope marker and header from r when the
+// plaintext starts with them. ok is false for a plain (non-envelope) stream,
+// which is left untouched.
+func readEnvelope(r *bufio.Reader) (meta *envelopeMeta, ok bool, err error) {
+	// A short read returns fewer bytes, which cannot match the marker.
+	peek, _ := r.Peek(len(envelopeMarker) + 1)
+	if string(peek) != envelopeMarker+"\n" {
+		return nil, false, nil
+	}
+	if _, err := r.Discard(len(peek)); err != nil {
+		return nil, false, err
+	}
+	// ReadSlice is bounded by the reader's buffer, so a hostile header cannot
+	// grow without limit.
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, false, fmt.Errorf("reading envelope header: %w", err)
+	}
+	meta = &envelopeMeta{}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(meta); err != nil {
+		return nil, false, fmt.Errorf("parsing envelope header: %w", err)
+	}
+	return meta, true, nil
+}
+
+// sanitizeEnvelopeName returns the stored name when it is a plain file name
+// that cannot escape the output directory.
+func sanitizeEnvelopeName(name string) (string, bool) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return "", false
+	}
+	return name, true
+}
+
+// envelopeOutput returns where decrypt writes input, whose envelope is meta,
+// when -o is not given: the original name in the directory of the derived
+// output, checked like any output (see checkOutput) before guardOutput asks
+// about replacing it. An unsafe name keeps the derived output; the ciphertext
+// must never choose a file outside that directory.
+func envelopeOutput(cmd *cobra.Command, input, output string, meta *envelopeMeta, log *slog.Logger) (string, error) {
+	name, ok := sanitizeEnvelopeName(meta.Name)
+	if !ok {
+		log.Warn("Keeping derived output name", "output", output, "reason", "unsafe original name", "name", meta.Name)
+		return output, nil
+	}
+	target := filepath.Join(filepath.Dir(output), name)
+	if target == output {
+		return output, nil
+	}
+	inInfo, err := os.Stat(input)
+	if err != nil {
+		return "", fmt.Errorf("input file does not exist: %w", err)
+	}
+	if target, err = checkOutput(cmd, target, inInfo); err != nil {
+		return "", err
+	}
+	log.Info("Restoring original file name", "output", target)
+	return target, nil
+}
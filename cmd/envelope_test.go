@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encryptEnvelopeFor encrypts path with --envelope to output for the key at pub.
+func encryptEnvelopeFor(t *testing.T, path, output, pub string) {
+	t.Helper()
+	c := Encrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", path))
+	require.NoError(t, c.Flags().Set("output", output))
+	require.NoError(t, c.Flags().Set("recipient", pub))
+	require.NoError(t, c.Flags().Set("envelope", "true"))
+	require.NoError(t, c.RunE(c, nil))
+}
+
+func TestEnvelope_RestoresNameModeAndMTime(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	src := filepath.Join(dir, "report.sh")
+	require.NoError(t, os.WriteFile(src, []byte("#!/bin/sh\necho hi\n"), 0o600))
+	require.NoError(t, os.Chmod(src, 0o4777)) // #nosec G302 -- setuid/world-write must not survive
+	mtime := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	require.NoError(t, os.Chtimes(src, mtime, mtime))
+
+	outDir := t.TempDir()
+	enc := filepath.Join(outDir, "blob.bin")
+	encryptEnvelopeFor(t, src, enc, pub)
+	// The derived name is neither written nor checked: the output is the
+	// original name from the start.
+	require.NoError(t, os.WriteFile(enc+".dec", []byte("unrelated"), 0o600))
+
+	d := Decrypt(&Config{}, discardLogger())
+	require.NoError(t, d.Flags().Set("ssh-key", priv))
+	require.NoError(t, d.RunE(d, []string{enc}))
+	unrelated, err := os.ReadFile(enc + ".dec") // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "unrelated", string(unrelated))
+
+	restored := filepath.Join(outDir, "report.sh")
+	got, err := os.ReadFile(restored) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho hi\n", string(got))
+	info, err := os.Stat(restored)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode()&(os.ModePerm|os.ModeSetuid), "mode is capped by the mask")
+	assert.True(t, info.ModTime().Equal(mtime))
+
+	// An explicit -o wins.
+	out := filepath.Join(outDir, "chosen.txt")
+	d = Decrypt(&Config{}, discardLogger())
+	require.NoError(t, d.Flags().Set("ssh-key", priv))
+	require.NoError(t, d.Flags().Set("output", out))
+	require.NoError(t, d.RunE(d, []string{enc}))
+	assert.FileExists(t, out)
+
+	// An existing file at the original name is protected like any output:
+	// refused without --force, replaced with it.
+	require.NoError(t, os.WriteFile(restored, []byte("keep me"), 0o600))
+	d = Decrypt(&Config{}, discardLogger())
+	require.NoError(t, d.Flags().Set("ssh-key", priv))
+	require.ErrorContains(t, d.RunE(d, []string{enc}), restored+" already exists")
+	kept, err := os.ReadFile(restored) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "keep me", string(kept))
+
+	d = Decrypt(&Config{}, discardLogger())
+	require.NoError(t, d.Flags().Set("ssh-key", priv))
+	require.NoError(t, d.Flags().Set("force", "true"))
+	require.NoError(t, d.RunE(d, []string{enc}))
+	replaced, err := os.ReadFile(restored) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho hi\n", string(replaced))
+}
+
+// Plain age sees the marker, the header and then the unmodified contents.
+func TestEnvelope_ReadableByPlainAge(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(src, []byte("line one\nline two\n"), 0o600))
+	enc := filepath.Join(dir, "notes.age")
+	recips := []age.Recipient{id.Recipient()}
+	require.NoError(t, encryptEnvelope(context.Background(), src, enc, recips, outputOptions{}))
+
+	f, err := os.Open(enc) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+	r, err := age.Decrypt(f, id)
+	require.NoError(t, err)
+	plain := new(strings.Builder)
+	_, err = bufio.NewReader(r).WriteTo(plain)
+	require.NoError(t, err)
+	lines := strings.SplitN(plain.String(), "\n", 3)
+	require.Len(t, lines, 3)
+	assert.Equal(t, envelopeMarker, lines[0])
+	assert.Contains(t, lines[1], `"name":"notes.txt"`)
+	assert.Equal(t, "line one\nline two\n", lines[2])
+}
+
+func TestReadEnvelope(t *testing.T) {
+	_, ok, err := readEnvelope(bufio.NewReader(strings.NewReader("plain data")))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = readEnvelope(bufio.NewReader(strings.NewReader(envelopeMarker + "\n{\"evil\":1}\n")))
+	assert.ErrorContains(t, err, "parsing envelope header")
+
+	_, _, err = readEnvelope(bufio.NewReader(strings.NewReader(envelopeMarker + "\n" + strings.Repeat("x", 8192))))
+	assert.ErrorContains(t, err, "reading envelope header")
+}
+
+func TestEnvelope_HashMismatch(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	recips, err := resolveRefs(t, []string{pub}, discardLogger())
+	require.NoError(t, err)
+	meta := &envelopeMeta{Name: "x", Mode: "0644", SHA256: "00"}
+	header, err := meta.header()
+	require.NoError(t, err)
+	src := filepath.Join(dir, "x")
+	require.NoError(t, os.WriteFile(src, []byte("contents"), 0o600))
+	enc := filepath.Join(dir, "x.age")
+	require.NoError(t, encryptWithHeader(context.Background(), src, enc, recips, header, outputOptions{}))
+
+	out := filepath.Join(dir, "out")
+	_, err = decryptFile(context.Background(), priv, out, enc, outputOptions{})
+	assert.ErrorContains(t, err, "hash mismatch")
+	assert.NoFileExists(t, out)
+}
+
+func TestSanitizeEnvelopeName(t *testing.T) {
+	for _, bad := range []string{"", ".", "..", "../x", "a/b", `a\b`, "a\x00b"} {
+		_, ok := sanitizeEnvelopeName(bad)
+		assert.False(t, ok, bad)
+	}
+	name, ok := sanitizeEnvelopeName(".env")
+	assert.True(t, ok)
+	assert.Equal(t, ".env", name)
+
+	out := filepath.Join(t.TempDir(), "out")
+	got, err := envelopeOutput(Decrypt(&Config{}, discardLogger()), out, out, &envelopeMeta{Name: "../../etc/passwd"},
+		discardLogger())
+	require.NoError(t, err)
+	assert.Equal(t, out, got, "an unsafe name keeps the derived output")
+}
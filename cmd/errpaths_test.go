@@ -69,14 +69,6 @@ func TestLoadConfig_MissingDefaultsError(t *testing.T) {
 	assert.Error(t, err)
 }
 
-func TestReadKeyCache_Unreadable(t *testing.T) {
-	// A directory at cachePath: Stat succeeds and is fresh, but ReadFile fails (EISDIR).
-	dir := filepath.Join(t.TempDir(), "user.keys")
-	require.NoError(t, os.Mkdir(dir, 0o700))
-	_, ok := readKeyCache(dir, 60)
-	assert.False(t, ok)
-}
-
 func TestInitConfigPaths_UserConfigDirError(t *testing.T) {
 	t.Setenv("HOME", "")
 	t.Setenv("XDG_CONFIG_HOME", "")
@@ -96,7 +88,7 @@ func TestEncryptCmd_AgeFailure(t *testing.T) {
 	in := filepath.Join(t.TempDir(), "in.txt")
 	require.NoError(t, os.WriteFile(in, []byte("data"), 0o600))
 	// A bogus recipient string is not a file and not a valid ssh/age key, so
-	// parseRecipients rejects it and RunE fails.
+	// keySources rejects it and RunE fails.
 	c := Encrypt(&Config{DefaultRecipients: []string{"age1bogusrecipient"}}, discardLogger())
 	require.NoError(t, c.Flags().Set("input", in))
 	require.NoError(t, c.Flags().Set("output", filepath.Join(t.TempDir(), "o.age")))
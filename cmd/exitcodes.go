@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+
+	"filippo.io/age"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// Exit statuses. Each class of failure has its own status so scripts can react
+// without parsing messages; the codes are part of the CLI's interface and must
+// not be renumbered.
+const (
+	ExitOK            = 0
+	ExitFailure       = 1   // any failure not classified below, including usage errors
+	ExitConfig        = 2   // the config file could not be read, parsed or updated
+	ExitNoRecipients  = 3   // encrypt found no usable recipient
+	ExitNoMatchingKey = 4   // decrypt or verify found no key the file is encrypted to
+	ExitTampered      = 5   // a key matched, but the ciphertext is truncated or modified
+	ExitIO            = 6   // reading or writing a file failed
+	ExitNetwork       = 7   // fetching keys failed
+	ExitInterrupted   = 130 // SIGINT or SIGTERM, after the shell's 128+SIGINT convention
+)
+
+// errorClass is a failure class: the code reported by --output-format json and
+// the exit status.
+type errorClass struct {
+	code string
+	exit int
+}
+
+// The failure classes, one per exit status.
+var (
+	classFailure       = errorClass{"failure", ExitFailure}
+	classConfig        = errorClass{"config", ExitConfig}
+	classNoRecipients  = errorClass{"no_recipients", ExitNoRecipients}
+	classNoMatchingKey = errorClass{"no_matching_key", ExitNoMatchingKey}
+	classTampered      = errorClass{"tampered", ExitTampered}
+	classIO            = errorClass{"io", ExitIO}
+	classNetwork       = errorClass{"network", ExitNetwork}
+	classInterrupted   = errorClass{"interrupted", ExitInterrupted}
+)
+
+// classifiedError tags an error with its class where the type of the error
+// alone cannot tell, e.g. a tampered payload from a wrong key. The message is
+// unchanged.
+type classifiedError struct {
+	class errorClass
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+func (e *classifiedError) Unwrap() error { return e.err }
+
+// withClass tags err with class; a nil err stays nil.
+func withClass(class errorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// ConfigError tags err as a configuration failure (ExitConfig), for the config
+// loading main does before any command runs.
+func ConfigError(err error) error {
+	return withClass(classConfig, err)
+}
+
+// classify returns the class of err. An explicit tag wins; otherwise the class
+// follows from the error types age, agewrap and the standard library return.
+func classify(err error) errorClass {
+	if c, ok := errors.AsType[*classifiedError](err); ok {
+		return c.class
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return classInterrupted
+	case errors.Is(err, agewrap.ErrNoRecipients):
+		return classNoRecipients
+	case errors.Is(err, agewrap.ErrHeaderMAC):
+		return classTampered
+	}
+	if _, ok := errors.AsType[*age.NoIdentityMatchError](err); ok {
+		return classNoMatchingKey
+	}
+	if _, ok := errors.AsType[*agewrap.GitHubError](err); ok {
+		return classNetwork
+	}
+	if _, ok := errors.AsType[*url.Error](err); ok {
+		return classNetwork
+	}
+	// Not net.Error: syscall.Errno satisfies it, so a plain file error would match.
+	if _, ok := errors.AsType[*net.OpError](err); ok {
+		return classNetwork
+	}
+	if _, ok := errors.AsType[*fs.PathError](err); ok {
+		return classIO
+	}
+	if _, ok := errors.AsType[*os.LinkError](err); ok {
+		return classIO
+	}
+	return classFailure
+}
+
+// ExitCode returns the exit status for a command's error: ExitOK for nil.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	return classify(err).exit
+}
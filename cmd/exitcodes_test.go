@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+func TestExitCode(t *testing.T) {
+	_, pathErr := os.Open("/no/such/file")
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{nil, ExitOK},
+		{errors.New("boom"), ExitFailure},
+		{ConfigError(errors.New("bad yaml")), ExitConfig},
+		{fmt.Errorf("resolving: %w", agewrap.ErrNoRecipients), ExitNoRecipients},
+		{&age.NoIdentityMatchError{}, ExitNoMatchingKey},
+		{withClass(classTampered, errors.New("bad chunk")), ExitTampered},
+		{fmt.Errorf("opening input: %w", pathErr), ExitIO},
+		{&agewrap.GitHubError{User: "x", StatusCode: 404}, ExitNetwork},
+		{fmt.Errorf("copy: %w", context.Canceled), ExitInterrupted},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, ExitCode(c.err), "%v", c.err)
+	}
+	assert.Nil(t, withClass(classIO, nil))
+	assert.Equal(t, "bad yaml", ConfigError(errors.New("bad yaml")).Error(), "tagging keeps the message")
+}
+
+func TestVerifyError(t *testing.T) {
+	ok := verifyResult{Status: verifyOK}
+	noMatch := verifyResult{Status: verifyNoMatch}
+	corrupt := verifyResult{Status: verifyCorrupt}
+
+	assert.NoError(t, verifyError([]verifyResult{ok, ok}))
+	assert.Equal(t, ExitNoMatchingKey, ExitCode(verifyError([]verifyResult{ok, noMatch, noMatch})))
+	assert.Equal(t, ExitTampered, ExitCode(verifyError([]verifyResult{corrupt})))
+	assert.Equal(t, ExitFailure, ExitCode(verifyError([]verifyResult{noMatch, corrupt})))
+	assert.EqualError(t, verifyError([]verifyResult{ok, corrupt}), "1 of 2 files failed verification")
+}
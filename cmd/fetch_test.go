@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -10,31 +11,33 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
 )
 
-// withGitHubKeysServer points githubKeysURL at a local test server for the duration
-// of the test and restores it afterwards.
-func withGitHubKeysServer(t *testing.T, handler http.HandlerFunc) {
+// githubKeysServer starts a local test server, which lives for the duration of
+// the test, and returns the agewrap options that fetch GitHub keys from it.
+func githubKeysServer(t *testing.T, handler http.HandlerFunc) []agewrap.Option {
 	t.Helper()
 	srv := httptest.NewServer(handler)
 	t.Cleanup(srv.Close)
-	orig := githubKeysURL
-	githubKeysURL = func(user string) string { return srv.URL + "/" + user + ".keys" }
-	t.Cleanup(func() { githubKeysURL = orig })
+	return []agewrap.Option{
+		agewrap.WithHTTPClient(srv.Client()),
+		agewrap.WithGitHubKeysURL(func(user string) string { return srv.URL + "/" + user + ".keys" }),
+	}
 }
 
 func TestFetchGitHubKeys_NetworkOK(t *testing.T) {
-	withGitHubKeysServer(t, func(w http.ResponseWriter, r *http.Request) {
+	dir := t.TempDir()
+	github := githubKeysServer(t, func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/good.keys" {
 			_, _ = fmt.Fprintln(w, "ssh-ed25519 NETKEY")
 			return
 		}
 		w.WriteHeader(http.StatusNotFound)
 	})
-
-	dir := t.TempDir()
 	cfg := &Config{CacheDir: dir, CacheTTLMinutes: 60}
-	keys := fetchGitHubKeys(cfg, "good", discardLogger())
+	keys := fetchGitHubKeys(context.Background(), cfg, "good", discardLogger(), github...)
 	assert.Equal(t, []string{"ssh-ed25519 NETKEY"}, keys)
 
 	// The successful response must have been written to the cache.
@@ -44,29 +47,27 @@ func TestFetchGitHubKeys_NetworkOK(t *testing.T) {
 }
 
 func TestFetchGitHubKeys_NotFound(t *testing.T) {
-	withGitHubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+	github := githubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 	})
-	assert.Nil(t, fetchGitHubKeys(&Config{}, "missing", discardLogger()))
+	assert.Nil(t, fetchGitHubKeys(context.Background(), &Config{}, "missing", discardLogger(), github...))
 }
 
 func TestFetchGitHubKeys_ConnError(t *testing.T) {
-	orig := githubKeysURL
-	githubKeysURL = func(user string) string { return "http://127.0.0.1:0/" + user + ".keys" }
-	t.Cleanup(func() { githubKeysURL = orig })
-	assert.Nil(t, fetchGitHubKeys(&Config{}, "x", discardLogger()))
+	unreachable := agewrap.WithGitHubKeysURL(func(user string) string { return "http://127.0.0.1:0/" + user + ".keys" })
+	assert.Nil(t, fetchGitHubKeys(context.Background(), &Config{}, "x", discardLogger(), unreachable))
 }
 
 func TestFetchGitHubKeys_CacheDisabled(t *testing.T) {
 	calls := 0
-	withGitHubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+	dir := t.TempDir()
+	github := githubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
 		calls++
 		_, _ = fmt.Fprintln(w, "ssh-ed25519 NOCACHE")
 	})
-	dir := t.TempDir()
 	cfg := &Config{CacheDir: dir, CacheTTLMinutes: 0} // TTL 0 disables caching
-	_ = fetchGitHubKeys(cfg, "user", discardLogger())
-	_ = fetchGitHubKeys(cfg, "user", discardLogger())
+	_ = fetchGitHubKeys(context.Background(), cfg, "user", discardLogger(), github...)
+	_ = fetchGitHubKeys(context.Background(), cfg, "user", discardLogger(), github...)
 	assert.Equal(t, 2, calls, "both calls should hit the network when caching is disabled")
 	assert.NoFileExists(t, filepath.Join(dir, "user.keys"), "no cache file when TTL is 0")
 }
@@ -74,7 +75,7 @@ func TestFetchGitHubKeys_CacheDisabled(t *testing.T) {
 func TestFetchGitHubKeys_BodyReadError(t *testing.T) {
 	// Hijack the connection and promise more bytes than we send, then close, so the
 	// client's io.ReadAll fails with an unexpected EOF.
-	withGitHubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+	github := githubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
 		conn, bufrw, err := http.NewResponseController(w).Hijack()
 		if err != nil {
 			return
@@ -83,32 +84,49 @@ func TestFetchGitHubKeys_BodyReadError(t *testing.T) {
 		_ = bufrw.Flush()
 		_ = conn.Close()
 	})
-	assert.Nil(t, fetchGitHubKeys(&Config{}, "user", discardLogger()))
+	assert.Nil(t, fetchGitHubKeys(context.Background(), &Config{}, "user", discardLogger(), github...))
 }
 
 func TestCollectRecipients(t *testing.T) {
 	log := discardLogger()
 
-	// Invalid GitHub username: warned and skipped, config + flag recipients returned.
+	// Invalid GitHub username: warned and dropped, config + flag recipients returned.
 	cfg := &Config{DefaultRecipients: []string{"/a.pub"}, GitHubUser: "bad user!"}
 	got, ghUser := collectRecipients(cfg, []string{"extra"}, "", log)
 	assert.Equal(t, []string{"/a.pub", "extra"}, got)
-	assert.Equal(t, "bad user!", ghUser)
+	assert.Empty(t, ghUser)
 
 	// No GitHub user: only config + flag recipients.
 	got2, ghUser2 := collectRecipients(&Config{DefaultRecipients: []string{"x"}}, nil, "", log)
 	assert.Equal(t, []string{"x"}, got2)
 	assert.Empty(t, ghUser2)
 
-	// Valid GitHub user via flag: keys fetched and appended.
-	withGitHubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
-		_, _ = fmt.Fprintln(w, "ssh-ed25519 GH")
-	})
-	got3, ghUser3 := collectRecipients(&Config{}, []string{"local"}, "octocat", log)
-	assert.Equal(t, []string{"local", "ssh-ed25519 GH"}, got3)
+	// The flag overrides the configured user; nothing is fetched yet.
+	got3, ghUser3 := collectRecipients(&Config{GitHubUser: "other"}, []string{"local"}, "octocat", log)
+	assert.Equal(t, []string{"local"}, got3)
 	assert.Equal(t, "octocat", ghUser3)
 }
 
+// The configured GitHub user is best effort: a failed fetch leaves the other
+// recipients usable, unlike an explicit github:<user> recipient.
+func TestResolveRecipients_GitHubUserBestEffort(t *testing.T) {
+	_, pub := makeSSHKey(t, t.TempDir())
+	github := githubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	sources := keySources(&Config{}, defaultKnownHostsPath(), discardLogger(), github...)
+
+	got, err := resolveRecipients(context.Background(), sources, []string{pub}, "ghost", discardLogger())
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+
+	_, err = resolveRecipients(context.Background(), sources, nil, "ghost", discardLogger())
+	assert.ErrorIs(t, err, agewrap.ErrNoRecipients)
+
+	_, err = resolveRecipients(context.Background(), sources, []string{pub, "github:ghost"}, "", discardLogger())
+	assert.ErrorContains(t, err, "status 404")
+}
+
 func TestEncryptCmd_Validation(t *testing.T) {
 	log := discardLogger()
 	run := func(flags map[string]string) error {
@@ -133,7 +151,8 @@ func TestEncryptCmd_Validation(t *testing.T) {
 
 func TestEncryptFile_MissingInput(t *testing.T) {
 	// A missing input file must error before any encryption is attempted.
-	err := encryptFile("/no/such/input", filepath.Join(t.TempDir(), "o.age"), nil)
+	err := encryptFile(context.Background(), "/no/such/input", filepath.Join(t.TempDir(), "o.age"), nil,
+		outputOptions{})
 	assert.ErrorContains(t, err, "opening input")
 }
 
@@ -146,7 +165,7 @@ func TestEncryptFile_FailureLeavesPreexistingIntact(t *testing.T) {
 	out := filepath.Join(dir, "out.age")
 	require.NoError(t, os.WriteFile(out, []byte("PREEXISTING"), 0o600))
 
-	assert.Error(t, encryptFile(in, out, nil), "zero recipients must fail")
+	assert.Error(t, encryptFile(context.Background(), in, out, nil, outputOptions{}), "zero recipients must fail")
 
 	got, err := os.ReadFile(out) // #nosec G304 -- test temp path
 	require.NoError(t, err)
@@ -158,3 +177,25 @@ func TestEncryptFile_FailureLeavesPreexistingIntact(t *testing.T) {
 		assert.NotContains(t, e.Name(), ".a-encrypt", "temp file must be cleaned up")
 	}
 }
+
+// A github:<user> recipient is fetched through the configured cache.
+func TestEncryptCmd_GitHubRecipient(t *testing.T) {
+	_, pub := makeSSHKey(t, t.TempDir())
+	line := pubKeyLine(t, pub)
+	calls := 0
+	github := githubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		_, _ = fmt.Fprintln(w, line)
+	})
+	cfg := &Config{CacheDir: t.TempDir(), CacheTTLMinutes: 60}
+	in := filepath.Join(t.TempDir(), "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+	for range 2 {
+		c := Encrypt(cfg, discardLogger(), github...)
+		require.NoError(t, c.Flags().Set("input", in))
+		require.NoError(t, c.Flags().Set("recipient", "github:octocat"))
+		require.NoError(t, c.Flags().Set("force", "true"))
+		require.NoError(t, c.RunE(c, nil))
+	}
+	assert.Equal(t, 1, calls, "the second run uses the cache")
+}
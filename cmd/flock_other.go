@@ -0,0 +1,11 @@
+//go:build !unix
+
+package cmd
+
+import "os"
+
+// lockFile does nothing: advisory locks are not available on this platform, so
+// concurrent rotations rely on the rename being atomic.
+func lockFile(*os.File) error {
+	return nil
+}
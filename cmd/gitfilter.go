@@ -0,0 +1,544 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// ageMagic starts every binary age file; the filters use it to tell
+// ciphertext from plaintext.
+const ageMagic = "age-encryption.org/v1\n"
+
+// filterCacheDir is the directory under the git dir where clean and smudge
+// remember which plaintext each ciphertext holds.
+const filterCacheDir = "a-filter"
+
+// filterRecipientsFile, committed at the top of the working tree, lists the
+// recipients clean encrypts to, one reference per line, so every committer
+// encrypts to the same set.
+const filterRecipientsFile = ".a-recipients"
+
+// GitFilter returns the `git-filter` command, the clean, smudge and textconv
+// programs git runs for paths marked in .gitattributes (see GitCmd). extra is
+// added to the agewrap options recipients are resolved with (see
+// resolverOptions).
+func GitFilter(cfg *Config, log *slog.Logger, extra ...agewrap.Option) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "git-filter",
+		Short: "Git clean/smudge/textconv filter for transparent encryption (clean|smudge|textconv)",
+		Long: `Filter programs for git, set up by ` + "`a git init-filter`" + `.
+
+clean encrypts the plaintext on stdin to the recipients listed in the
+repository's committed ` + filterRecipientsFile + ` file (plus --recipient) and prints
+the ciphertext. Without that file it falls back to your own default_recipients
+and github_user, with a warning.
+When the plaintext is unchanged since the last clean or checkout, the ciphertext
+already in the index is reused, so git sees no change. smudge decrypts with the
+keys decrypt would use; without a matching key it passes the ciphertext through,
+so repositories still check out for people who cannot read the secrets.
+textconv prints a file's plaintext for git diff and git log -p.`,
+		SilenceUsage: true,
+	}
+
+	clean := &cobra.Command{
+		Use:   "clean [path]",
+		Short: "Encrypt stdin to stdout, reusing the indexed ciphertext for unchanged content",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			plain, err := io.ReadAll(cmd.InOrStdin())
+			if err != nil {
+				return fmt.Errorf("reading stdin: %w", err)
+			}
+			path := ""
+			if len(args) > 0 {
+				path = args[0]
+			}
+			out, err := cleanFilter(cmd, cfg, path, plain, log, extra)
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(out)
+			return err
+		},
+	}
+	clean.Flags().StringSliceP("recipient", "r", nil,
+		"Recipient reference, as for encrypt (repeatable); added to the repository's recipients")
+
+	smudge := &cobra.Command{
+		Use:   "smudge [path]",
+		Short: "Decrypt stdin to stdout, passing it through when no key matches",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := io.ReadAll(cmd.InOrStdin())
+			if err != nil {
+				return fmt.Errorf("reading stdin: %w", err)
+			}
+			path := "stdin"
+			if len(args) > 0 {
+				path = args[0]
+			}
+			out, err := smudgeFilter(cmd, cfg, path, data, log, extra)
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(out)
+			return err
+		},
+	}
+
+	textconv := &cobra.Command{
+		Use:   "textconv <file>",
+		Short: "Print the plaintext of an encrypted file for git diff",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// #nosec G304 -- git passes a temp file holding the blob
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			plain, _, err := decryptFiltered(cmd, cfg, args[0], data, log)
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(plain)
+			return err
+		},
+	}
+
+	for _, c := range []*cobra.Command{smudge, textconv} {
+		c.Flags().String("ssh-key", "", "SSH private key to decrypt with")
+		c.Flags().StringSlice("identity", nil,
+			"age identity file (native or plugin identities); replaces identity_files from the config")
+	}
+	cmd.AddCommand(clean, smudge, textconv)
+	return cmd
+}
+
+// cleanFilter returns the ciphertext git stores for plain at path. Content
+// that is already age ciphertext (checked out without a key) is stored as is.
+//
+// age encryption is randomized, so encrypting the same plaintext twice gives
+// different bytes and git would report every touched file as modified. The
+// ciphertext in the index is reused instead when the filter cache says it holds
+// the same plaintext, encrypted to the same recipients.
+func cleanFilter(
+	cmd *cobra.Command,
+	cfg *Config,
+	path string,
+	plain []byte,
+	log *slog.Logger,
+	extra []agewrap.Option,
+) ([]byte, error) {
+	if bytes.HasPrefix(plain, []byte(ageMagic)) {
+		return plain, nil
+	}
+	ctx := commandContext(cmd)
+	recips, err := filterRecipientSet(cmd, cfg, log, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	plainSum, recipSum := sha256Hex(plain), recipientsSum(recips)
+	cache, err := openFilterCache(ctx)
+	if err != nil {
+		log.Debug("Git filter cache unavailable; ciphertext will not be reused", "error", err)
+	}
+	if cache != nil && path != "" {
+		// The index holds what the last clean or checkout produced for path.
+		if prev, err := gitOutput(ctx, "cat-file", "blob", ":"+path); err == nil {
+			stored, ok := cache.lookup(prev, plainSum)
+			if ok && stored != "" && stored != recipSum {
+				log.Warn("Recipients changed since the file was encrypted; encrypting it again", "path", path)
+			} else if ok {
+				if stored == "" {
+					// Checked out while the recipients could not be resolved;
+					// they can now, so record them for the next clean.
+					if err := cache.store(prev, plainSum, recipSum); err != nil {
+						log.Warn("Could not update the git filter cache", "error", err)
+					}
+				}
+				log.Debug("Reusing indexed ciphertext", "path", path)
+				return prev, nil
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := agewrap.Encrypt(ctx, &out, bytes.NewReader(plain), recips); err != nil {
+		return nil, fmt.Errorf("encrypting %s: %w", path, err)
+	}
+	if cache != nil {
+		if err := cache.store(out.Bytes(), plainSum, recipSum); err != nil {
+			log.Warn("Could not update the git filter cache", "error", err)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// filterRecipientSet resolves the recipients clean encrypts to (see
+// filterRecipients) through keySources, configured with extra, and checks that
+// they can be used together.
+func filterRecipientSet(
+	cmd *cobra.Command,
+	cfg *Config,
+	log *slog.Logger,
+	extra []agewrap.Option,
+) ([]age.Recipient, error) {
+	flagRecipients, _ := cmd.Flags().GetStringSlice("recipient")
+	refs, ghUser, err := filterRecipients(cfg, flagRecipients, log)
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 && ghUser == "" {
+		return nil, withClass(classNoRecipients, fmt.Errorf(
+			"no recipients: list them in %s at the top of the repository, or pass --recipient", filterRecipientsFile))
+	}
+	sources := keySources(cfg, defaultKnownHostsPath(), log, extra...)
+	recips, err := resolveRecipients(commandContext(cmd), sources, refs, ghUser, log)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPostQuantumMix(recips, log); err != nil {
+		return nil, err
+	}
+	return recips, nil
+}
+
+// filterRecipients returns the recipient references clean encrypts to: the
+// lines of the committed recipients file plus extra. Without the file, the
+// committer's own default_recipients and github_user are used, which differ
+// from one person to the next, so that is warned about.
+func filterRecipients(cfg *Config, extra []string, log *slog.Logger) ([]string, string, error) {
+	// git runs filters from the top of the working tree.
+	data, err := os.ReadFile(filterRecipientsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Warn("No "+filterRecipientsFile+" in the repository; encrypting to your own default recipients",
+			"hint", "commit a "+filterRecipientsFile+" file so everyone encrypts to the same recipients")
+		refs, ghUser := collectRecipients(cfg, extra, "", log)
+		return refs, ghUser, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("reading %s: %w", filterRecipientsFile, err)
+	}
+	var refs []string
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			refs = append(refs, line)
+		}
+	}
+	return slices.Concat(refs, extra), "", nil
+}
+
+// smudgeFilter returns the working-tree contents for the stored data at path,
+// and records the pair in the filter cache so the next clean reuses data.
+func smudgeFilter(
+	cmd *cobra.Command,
+	cfg *Config,
+	path string,
+	data []byte,
+	log *slog.Logger,
+	extra []agewrap.Option,
+) ([]byte, error) {
+	plain, decrypted, err := decryptFiltered(cmd, cfg, path, data, log)
+	if err != nil || !decrypted {
+		return plain, err
+	}
+	// The checked-out ciphertext was encrypted to the recipients committed
+	// with it, which are the ones the working tree lists now. Resolving them is
+	// quiet, as clean reports recipient problems; when it fails the sum is left
+	// empty and the next clean fills it in.
+	recipSum := ""
+	if recips, err := filterRecipientSet(cmd, cfg, slog.New(slog.DiscardHandler), extra); err == nil {
+		recipSum = recipientsSum(recips)
+	} else {
+		log.Debug("Recipients unavailable; caching the checkout without them", "path", path, "error", err)
+	}
+	if cache, err := openFilterCache(commandContext(cmd)); err == nil {
+		if err := cache.store(data, sha256Hex(plain), recipSum); err != nil {
+			log.Warn("Could not update the git filter cache", "error", err)
+		}
+	}
+	return plain, nil
+}
+
+// decryptFiltered decrypts data with the keys decrypt would try. Data that is
+// not age ciphertext, or that none of the keys can open, is returned unchanged
+// with decrypted false, so checkouts work without keys. A file that a key
+// opens but that fails to authenticate is an error: git must not check out
+// tampered plaintext.
+//
+// The plaintext is buffered and returned only once age has authenticated the
+// whole stream.
+func decryptFiltered(
+	cmd *cobra.Command,
+	cfg *Config,
+	path string,
+	data []byte,
+	log *slog.Logger,
+) (plain []byte, decrypted bool, err error) {
+	if !bytes.HasPrefix(data, []byte(ageMagic)) {
+		return data, false, nil
+	}
+	keys, _, err := decryptKeys(cmd, cfg, log)
+	if err != nil {
+		log.Warn("No keys to decrypt with; leaving the file encrypted", "path", path, "error", err)
+		return data, false, nil
+	}
+	var identities []age.Identity
+	for _, keyPath := range keys {
+		ids, err := parseIdentityFile(keyPath)
+		if err != nil {
+			log.Debug("Skipping key", "key", keyPath, "error", err)
+			continue
+		}
+		identities = append(identities, ids...)
+	}
+	if len(identities) == 0 {
+		log.Warn("No usable keys; leaving the file encrypted", "path", path)
+		return data, false, nil
+	}
+
+	r, err := agewrap.NewDecryptReader(commandContext(cmd), bytes.NewReader(data), identities...)
+	if _, ok := errors.AsType[*age.NoIdentityMatchError](err); ok {
+		log.Warn("None of your keys can decrypt this file; leaving it encrypted", "path", path)
+		return data, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("decrypting %s: %w", path, err)
+	}
+	plain, err = io.ReadAll(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("decrypting %s: %w", path, payloadError(err))
+	}
+	return plain, true, nil
+}
+
+// sha256Hex returns the hex SHA-256 of data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// recipientsSum identifies a recipient set independent of its order.
+func recipientsSum(recipients []age.Recipient) string {
+	fps := recipientFingerprints(recipients)
+	slices.Sort(fps)
+	return sha256Hex([]byte(strings.Join(fps, "\n")))
+}
+
+// filterCache maps ciphertexts, by hash, to the hash of their plaintext and of
+// the recipients clean encrypted them to. It lives in the git dir, next to the
+// objects it describes, and is never committed; deleting it only makes the
+// next clean of each file produce new ciphertext.
+type filterCache struct {
+	dir string
+}
+
+// openFilterCache returns the cache of the repository around the working
+// directory; git runs filters from the top of the working tree.
+func openFilterCache(ctx context.Context) (*filterCache, error) {
+	out, err := gitOutput(ctx, "rev-parse", "--git-common-dir")
+	if err != nil {
+		return nil, err
+	}
+	gitDir, err := filepath.Abs(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, err
+	}
+	return &filterCache{dir: filepath.Join(gitDir, filterCacheDir)}, nil
+}
+
+// lookup returns the recipient sum recorded for cipher, "" when unknown, if
+// cipher was recorded as the encryption of the plaintext with plainSum.
+func (c *filterCache) lookup(cipher []byte, plainSum string) (recipSum string, ok bool) {
+	data, err := os.ReadFile(filepath.Join(c.dir, sha256Hex(cipher))) // #nosec G304 -- name is a hex hash
+	if err != nil {
+		return "", false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || fields[0] != plainSum {
+		return "", false
+	}
+	if len(fields) == 1 {
+		return "", true
+	}
+	return fields[1], true
+}
+
+// store records that cipher holds the plaintext with plainSum, encrypted to
+// the recipients with recipSum ("" when unknown).
+func (c *filterCache) store(cipher []byte, plainSum, recipSum string) error {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+	line := strings.TrimSpace(plainSum+" "+recipSum) + "\n"
+	return os.WriteFile(filepath.Join(c.dir, sha256Hex(cipher)), []byte(line), 0o600)
+}
+
+// gitOutput runs git with args and returns its stdout; the error carries
+// git's stderr.
+func gitOutput(ctx context.Context, args ...string) ([]byte, error) {
+	// #nosec G204 -- runs git with fixed subcommands; args are paths and config values
+	c := exec.CommandContext(ctx, "git", args...)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// GitCmd returns the `git` command, which sets up the repository integration:
+// `init-filter` writes the git config for the git-filter programs.
+func GitCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "git",
+		Short: "Set up git integration (init-filter)",
+	}
+
+	initFilter := &cobra.Command{
+		Use:   "init-filter",
+		Short: "Write the git config that runs a as the clean/smudge filter and diff textconv",
+		Long: `Write filter.<name>.clean, filter.<name>.smudge, filter.<name>.required and
+diff.<name>.textconv to the repository's git config (--global for yours), then
+mark files in .gitattributes:
+
+    secrets/** filter=a diff=a
+
+--recipient adds references to the ` + filterRecipientsFile + ` file at the top of the
+working tree, which clean encrypts to; commit it so everyone uses the same
+recipients. The commands use the path of this binary; run init-filter again
+after moving it.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			name, _ := cmd.Flags().GetString("name")
+			if !filterNameRe.MatchString(name) {
+				return fmt.Errorf("invalid filter name %q: use letters, digits, - and _", name)
+			}
+			exe, err := os.Executable()
+			if err != nil {
+				return fmt.Errorf("locating the a binary: %w", err)
+			}
+			recipients, _ := cmd.Flags().GetStringSlice("recipient")
+			scope := "--local"
+			if global, _ := cmd.Flags().GetBool("global"); global {
+				scope = "--global"
+			}
+
+			ctx := commandContext(cmd)
+			if len(recipients) > 0 {
+				if err := addFilterRecipients(ctx, cmd.OutOrStdout(), recipients); err != nil {
+					return err
+				}
+			}
+			for _, kv := range filterConfig(name, exe) {
+				if _, err := gitOutput(ctx, "config", scope, kv[0], kv[1]); err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(cmd.OutOrStdout(), "%s = %s\n", kv[0], kv[1]); err != nil {
+					return err
+				}
+			}
+			_, err = fmt.Fprintf(cmd.OutOrStdout(),
+				"\nMark files to encrypt in .gitattributes, e.g.:\n    secrets/** filter=%s diff=%s\n", name, name)
+			return err
+		},
+	}
+	initFilter.Flags().String("name", "a", "Name of the filter and diff driver in .gitattributes")
+	initFilter.Flags().Bool("global", false, "Write to your global git config instead of the repository's")
+	initFilter.Flags().StringSliceP("recipient", "r", nil,
+		"Recipient reference for clean (repeatable), added to "+filterRecipientsFile+" in the working tree")
+
+	cmd.AddCommand(initFilter)
+	return cmd
+}
+
+// addFilterRecipients appends the refs not yet listed to the recipients file
+// at the top of the working tree, creating it when needed.
+func addFilterRecipients(ctx context.Context, out io.Writer, refs []string) error {
+	top, err := gitOutput(ctx, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(strings.TrimSpace(string(top)), filterRecipientsFile)
+	// #nosec G304 -- a fixed name at the top of the working tree
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		data = []byte("# Recipients of files encrypted by the a git filter, one per line.\n")
+	} else if !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	listed := strings.Split(string(data), "\n")
+	for i := range listed {
+		listed[i] = strings.TrimSpace(listed[i])
+	}
+	added := 0
+	for _, ref := range refs {
+		if !slices.Contains(listed, ref) {
+			data = append(data, ref+"\n"...)
+			listed = append(listed, ref)
+			added++
+		}
+	}
+	if added == 0 {
+		return nil
+	}
+	// The file names public keys and is committed, so it is world-readable.
+	if err := writeFileAtomic(path, data, ".a-recipients-*", outputOptions{perm: 0o644}); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Added %s to %s; commit it.\n", plural(added, "recipient"), path)
+	return err
+}
+
+// filterNameRe matches names usable as a git config subsection and in
+// .gitattributes without quoting.
+var filterNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// filterConfig returns the git config entries, in order, that run exe as the
+// filter and diff driver called name. git expands %f to the quoted path.
+// filter.<name>.required makes a failing filter fail the git command instead
+// of storing plaintext.
+func filterConfig(name, exe string) [][2]string {
+	return [][2]string{
+		{"filter." + name + ".clean", shellQuote(exe) + " git-filter clean -- %f"},
+		{"filter." + name + ".smudge", shellQuote(exe) + " git-filter smudge -- %f"},
+		{"filter." + name + ".required", "true"},
+		{"diff." + name + ".textconv", shellQuote(exe) + " git-filter textconv"},
+	}
+}
+
+// shellQuote quotes s for the POSIX shell git runs filter commands with.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-", r)
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// initGitRepo makes dir a git repository and the working directory.
+func initGitRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	_, err := gitOutput(t.Context(), "init", "-q")
+	require.NoError(t, err)
+	return dir
+}
+
+// runFilter runs a git-filter subcommand with stdin and returns its stdout.
+func runFilter(t *testing.T, cfg *Config, stdin []byte, args ...string) ([]byte, error) {
+	t.Helper()
+	cmd := GitFilter(cfg, discardLogger())
+	var stdout bytes.Buffer
+	cmd.SetIn(bytes.NewReader(stdin))
+	cmd.SetOut(&stdout)
+	cmd.SetErr(&bytes.Buffer{})
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return stdout.Bytes(), err
+}
+
+// stage puts data in the index for path without running any filter.
+func stage(t *testing.T, path string, data []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	_, err := gitOutput(t.Context(), "add", path)
+	require.NoError(t, err)
+}
+
+func TestGitFilter_CleanIsStable(t *testing.T) {
+	dir := initGitRepo(t)
+	priv, pub := makeSSHKey(t, t.TempDir())
+	cfg := &Config{DefaultRecipients: []string{pub}, SSHKeyPath: priv}
+	plain := []byte("API_TOKEN=s3cret\n")
+
+	first, err := runFilter(t, cfg, plain, "clean", "secret.env")
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(first, []byte(ageMagic)))
+	stage(t, "secret.env", first)
+
+	again, err := runFilter(t, cfg, plain, "clean", "secret.env")
+	require.NoError(t, err)
+	assert.Equal(t, first, again, "unchanged plaintext keeps the indexed ciphertext")
+
+	changed, err := runFilter(t, cfg, []byte("API_TOKEN=rotated\n"), "clean", "secret.env")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, changed)
+
+	// New recipients mean new ciphertext, even for the same plaintext.
+	_, otherPub := makeSSHKey(t, t.TempDir())
+	rekeyed, err := runFilter(t, cfg, plain, "clean", "-r", otherPub, "secret.env")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, rekeyed)
+
+	// Ciphertext passes through clean untouched.
+	out, err := runFilter(t, cfg, first, "clean", "secret.env")
+	require.NoError(t, err)
+	assert.Equal(t, first, out)
+
+	entries, err := os.ReadDir(filepath.Join(dir, ".git", filterCacheDir))
+	require.NoError(t, err)
+	assert.NotEmpty(t, entries)
+}
+
+// A fresh checkout records what smudge decrypted, so the first clean after it
+// reuses the committed ciphertext.
+func TestGitFilter_SmudgeThenClean(t *testing.T) {
+	dir := initGitRepo(t)
+	priv, pub := makeSSHKey(t, t.TempDir())
+	cfg := &Config{DefaultRecipients: []string{pub}, SSHKeyPath: priv}
+	plain := []byte("password: hunter2\n")
+
+	var cipher bytes.Buffer
+	recips, err := resolveRefs(t, []string{pub}, discardLogger())
+	require.NoError(t, err)
+	require.NoError(t, agewrap.Encrypt(t.Context(), &cipher, bytes.NewReader(plain), recips))
+	stage(t, "values.yaml", cipher.Bytes())
+	require.NoError(t, os.WriteFile(filterRecipientsFile, []byte(pub+"\n"), 0o600))
+
+	out, err := runFilter(t, cfg, cipher.Bytes(), "smudge", "values.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, plain, out)
+
+	// smudge records the current recipients, so the clean reuses the
+	// ciphertext without a warning.
+	cleanLogged := func(cfg *Config, args ...string) ([]byte, string) {
+		var logs, stdout bytes.Buffer
+		clean := GitFilter(cfg, slog.New(slog.NewTextHandler(&logs, nil)))
+		clean.SetIn(bytes.NewReader(plain))
+		clean.SetOut(&stdout)
+		clean.SetArgs(append([]string{"clean"}, args...))
+		require.NoError(t, clean.Execute())
+		return stdout.Bytes(), logs.String()
+	}
+	out, logs := cleanLogged(cfg, "values.yaml")
+	assert.Equal(t, cipher.Bytes(), out)
+	assert.NotContains(t, logs, "level=WARN")
+
+	// Other recipients get new ciphertext, and are warned about.
+	_, otherPub := makeSSHKey(t, t.TempDir())
+	out, logs = cleanLogged(cfg, "-r", otherPub, "values.yaml")
+	assert.NotEqual(t, cipher.Bytes(), out)
+	assert.Contains(t, logs, "Recipients changed")
+
+	// A checkout without resolvable recipients is reused, and the first clean
+	// records them.
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, ".git", filterCacheDir)))
+	require.NoError(t, os.Rename(filterRecipientsFile, filterRecipientsFile+".off"))
+	_, err = runFilter(t, &Config{SSHKeyPath: priv}, cipher.Bytes(), "smudge", "values.yaml")
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(filterRecipientsFile+".off", filterRecipientsFile))
+	out, logs = cleanLogged(cfg, "values.yaml")
+	assert.Equal(t, cipher.Bytes(), out)
+	assert.NotContains(t, logs, "level=WARN")
+	cache := &filterCache{dir: filepath.Join(dir, ".git", filterCacheDir)}
+	stored, ok := cache.lookup(cipher.Bytes(), sha256Hex(plain))
+	assert.True(t, ok)
+	assert.Equal(t, recipientsSum(recips), stored)
+
+	// textconv decrypts blobs for diffs and prints plaintext as is.
+	blob := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, os.WriteFile(blob, cipher.Bytes(), 0o600))
+	out, err = runFilter(t, cfg, nil, "textconv", blob)
+	require.NoError(t, err)
+	assert.Equal(t, plain, out)
+}
+
+func TestGitFilter_SmudgeWithoutKey(t *testing.T) {
+	initGitRepo(t)
+	priv, pub := makeSSHKey(t, t.TempDir())
+	otherPriv, _ := makeSSHKey(t, t.TempDir())
+	var cipher bytes.Buffer
+	recips, err := resolveRefs(t, []string{pub}, discardLogger())
+	require.NoError(t, err)
+	require.NoError(t, agewrap.Encrypt(t.Context(), &cipher, bytes.NewReader([]byte("secret")), recips))
+
+	out, err := runFilter(t, &Config{SSHKeyPath: otherPriv}, cipher.Bytes(), "smudge", "s.txt")
+	require.NoError(t, err)
+	assert.Equal(t, cipher.Bytes(), out, "ciphertext is checked out as is")
+
+	// A key that matches but a modified payload fails the checkout.
+	tampered := bytes.Clone(cipher.Bytes())
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = runFilter(t, &Config{SSHKeyPath: priv}, tampered, "smudge", "s.txt")
+	require.Error(t, err)
+	assert.Equal(t, ExitTampered, ExitCode(err))
+
+	out, err = runFilter(t, &Config{}, []byte("plain"), "smudge", "s.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(out))
+}
+
+// The committed recipients file, not the committer's own config, decides who
+// clean encrypts to.
+func TestGitFilter_RecipientsFile(t *testing.T) {
+	initGitRepo(t)
+	priv, pub := makeSSHKey(t, t.TempDir())
+	personalPriv, personalPub := makeSSHKey(t, t.TempDir())
+	require.NoError(t, os.WriteFile(filterRecipientsFile, []byte("# team\n"+pub+"\n"), 0o600))
+
+	cfg := &Config{DefaultRecipients: []string{personalPub}}
+	cipher, err := runFilter(t, cfg, []byte("shared"), "clean", "s.txt")
+	require.NoError(t, err)
+
+	out, err := runFilter(t, &Config{SSHKeyPath: personalPriv}, cipher, "smudge", "s.txt")
+	require.NoError(t, err)
+	assert.Equal(t, cipher, out, "personal default_recipients are not used")
+	out, err = runFilter(t, &Config{SSHKeyPath: priv}, cipher, "smudge", "s.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "shared", string(out))
+
+	require.NoError(t, os.WriteFile(filterRecipientsFile, []byte("# nobody yet\n"), 0o600))
+	_, err = runFilter(t, cfg, []byte("shared"), "clean", "s.txt")
+	assert.Equal(t, ExitNoRecipients, ExitCode(err))
+}
+
+func TestGitFilter_CleanNeedsRecipients(t *testing.T) {
+	initGitRepo(t)
+	_, err := runFilter(t, &Config{}, []byte("x"), "clean", "x")
+	assert.Equal(t, ExitNoRecipients, ExitCode(err))
+}
+
+func TestGitInitFilter(t *testing.T) {
+	initGitRepo(t)
+	cmd := GitCmd()
+	var stdout bytes.Buffer
+	cmd.SetOut(&stdout)
+	cmd.SetArgs([]string{"init-filter", "--name", "secrets", "-r", "@team"})
+	require.NoError(t, cmd.Execute())
+
+	clean, err := gitOutput(t.Context(), "config", "filter.secrets.clean")
+	require.NoError(t, err)
+	assert.Contains(t, string(clean), " git-filter clean -- %f")
+	recipients, err := os.ReadFile(filterRecipientsFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(recipients), "\n@team\n")
+	assert.Contains(t, stdout.String(), "Added 1 recipient to ")
+	required, err := gitOutput(t.Context(), "config", "--bool", "filter.secrets.required")
+	require.NoError(t, err)
+	assert.Equal(t, "true\n", string(required))
+	textconv, err := gitOutput(t.Context(), "config", "diff.secrets.textconv")
+	require.NoError(t, err)
+	assert.Contains(t, string(textconv), " git-filter textconv")
+	assert.Contains(t, stdout.String(), "secrets/** filter=secrets diff=secrets")
+
+	// References already listed are not added again.
+	cmd = GitCmd()
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetArgs([]string{"init-filter", "--name", "secrets", "-r", "@team", "-r", "github:alice"})
+	require.NoError(t, cmd.Execute())
+	again, err := os.ReadFile(filterRecipientsFile)
+	require.NoError(t, err)
+	assert.Equal(t, string(recipients)+"github:alice\n", string(again))
+
+	cmd = GitCmd()
+	cmd.SetArgs([]string{"init-filter", "--name", "a b"})
+	assert.ErrorContains(t, cmd.Execute(), "invalid filter name")
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "/usr/local/bin/a", shellQuote("/usr/local/bin/a"))
+	assert.Equal(t, "'/Applications/My Tools/a'", shellQuote("/Applications/My Tools/a"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+	assert.Equal(t, "''", shellQuote(""))
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// pluginUI answers the interactive requests age plugins make during encryption
+// and decryption (PIN entry, touch and confirmation prompts). It reads from the
+// terminal directly, so it works even when stdin/stdout are redirected. It is a
+// package variable so tests can script the answers.
+var pluginUI = plugin.NewTerminalUI(
+	func(format string, v ...any) { _, _ = fmt.Fprintf(os.Stderr, "a: "+format+"\n", v...) },
+	func(format string, v ...any) { _, _ = fmt.Fprintf(os.Stderr, "a: warning: "+format+"\n", v...) },
+)
+
+// parseIdentityFile loads the identities in the key file at keyPath: an SSH
+// private key, or an age identity file (see agewrap.ParseIdentities). Plugin
+// identities prompt through pluginUI.
+func parseIdentityFile(keyPath string) ([]age.Identity, error) {
+	// #nosec G304 -- keyPath comes from the --ssh-key/--identity flags, config, or a ~/.ssh scan
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading key %s: %w", keyPath, err)
+	}
+	identities, err := agewrap.ParseIdentities(data, agewrap.WithPluginUI(pluginUI))
+	if err != nil {
+		return nil, fmt.Errorf("parsing key %s: %w", keyPath, err)
+	}
+	return identities, nil
+}
+
+// identityRecipients derives the recipient strings for the identities in the
+// key file at keyPath: "ssh-..." lines for an SSH private key (read from the
+// adjacent .pub when the key is passphrase-protected) and "age1..." strings for
+// native identities. Plugin identities are an error: only the plugin knows
+// their recipient.
+func identityRecipients(keyPath string) ([]string, error) {
+	// #nosec G304 -- keyPath comes from a flag, the config, or a ~/.ssh scan
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading key %s: %w", keyPath, err)
+	}
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		pub, err := sshPublicKey(keyPath, data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))}, nil
+	}
+
+	var recipients []string
+	for n, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "AGE-PLUGIN-"):
+			name, _, _ := plugin.ParseIdentity(line)
+			return nil, fmt.Errorf("%s: line %d: the recipient of a plugin identity is only known to age-plugin-%s",
+				keyPath, n+1, name)
+		case strings.HasPrefix(line, "AGE-SECRET-KEY-PQ-1"):
+			id, err := age.ParseHybridIdentity(line)
+			if err != nil {
+				return nil, fmt.Errorf("parsing key %s: line %d: %w", keyPath, n+1, err)
+			}
+			recipients = append(recipients, id.Recipient().String())
+		case strings.HasPrefix(line, "AGE-SECRET-KEY-1"):
+			id, err := age.ParseX25519Identity(line)
+			if err != nil {
+				return nil, fmt.Errorf("parsing key %s: line %d: %w", keyPath, n+1, err)
+			}
+			recipients = append(recipients, id.Recipient().String())
+		default:
+			return nil, fmt.Errorf("parsing key %s: line %d: unknown identity type", keyPath, n+1)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("parsing key %s: no identities found", keyPath)
+	}
+	return recipients, nil
+}
+
+// sshPublicKey returns the public half of the SSH private key pem read from
+// keyPath. A passphrase-protected key cannot be opened without prompting, so
+// its public key is read from keyPath.pub instead.
+func sshPublicKey(keyPath string, pem []byte) (ssh.PublicKey, error) {
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err == nil {
+		return signer.PublicKey(), nil
+	}
+	if _, ok := errors.AsType[*ssh.PassphraseMissingError](err); !ok {
+		return nil, fmt.Errorf("parsing key %s: %w", keyPath, err)
+	}
+	// #nosec G304 -- the .pub sibling of a key path from a flag, the config, or a ~/.ssh scan
+	pubData, readErr := os.ReadFile(keyPath + ".pub")
+	if readErr != nil {
+		return nil, fmt.Errorf("key %s is passphrase-protected and has no readable .pub: %w", keyPath, readErr)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s.pub: %w", keyPath, err)
+	}
+	return pub, nil
+}
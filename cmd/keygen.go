@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+)
+
+// generatedIdentity is a freshly generated native age identity.
+type generatedIdentity interface {
+	age.Identity
+	fmt.Stringer
+}
+
+// generateIdentity creates a native age identity: a post-quantum hybrid
+// (ML-KEM-768 + X25519) one when pq is set, an X25519 one otherwise. It returns
+// the identity and its recipient string.
+func generateIdentity(pq bool) (generatedIdentity, string, error) {
+	if pq {
+		id, err := age.GenerateHybridIdentity()
+		if err != nil {
+			return nil, "", err
+		}
+		return id, id.Recipient().String(), nil
+	}
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, "", err
+	}
+	return id, id.Recipient().String(), nil
+}
+
+// formatIdentityFile renders an identity file in the age-keygen layout: comment
+// lines with the creation time and public key, then the secret key.
+func formatIdentityFile(identity fmt.Stringer, recipient string, now time.Time) string {
+	return fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", now.Format(time.RFC3339), recipient, identity)
+}
+
+// Keygen returns a cobra.Command that generates a native age identity, or with
+// -y prints the recipients of an existing identity file. The saveConfig
+// callback persists --register.
+func Keygen(cfg *Config, saveConfig func(*Config) error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keygen [-o file] | keygen -y <identity>",
+		Short: "Generate an age identity, or print the recipient of one (-y)",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if derive, _ := cmd.Flags().GetBool("public"); derive {
+				if len(args) != 1 {
+					return fmt.Errorf("-y requires an identity file")
+				}
+				recipients, err := identityRecipients(args[0])
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintln(cmd.OutOrStdout(), strings.Join(recipients, "\n"))
+				return err
+			}
+			if len(args) > 0 {
+				return fmt.Errorf("unexpected argument %q (did you mean -y?)", args[0])
+			}
+			return generateKeyFile(cmd, cfg, saveConfig)
+		},
+	}
+	cmd.Flags().Bool("pq", false, "Generate a post-quantum hybrid (ML-KEM-768 + X25519) identity")
+	cmd.Flags().StringP("output", "o", "", "Write the identity to this file (0600) instead of stdout")
+	cmd.Flags().BoolP("public", "y", false, "Print the recipients of an existing identity file")
+	cmd.Flags().Bool("register", false, "Add the written identity file (-o) to identity_files in the config")
+	return cmd
+}
+
+// generateKeyFile generates an identity and writes it to -o or stdout, reporting the
+// public key on stderr as age-keygen does.
+func generateKeyFile(cmd *cobra.Command, cfg *Config, saveConfig func(*Config) error) error {
+	pq, _ := cmd.Flags().GetBool("pq")
+	output, _ := cmd.Flags().GetString("output")
+	register, _ := cmd.Flags().GetBool("register")
+	if register && output == "" {
+		return fmt.Errorf("--register requires -o: an identity printed to stdout has no path to register")
+	}
+
+	identity, recipient, err := generateIdentity(pq)
+	if err != nil {
+		return fmt.Errorf("generating identity: %w", err)
+	}
+	contents := formatIdentityFile(identity, recipient, time.Now())
+	if output == "" {
+		if _, err := fmt.Fprintf(cmd.ErrOrStderr(), "Public key: %s\n", recipient); err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(cmd.OutOrStdout(), contents)
+		return err
+	}
+
+	if err := writeIdentityFile(output, contents); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(cmd.ErrOrStderr(), "Public key: %s\n", recipient); err != nil {
+		return err
+	}
+	if !register {
+		return nil
+	}
+	abs, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(cfg.IdentityFiles, abs) {
+		cfg.IdentityFiles = append(cfg.IdentityFiles, abs)
+	}
+	if err := saveConfig(cfg); err != nil {
+		return fmt.Errorf("registering identity: %w", err)
+	}
+	_, err = fmt.Fprintf(cmd.ErrOrStderr(), "Added %s to identity_files\n", abs)
+	return err
+}
+
+// writeIdentityFile creates path with mode 0600 and writes contents to it. An
+// existing file is never overwritten: losing an identity loses every file
+// encrypted to it.
+func writeIdentityFile(path, contents string) (err error) {
+	// #nosec G304 -- the output path is user-provided by design
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%s already exists; refusing to overwrite an identity", path)
+		}
+		return fmt.Errorf("creating identity file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+	if _, err = f.WriteString(contents); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("writing identity file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("closing identity file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runKeygen runs keygen with args and returns its stdout and stderr.
+func runKeygen(t *testing.T, args ...string) (stdout, stderr string) {
+	t.Helper()
+	c := Keygen(&Config{}, func(*Config) error { return nil })
+	var out, errOut bytes.Buffer
+	c.SetOut(&out)
+	c.SetErr(&errOut)
+	c.SetArgs(args)
+	require.NoError(t, c.Execute())
+	return out.String(), errOut.String()
+}
+
+func TestFormatIdentityFile(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	identity, recipient, err := generateIdentity(false)
+	require.NoError(t, err)
+	got := formatIdentityFile(identity, recipient, now)
+	assert.Equal(t, "# created: 2026-01-02T03:04:05Z\n# public key: "+recipient+"\n"+identity.String()+"\n", got)
+}
+
+// A --pq identity round-trips through encrypt and decrypt.
+func TestKeygen_PostQuantumRoundTrip(t *testing.T) {
+	stdout, stderr := runKeygen(t, "--pq")
+	assert.Contains(t, stdout, "AGE-SECRET-KEY-PQ-1")
+	recipient := strings.TrimSpace(strings.TrimPrefix(stderr, "Public key: "))
+	require.True(t, strings.HasPrefix(recipient, "age1pq1"), recipient)
+
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "pq.txt")
+	require.NoError(t, os.WriteFile(identityFile, []byte(stdout), 0o600))
+
+	recips, err := resolveRefs(t, []string{recipient}, discardLogger())
+	require.NoError(t, err)
+	in := filepath.Join(dir, "archive.tar")
+	require.NoError(t, os.WriteFile(in, []byte("keep for decades"), 0o600))
+	enc := in + ".age"
+	require.NoError(t, encryptFile(context.Background(), in, enc, recips, outputOptions{}))
+
+	dec := filepath.Join(dir, "out.tar")
+	_, err = decryptFile(context.Background(), identityFile, dec, enc, outputOptions{})
+	require.NoError(t, err)
+	got, err := os.ReadFile(dec) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "keep for decades", string(got))
+}
+
+func TestKeygen_Classic(t *testing.T) {
+	stdout, stderr := runKeygen(t)
+	assert.Contains(t, stdout, "AGE-SECRET-KEY-1")
+	assert.Contains(t, stderr, "Public key: age1")
+	assert.NotContains(t, stderr, "age1pq1")
+}
+
+func TestCheckPostQuantumMix(t *testing.T) {
+	_, pq, err := generateIdentity(true)
+	require.NoError(t, err)
+	_, classic, err := generateIdentity(false)
+	require.NoError(t, err)
+
+	onlyPQ, err := resolveRefs(t, []string{pq}, discardLogger())
+	require.NoError(t, err)
+	assert.NoError(t, checkPostQuantumMix(onlyPQ, discardLogger()))
+
+	mixed, err := resolveRefs(t, []string{pq, classic}, discardLogger())
+	require.NoError(t, err)
+	err = checkPostQuantumMix(mixed, discardLogger())
+	assert.ErrorContains(t, err, "1 post-quantum recipient(s) are mixed with 1 classical")
+
+	// The same check surfaces through encrypt, before anything is written.
+	in := filepath.Join(t.TempDir(), "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+	c := Encrypt(&Config{DefaultRecipients: []string{classic}}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("recipient", pq))
+	assert.ErrorContains(t, c.RunE(c, nil), "quantum")
+	assert.NoFileExists(t, in+".age")
+}
+
+func TestKeygen_OutputFile(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "key.txt")
+	stdout, stderr := runKeygen(t, "-o", out)
+	assert.Empty(t, stdout, "the identity goes to the file, not stdout")
+
+	info, err := os.Stat(out)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	data, err := os.ReadFile(out) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	recipient := strings.TrimSpace(strings.TrimPrefix(stderr, "Public key: "))
+	assert.Regexp(t, `^# created: \S+\n# public key: `+recipient+`\nAGE-SECRET-KEY-1\S+\n$`, string(data))
+
+	c := Keygen(&Config{}, func(*Config) error { return nil })
+	c.SetArgs([]string{"-o", out})
+	c.SetOut(&bytes.Buffer{})
+	c.SetErr(&bytes.Buffer{})
+	assert.ErrorContains(t, c.Execute(), "refusing to overwrite")
+	again, err := os.ReadFile(out) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, data, again, "the existing identity is untouched")
+
+	// -y derives the same recipient back from the file.
+	stdout, _ = runKeygen(t, "-y", out)
+	assert.Equal(t, recipient+"\n", stdout)
+}
+
+func TestKeygen_DeriveRecipient(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	stdout, _ := runKeygen(t, "-y", priv)
+	assert.Equal(t, pubKeyLine(t, pub)+"\n", stdout)
+
+	pq := filepath.Join(dir, "pq.txt")
+	_, stderr := runKeygen(t, "--pq", "-o", pq)
+	stdout, _ = runKeygen(t, "--public", pq)
+	assert.Equal(t, strings.TrimPrefix(stderr, "Public key: "), stdout)
+
+	_, pluginIdentity := withFakePlugin(t, "1234")
+	_, err := identityRecipients(pluginIdentity)
+	assert.ErrorContains(t, err, "only known to age-plugin-fake")
+}
+
+func TestKeygen_Register(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "key.txt")
+	cfg := &Config{IdentityFiles: []string{"/existing/key.txt"}}
+	saved := 0
+	c := Keygen(cfg, func(*Config) error { saved++; return nil })
+	c.SetArgs([]string{"-o", out, "--register"})
+	c.SetOut(&bytes.Buffer{})
+	c.SetErr(&bytes.Buffer{})
+	require.NoError(t, c.Execute())
+	assert.Equal(t, []string{"/existing/key.txt", out}, cfg.IdentityFiles)
+	assert.Equal(t, 1, saved)
+
+	c = Keygen(cfg, func(*Config) error { return nil })
+	c.SetArgs([]string{"--register"})
+	c.SetOut(&bytes.Buffer{})
+	c.SetErr(&bytes.Buffer{})
+	assert.ErrorContains(t, c.Execute(), "--register requires -o")
+}
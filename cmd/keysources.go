@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// aliasRecipientPrefix marks a recipient naming a group from recipient_aliases
+// ("@team").
+const aliasRecipientPrefix = "@"
+
+// resolverOptions configures agewrap for cfg: GitHub keys are cached under
+// cfg.CacheDir for cfg.CacheTTLMinutes (a non-positive TTL or an empty cache
+// dir disables caching) and plugins prompt through pluginUI. extra comes last,
+// so a command's own options (see Encrypt) override these; that is how GitHub
+// keys are fetched with another HTTP client or from another URL.
+func resolverOptions(cfg *Config, log *slog.Logger, extra ...agewrap.Option) []agewrap.Option {
+	return append([]agewrap.Option{
+		agewrap.WithLogger(log),
+		agewrap.WithCache(cfg.CacheDir, time.Duration(cfg.CacheTTLMinutes)*time.Minute),
+		agewrap.WithPluginUI(pluginUI),
+	}, extra...)
+}
+
+// keySources returns the registry every recipient reference is resolved
+// through: agewrap's GitHub, file and literal sources, "host:<name>" looked up
+// in the known_hosts file at knownHostsPath, and "@<alias>" from
+// recipient_aliases. A new kind of recipient is a new source registered here.
+// extra is passed on to resolverOptions.
+func keySources(
+	cfg *Config,
+	knownHostsPath string,
+	log *slog.Logger,
+	extra ...agewrap.Option,
+) *agewrap.RecipientResolver {
+	r := agewrap.NewRecipientResolver(resolverOptions(cfg, log, extra...)...)
+	r.Register(hostRecipientPrefix, &knownHostsSource{path: knownHostsPath, log: log})
+	r.Register(aliasRecipientPrefix, agewrap.NewAliasSource(cfg.RecipientAliases, r.Registry))
+	return r
+}
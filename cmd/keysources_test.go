@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySources_Aliases(t *testing.T) {
+	_, alicePub := makeSSHKey(t, t.TempDir())
+	_, bobPub := makeSSHKey(t, t.TempDir())
+	cfg := &Config{}
+	require.NoError(t, setConfigKey(cfg, "recipient_aliases.ops", bobPub))
+	require.NoError(t, setConfigKey(cfg, "recipient_aliases.team", alicePub+", @ops"))
+	assert.Equal(t, map[string][]string{"ops": {bobPub}, "team": {alicePub, "@ops"}}, cfg.RecipientAliases)
+
+	sources := keySources(cfg, defaultKnownHostsPath(), discardLogger())
+	got, err := sources.Resolve(context.Background(), []string{"@team"})
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+
+	_, err = sources.Resolve(context.Background(), []string{"@nobody"})
+	assert.ErrorContains(t, err, `unknown recipient alias "nobody"`)
+
+	require.NoError(t, setConfigKey(cfg, "recipient_aliases.ops", ""))
+	require.NoError(t, setConfigKey(cfg, "recipient_aliases.team", ""))
+	assert.Nil(t, cfg.RecipientAliases, "removing the last alias drops the key")
+}
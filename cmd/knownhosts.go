@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505 -- SHA-1 is fixed by the OpenSSH hashed known_hosts format
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// hostRecipientPrefix marks a recipient that names an SSH host whose host key,
+// looked up in a known_hosts file, is the recipient ("host:db1.example.com").
+const hostRecipientPrefix = "host:"
+
+// maxKnownHostsBytes caps how much of a known_hosts file we read into memory.
+const maxKnownHostsBytes = 16 << 20 // 16 MiB
+
+// defaultKnownHostsPath is the user's OpenSSH known_hosts file.
+func defaultKnownHostsPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+}
+
+// knownHostsLine is one parsed known_hosts entry.
+type knownHostsLine struct {
+	marker   string   // "", "@revoked" or "@cert-authority"
+	patterns []string // comma-separated host patterns, possibly hashed
+	keyType  string
+	key      string // base64 key blob
+}
+
+// knownHostsSource resolves "host:<name>" recipients to the agessh-usable host
+// keys recorded for that name in the known_hosts file at path. A host with no
+// usable key is an error; revoked and CA entries are skipped with a warning.
+type knownHostsSource struct {
+	path string
+	log  *slog.Logger
+}
+
+// Resolve implements agewrap.KeySource.
+func (s *knownHostsSource) Resolve(_ context.Context, host string) ([]age.Recipient, error) {
+	lines, err := readKnownHosts(s.path)
+	if err != nil {
+		return nil, err
+	}
+	keys := hostKeys(lines, knownHostsName(host), s.log)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable ed25519/RSA host key for %q in %s", host, s.path)
+	}
+	s.log.Debug("Resolved host recipient", "host", host, "keys", len(keys))
+	recipients := make([]age.Recipient, 0, len(keys))
+	for _, k := range keys {
+		r, err := agewrap.ParseSSHRecipient(k)
+		if err != nil {
+			return nil, fmt.Errorf("host key for %q: %w", host, err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// knownHostsName converts "host" or "host:port" to the name known_hosts records:
+// the bare host for port 22, "[host]:port" otherwise.
+func knownHostsName(host string) string {
+	if strings.HasPrefix(host, "[") {
+		return host
+	}
+	name, port, ok := strings.Cut(host, ":")
+	if !ok || port == "22" {
+		return name
+	}
+	return "[" + name + "]:" + port
+}
+
+// readKnownHosts parses a known_hosts file (or ssh-keyscan output, which uses the
+// same format). Malformed lines are ignored, as OpenSSH does.
+func readKnownHosts(path string) ([]knownHostsLine, error) {
+	// #nosec G304 -- the known_hosts path is user-provided by design
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening known_hosts: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var lines []knownHostsLine
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), maxKnownHostsBytes)
+	for sc.Scan() {
+		if l, ok := parseKnownHostsLine(sc.Text()); ok {
+			lines = append(lines, l)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading known_hosts: %w", err)
+	}
+	return lines, nil
+}
+
+// parseKnownHostsLine parses "[@marker] patterns keytype base64key [comment]".
+func parseKnownHostsLine(line string) (knownHostsLine, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return knownHostsLine{}, false
+	}
+	var l knownHostsLine
+	if strings.HasPrefix(fields[0], "@") {
+		l.marker, fields = fields[0], fields[1:]
+	}
+	if len(fields) < 3 {
+		return knownHostsLine{}, false
+	}
+	l.patterns = strings.Split(fields[0], ",")
+	l.keyType, l.key = fields[1], fields[2]
+	return l, true
+}
+
+// hostKeys returns "type base64" key lines for host that agessh can encrypt to.
+// A key marked @revoked for the host is excluded even if listed again unmarked.
+func hostKeys(lines []knownHostsLine, host string, log *slog.Logger) []string {
+	var revoked []string
+	for _, l := range lines {
+		if l.marker == "@revoked" && matchesHost(l.patterns, host) {
+			log.Warn("Skipping revoked host key", "host", host, "type", l.keyType)
+			revoked = append(revoked, l.key)
+		}
+	}
+	var keys []string
+	for _, l := range lines {
+		if !matchesHost(l.patterns, host) || slices.Contains(revoked, l.key) {
+			continue
+		}
+		switch {
+		case l.marker == "@cert-authority":
+			log.Warn("Skipping @cert-authority key; it signs host certificates and is not a host key",
+				"host", host, "type", l.keyType)
+		case l.marker != "":
+			log.Warn("Skipping host key with unknown marker", "host", host, "marker", l.marker)
+		case l.keyType != "ssh-ed25519" && l.keyType != "ssh-rsa":
+			log.Debug("Skipping host key type not supported by age", "host", host, "type", l.keyType)
+		default:
+			if k := l.keyType + " " + l.key; !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// matchesHost reports whether host matches a known_hosts pattern list: at least
+// one positive pattern matches and no negated ("!") pattern does. Hashed
+// patterns ("|1|salt|hash") are compared by HMAC-SHA1.
+func matchesHost(patterns []string, host string) bool {
+	matched := false
+	for _, p := range patterns {
+		if neg, ok := strings.CutPrefix(p, "!"); ok {
+			if wildcardMatch(neg, host) {
+				return false
+			}
+			continue
+		}
+		if strings.HasPrefix(p, "|1|") {
+			matched = matched || hashedHostMatch(p, host)
+			continue
+		}
+		matched = matched || wildcardMatch(p, host)
+	}
+	return matched
+}
+
+// hashedHostMatch checks an OpenSSH hashed hostname "|1|base64(salt)|base64(hmac)".
+func hashedHostMatch(pattern, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	_, _ = mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// wildcardMatch matches s against an OpenSSH host pattern, where "*" matches any
+// run of characters and "?" exactly one. Hostnames compare case-insensitively.
+func wildcardMatch(pattern, s string) bool {
+	p, str := []byte(strings.ToLower(pattern)), []byte(strings.ToLower(s))
+	star, mark := -1, 0
+	i, j := 0, 0
+	for j < len(str) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == str[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, mark = i, j
+			i++
+		case star >= 0:
+			i = star + 1
+			mark++
+			j = mark
+		default:
+			return false
+		}
+	}
+	return len(bytes.TrimLeft(p[i:], "*")) == 0
+}
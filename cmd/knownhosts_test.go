@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505 -- matches the OpenSSH hashed known_hosts format under test
+	"encoding/base64"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hashHost returns an OpenSSH "|1|salt|hash" hashed hostname.
+func hashHost(host string) string {
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	_, _ = mac.Write([]byte(host))
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// pubKeyLine returns the "type base64" part of an OpenSSH .pub file.
+func pubKeyLine(t *testing.T, pub string) string {
+	t.Helper()
+	data, err := os.ReadFile(pub) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	f := strings.Fields(string(data))
+	require.GreaterOrEqual(t, len(f), 2)
+	return f[0] + " " + f[1]
+}
+
+func TestKnownHostsSource_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	_, revokedPub := makeSSHKey(t, t.TempDir())
+	key, revoked := pubKeyLine(t, pub), pubKeyLine(t, revokedPub)
+
+	kh := filepath.Join(dir, "known_hosts")
+	require.NoError(t, os.WriteFile(kh, []byte(strings.Join([]string{
+		"# comment",
+		hashHost("db1.example.com") + " " + key,
+		"db1.example.com " + revoked,
+		"@revoked * " + revoked,
+		"@cert-authority *.example.com " + key,
+		"db1.example.com ecdsa-sha2-nistp256 AAAAE2VjZHNh",
+		"malformed",
+	}, "\n")), 0o600))
+
+	var logs bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&logs, nil))
+	recips, err := (&knownHostsSource{path: kh, log: log}).Resolve(context.Background(), "db1.example.com")
+	require.NoError(t, err)
+	require.Len(t, recips, 1, "only the hashed, unrevoked ed25519 key remains")
+	assert.Equal(t, []string{key}, hostKeys(mustReadKnownHosts(t, kh), "db1.example.com", discardLogger()))
+	assert.Contains(t, logs.String(), "revoked")
+	assert.Contains(t, logs.String(), "cert-authority")
+
+	plain := filepath.Join(dir, "secret.txt")
+	require.NoError(t, os.WriteFile(plain, []byte("for the host"), 0o600))
+	enc := filepath.Join(dir, "secret.age")
+	require.NoError(t, encryptFile(context.Background(), plain, enc, recips, outputOptions{}))
+	dec := filepath.Join(dir, "secret.dec")
+	_, err = decryptFile(context.Background(), priv, dec, enc, outputOptions{})
+	require.NoError(t, err, "the host's private key decrypts")
+}
+
+// mustReadKnownHosts parses the known_hosts file at path.
+func mustReadKnownHosts(t *testing.T, path string) []knownHostsLine {
+	t.Helper()
+	lines, err := readKnownHosts(path)
+	require.NoError(t, err)
+	return lines
+}
+
+func TestKnownHostsSource_Errors(t *testing.T) {
+	log := discardLogger()
+	// Without a host: reference the file is never read.
+	sources := keySources(&Config{}, "/no/such/known_hosts", log)
+	native := "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+	_, err := sources.Resolve(context.Background(), []string{native})
+	require.NoError(t, err)
+
+	_, err = sources.Resolve(context.Background(), []string{"host:x"})
+	assert.ErrorContains(t, err, "opening known_hosts")
+
+	kh := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(kh, []byte("other.example.com ssh-ed25519 AAAA\n"), 0o600))
+	_, err = (&knownHostsSource{path: kh, log: log}).Resolve(context.Background(), "db1.example.com")
+	assert.ErrorContains(t, err, "no usable ed25519/RSA host key")
+}
+
+func TestKnownHostsName(t *testing.T) {
+	assert.Equal(t, "db1", knownHostsName("db1"))
+	assert.Equal(t, "db1", knownHostsName("db1:22"))
+	assert.Equal(t, "[db1]:2222", knownHostsName("db1:2222"))
+	assert.Equal(t, "[db1]:2222", knownHostsName("[db1]:2222"))
+}
+
+func TestMatchesHost(t *testing.T) {
+	assert.True(t, matchesHost([]string{"*.example.com"}, "db1.example.com"))
+	assert.True(t, matchesHost([]string{"DB?.example.com"}, "db1.example.com"))
+	assert.False(t, matchesHost([]string{"*.example.com", "!db1.example.com"}, "db1.example.com"))
+	assert.False(t, matchesHost([]string{"db1"}, "db10"))
+	assert.True(t, matchesHost([]string{hashHost("[db1]:2222")}, "[db1]:2222"))
+	assert.False(t, matchesHost([]string{"|1|bad|entry"}, "db1"))
+	assert.False(t, matchesHost([]string{"|1|!!|!!"}, "db1"))
+}
+
+func TestEncryptCmd_HostRecipient(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	kh := filepath.Join(dir, "scan.txt")
+	require.NoError(t, os.WriteFile(kh, []byte("web1 "+pubKeyLine(t, pub)+"\n"), 0o600))
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("data"), 0o600))
+
+	c := Encrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("output", filepath.Join(dir, "in.age")))
+	require.NoError(t, c.Flags().Set("recipient", "host:web1"))
+	require.NoError(t, c.Flags().Set("known-hosts", kh))
+	require.NoError(t, c.RunE(c, nil))
+	assert.FileExists(t, filepath.Join(dir, "in.age"))
+}
@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Log file rotation defaults, used when the config leaves the keys unset (0).
+const (
+	defaultLogMaxSizeMB = 10
+	defaultLogMaxFiles  = 5
+)
+
+// logSegmentTime names rotated segments: <log>.<UTC time>, with nanoseconds so
+// busy hosts do not collide, and sortable as strings.
+const logSegmentTime = "20060102T150405.000000000Z"
+
+// Values of log_level.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// LogLevel returns the log file's level from log_level; info when unset.
+func LogLevel(cfg *Config) slog.Level {
+	if level, ok := logLevels[cfg.LogLevel]; ok {
+		return level
+	}
+	return slog.LevelInfo
+}
+
+// logAgeRotation is how old the first entry of the log may get before it is
+// rotated when log_max_age_days is set, so that pruning by age deletes entries
+// about log_max_age_days after they were written rather than up to twice that.
+const logAgeRotation = 24 * time.Hour
+
+// logStartTime matches the time of a log entry written by the JSON or text
+// handler, which both put it first.
+var logStartTime = regexp.MustCompile(`^(?:\{"time":"|time=)([^"\s]+)`)
+
+// RotateLog rotates cfg.LogFilePath once it reaches log_max_size_mb, or, with
+// log_max_age_days set, once its first entry is a day old: the file is renamed
+// to a timestamped segment, older uncompressed segments are gzipped, and
+// segments beyond log_max_files or older than log_max_age_days are deleted.
+// Call it before opening the log file.
+//
+// Several processes may log at once, so the work is done under an exclusive
+// lock on <log>.lock, and the check is repeated once the lock is held: only one
+// of them rotates. Writers reopen the file for every entry (see LogWriter), but
+// one in flight during the rename still lands in the new segment, which is why
+// the newest segment stays uncompressed until the next rotation.
+func RotateLog(cfg *Config, now time.Time) error {
+	path := cfg.LogFilePath
+	maxBytes := int64(orDefault(cfg.LogMaxSizeMB, defaultLogMaxSizeMB)) << 20
+	byAge := cfg.LogMaxAgeDays > 0
+	if !byAge && !logNeedsRotation(path, maxBytes, false, now) {
+		return nil
+	}
+
+	// #nosec G304 -- the lock file sits next to the configured log file
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening log lock: %w", err)
+	}
+	defer func() { _ = lock.Close() }()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("locking log: %w", err)
+	}
+
+	if logNeedsRotation(path, maxBytes, byAge, now) {
+		segment := path + "." + now.UTC().Format(logSegmentTime)
+		if err := os.Rename(path, segment); err != nil {
+			return fmt.Errorf("rotating log: %w", err)
+		}
+	}
+	segments, err := logSegments(path)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, seg := range segments {
+		// Newest first: i == 0 may still be written to (see above).
+		if i > 0 && !strings.HasSuffix(seg, ".gz") {
+			if err := gzipFile(seg); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if segments, err = logSegments(path); err != nil {
+		return err
+	}
+	errs = append(errs, pruneLogSegments(segments, orDefault(cfg.LogMaxFiles, defaultLogMaxFiles),
+		time.Duration(cfg.LogMaxAgeDays)*24*time.Hour, now))
+	return errors.Join(errs...)
+}
+
+// orDefault returns v, or def when v is not positive.
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// logNeedsRotation reports whether the log at path has reached maxBytes or,
+// with byAge, starts with an entry logAgeRotation older than now.
+func logNeedsRotation(path string, maxBytes int64, byAge bool, now time.Time) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+	if info.Size() >= maxBytes {
+		return true
+	}
+	if !byAge {
+		return false
+	}
+	started, ok := logStarted(path)
+	return ok && now.Sub(started) >= logAgeRotation
+}
+
+// logStarted returns the time of the first entry in the log at path.
+func logStarted(path string) (time.Time, bool) {
+	// #nosec G304 -- path is the configured log file
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer func() { _ = f.Close() }()
+	head := make([]byte, 128)
+	n, _ := io.ReadFull(f, head)
+	m := logStartTime.FindSubmatch(head[:n])
+	if m == nil {
+		return time.Time{}, false
+	}
+	started, err := time.Parse(time.RFC3339Nano, string(m[1]))
+	return started, err == nil
+}
+
+// LogWriter appends to the log file, opening it for every write — one per
+// entry with the slog handlers — so that a long-running process follows
+// rotation instead of appending to a segment that a later rotation compresses
+// and deletes, losing its entries.
+type LogWriter struct {
+	path string
+}
+
+// OpenLogWriter returns a LogWriter for path, creating the file to check that
+// it can be written.
+func OpenLogWriter(path string) (*LogWriter, error) {
+	w := &LogWriter{path: path}
+	if _, err := w.Write(nil); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends p to the log file.
+func (w *LogWriter) Write(p []byte) (int, error) {
+	// #nosec G304 -- path is the configured log file
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.Write(p)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// logSegments lists the rotated segments of the log at path, newest first.
+func logSegments(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("listing logs: %w", err)
+	}
+	prefix := filepath.Base(path) + "."
+	var segments []string
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(strings.TrimSuffix(e.Name(), ".gz"), prefix)
+		if _, err := time.Parse(logSegmentTime, stamp); ok && err == nil {
+			segments = append(segments, filepath.Join(filepath.Dir(path), e.Name()))
+		}
+	}
+	slices.SortFunc(segments, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(b, ".gz"), strings.TrimSuffix(a, ".gz"))
+	})
+	return segments, nil
+}
+
+// pruneLogSegments deletes the segments (newest first) past the first
+// maxFiles, and those last modified before maxAge ago when maxAge is set.
+func pruneLogSegments(segments []string, maxFiles int, maxAge time.Duration, now time.Time) error {
+	var errs []error
+	for i, seg := range segments {
+		expired := false
+		if maxAge > 0 {
+			info, err := os.Stat(seg)
+			expired = err == nil && now.Sub(info.ModTime()) > maxAge
+		}
+		if i < maxFiles && !expired {
+			continue
+		}
+		if err := os.Remove(seg); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("removing old log: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// gzipFile compresses path to path.gz, keeping its mtime for age-based
+// pruning, and removes path. The .gz appears only once complete.
+func gzipFile(path string) (err error) {
+	// #nosec G304 -- path is a rotated segment of the configured log file
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("compressing log: %w", err)
+	}
+	defer func() { _ = in.Close() }()
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("compressing log: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".a-log-*")
+	if err != nil {
+		return fmt.Errorf("compressing log: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	zw := gzip.NewWriter(tmp)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("compressing log: %w", err)
+	}
+	if err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("compressing log: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path+".gz"); err != nil {
+		return fmt.Errorf("compressing log: %w", err)
+	}
+	return os.Remove(path)
+}
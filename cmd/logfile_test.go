@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLog replaces the log at path with n bytes of content.
+func writeLog(t *testing.T, path string, n int) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(strings.Repeat("x", n)), 0o600))
+}
+
+func TestRotateLog(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{LogFilePath: filepath.Join(dir, "cli.log"), LogMaxSizeMB: 1, LogMaxFiles: 2}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	// Below the limit nothing happens, not even the lock file.
+	writeLog(t, cfg.LogFilePath, 1<<19)
+	require.NoError(t, RotateLog(cfg, now))
+	assert.NoFileExists(t, cfg.LogFilePath+".lock")
+
+	// Each rotation renames the log; older segments are gzipped and only
+	// LogMaxFiles are kept.
+	for i := range 4 {
+		writeLog(t, cfg.LogFilePath, 1<<20+i)
+		require.NoError(t, RotateLog(cfg, now.Add(time.Duration(i)*time.Second)))
+		assert.NoFileExists(t, cfg.LogFilePath)
+	}
+	segments, err := logSegments(cfg.LogFilePath)
+	require.NoError(t, err)
+	newest := cfg.LogFilePath + ".20261018T120003.000000000Z"
+	assert.Equal(t, []string{newest, cfg.LogFilePath + ".20261018T120002.000000000Z.gz"}, segments)
+
+	f, err := os.Open(segments[1]) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Len(t, data, 1<<20+2, "the segment decompresses to the rotated log")
+}
+
+func TestRotateLog_MaxAge(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{LogFilePath: filepath.Join(dir, "cli.log"), LogMaxAgeDays: 7}
+	now := time.Now()
+	old := cfg.LogFilePath + "." + now.Add(-30*24*time.Hour).UTC().Format(logSegmentTime) + ".gz"
+	recent := cfg.LogFilePath + "." + now.Add(-time.Hour).UTC().Format(logSegmentTime) + ".gz"
+	for _, p := range []string{old, recent} {
+		writeLog(t, p, 1)
+	}
+	require.NoError(t, os.Chtimes(old, now.Add(-30*24*time.Hour), now.Add(-30*24*time.Hour)))
+
+	require.NoError(t, RotateLog(cfg, now))
+	assert.NoFileExists(t, old)
+	assert.FileExists(t, recent)
+}
+
+// With log_max_age_days set the log is rotated once its first entry is a day
+// old, whatever its size.
+func TestRotateLog_ByAge(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		maxAge  int
+		first   string
+		rotated bool
+	}{
+		{"json, a day old", 7, `{"time":"2026-10-17T11:00:00.5+03:00","level":"INFO","msg":"x"}`, true},
+		{"text, a day old", 7, `time=2026-10-17T08:59:00.000Z level=INFO msg=x`, true},
+		{"recent", 7, `{"time":"2026-10-18T11:00:00Z","level":"INFO","msg":"x"}`, false},
+		{"no max age", 0, `{"time":"2026-10-01T00:00:00Z","level":"INFO","msg":"x"}`, false},
+		{"unparsable", 7, `garbage`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{LogFilePath: filepath.Join(t.TempDir(), "cli.log"), LogMaxAgeDays: tt.maxAge}
+			require.NoError(t, os.WriteFile(cfg.LogFilePath, []byte(tt.first+"\n"), 0o600))
+			require.NoError(t, RotateLog(cfg, now))
+			segments, err := logSegments(cfg.LogFilePath)
+			require.NoError(t, err)
+			if tt.rotated {
+				assert.NoFileExists(t, cfg.LogFilePath)
+				assert.Len(t, segments, 1)
+			} else {
+				assert.FileExists(t, cfg.LogFilePath)
+				assert.Empty(t, segments)
+			}
+		})
+	}
+}
+
+// A LogWriter opened before a rotation writes to the new log file, not to the
+// rotated segment.
+func TestLogWriter_FollowsRotation(t *testing.T) {
+	cfg := &Config{LogFilePath: filepath.Join(t.TempDir(), "cli.log"), LogMaxSizeMB: 1}
+	w, err := OpenLogWriter(cfg.LogFilePath)
+	require.NoError(t, err)
+	assert.FileExists(t, cfg.LogFilePath)
+
+	_, err = w.Write([]byte(strings.Repeat("x", 1<<20)))
+	require.NoError(t, err)
+	require.NoError(t, RotateLog(cfg, time.Now()))
+	_, err = w.Write([]byte("after\n"))
+	require.NoError(t, err)
+	data, err := os.ReadFile(cfg.LogFilePath) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "after\n", string(data))
+
+	_, err = OpenLogWriter(filepath.Dir(cfg.LogFilePath))
+	assert.Error(t, err, "a directory cannot be a log file")
+}
+
+// Processes starting at the same time rotate once between them.
+func TestRotateLog_Concurrent(t *testing.T) {
+	cfg := &Config{LogFilePath: filepath.Join(t.TempDir(), "cli.log"), LogMaxSizeMB: 1}
+	writeLog(t, cfg.LogFilePath, 1<<20)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Go(func() { errs[i] = RotateLog(cfg, time.Now()) })
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	segments, err := logSegments(cfg.LogFilePath)
+	require.NoError(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestLogSettings(t *testing.T) {
+	cfg := &Config{}
+	assert.Equal(t, slog.LevelInfo, LogLevel(cfg))
+	require.NoError(t, setConfigKey(cfg, "log_level", "warn"))
+	assert.Equal(t, slog.LevelWarn, LogLevel(cfg))
+	assert.ErrorContains(t, setConfigKey(cfg, "log_level", "loud"), "log_level must be")
+
+	require.NoError(t, setConfigKey(cfg, "log_max_size_mb", "50"))
+	require.NoError(t, setConfigKey(cfg, "log_max_files", "3"))
+	require.NoError(t, setConfigKey(cfg, "log_max_age_days", "30"))
+	assert.Equal(t, []int{50, 3, 30}, []int{cfg.LogMaxSizeMB, cfg.LogMaxFiles, cfg.LogMaxAgeDays})
+	assert.ErrorContains(t, setConfigKey(cfg, "log_max_files", "-1"), "non-negative integer")
+	require.NoError(t, setConfigKey(cfg, "log_max_files", ""))
+	assert.Zero(t, cfg.LogMaxFiles)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cmd
+
+import "io/fs"
+
+// linkCount returns 1: hard-link counts are not available on this platform.
+func linkCount(fs.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// addOutputFlags registers the overwrite-protection flags shared by encrypt and
+// decrypt.
+func addOutputFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("force", "f", false, "Overwrite an existing output file")
+	cmd.Flags().Bool("backup", false, "Keep an existing output file as <output>.bak before overwriting it")
+	cmd.Flags().Bool("allow-special", false, "Allow reading from a device, FIFO or socket")
+	cmd.Flags().Bool("follow-symlinks", false, "Write through a symlinked output to its target instead of refusing")
+}
+
+// checkInput rejects inputs that are not regular files: directories always,
+// and devices, FIFOs and sockets unless --allow-special is given, since reading
+// one may block forever or never end.
+func checkInput(cmd *cobra.Command, input string, info fs.FileInfo) error {
+	if info.IsDir() {
+		return fmt.Errorf("input %s is a directory; encrypt an archive of it instead (e.g. tar)", input)
+	}
+	if info.Mode().IsRegular() {
+		return nil
+	}
+	if allow, _ := cmd.Flags().GetBool("allow-special"); allow {
+		return nil
+	}
+	return fmt.Errorf("input %s is not a regular file (%s); pass --allow-special to read it anyway",
+		input, info.Mode().Type())
+}
+
+// checkOutput validates the output path and returns the path to write. Outputs
+// are replaced by renaming a temp file over them, which would silently swap a
+// symlink for a plain file, so a symlinked output is refused unless
+// --follow-symlinks resolves it to its target. Directories and special files
+// are never replaced, and the output may not be the input itself, by any name.
+func checkOutput(cmd *cobra.Command, output string, inInfo fs.FileInfo) (string, error) {
+	info, err := os.Lstat(output)
+	if errors.Is(err, fs.ErrNotExist) {
+		return output, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if follow, _ := cmd.Flags().GetBool("follow-symlinks"); !follow {
+			return "", fmt.Errorf("output %s is a symlink; pass --follow-symlinks to write to its target", output)
+		}
+		if output, err = resolveSymlink(output); err != nil {
+			return "", err
+		}
+		if info, err = os.Lstat(output); errors.Is(err, fs.ErrNotExist) {
+			return output, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	switch {
+	case info.IsDir():
+		return "", fmt.Errorf("output %s is a directory", output)
+	case !info.Mode().IsRegular():
+		return "", fmt.Errorf("output %s is not a regular file (%s)", output, info.Mode().Type())
+	case os.SameFile(inInfo, info):
+		return "", fmt.Errorf("input and output are the same file: %s", output)
+	}
+	return output, nil
+}
+
+// guardOutput refuses to replace an existing output unless --force or
+// --backup is given, or the user agrees at an interactive prompt. Without a
+// terminal there is nobody to ask, so the answer is no. The --backup copy is
+// made later, by replaceOutput, so a command that fails before writing leaves
+// an older <output>.bak alone.
+//
+// exclusive reports that nothing may be replaced: the output does not exist
+// and neither --force nor --backup is given. It is meant for
+// outputOptions.exclusive, so a file created at the name while the command
+// runs is not replaced either.
+func guardOutput(cmd *cobra.Command, output string) (exclusive bool, err error) {
+	force, _ := cmd.Flags().GetBool("force")
+	backup, _ := cmd.Flags().GetBool("backup")
+	if _, err := os.Lstat(output); errors.Is(err, fs.ErrNotExist) {
+		return !force && !backup, nil
+	} else if err != nil {
+		return false, err
+	}
+	if force || backup {
+		return false, nil
+	}
+	if !isTerminal(cmd.InOrStdin()) {
+		return false, fmt.Errorf("%s already exists; use --force to overwrite it or --backup to keep a copy", output)
+	}
+	question := fmt.Sprintf("%s already exists. Overwrite?", output)
+	ok, err := confirm(commandContext(cmd), cmd.InOrStdin(), cmd.ErrOrStderr(), question)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("not overwriting %s", output)
+	}
+	return false, nil
+}
+
+// outputOptions says how a command writes its output file: how the finished
+// file replaces an existing one, its mode, and how the copy reports progress.
+type outputOptions struct {
+	backup    bool             // keep an existing output as <output>.bak (--backup)
+	exclusive bool             // never replace a file at the output name (see guardOutput)
+	perm      fs.FileMode      // mode of the finished file; 0 keeps the temp file's 0600
+	progress  *progressOptions // nil reports nothing
+}
+
+// outputFlags returns the outputOptions set by cmd's --backup and --progress
+// flags.
+func outputFlags(cmd *cobra.Command, log *slog.Logger) (outputOptions, error) {
+	progress, err := progressFlag(cmd, log)
+	if err != nil {
+		return outputOptions{}, err
+	}
+	backup, _ := cmd.Flags().GetBool("backup")
+	return outputOptions{backup: backup, progress: progress}, nil
+}
+
+// replaceOutput gives the finished temp file tmpName opts.perm, renames it onto
+// output and syncs the directory. With opts.backup an existing output is first
+// kept as <output>.bak: only now, once the new contents are complete, is the
+// previous backup given up. With opts.exclusive the temp file is linked to
+// output instead, which fails rather than replace a file that appeared there.
+func replaceOutput(tmpName, output string, opts outputOptions) error {
+	if opts.perm != 0 && opts.perm != 0o600 {
+		if err := os.Chmod(tmpName, opts.perm); err != nil {
+			return fmt.Errorf("setting output mode: %w", err)
+		}
+	}
+	if opts.exclusive {
+		if err := linkOutput(tmpName, output); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(output))
+	}
+	if opts.backup {
+		if _, err := os.Lstat(output); err == nil {
+			if err := backupOutput(output); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(tmpName, output); err != nil {
+		return fmt.Errorf("finalizing output: %w", err)
+	}
+	return syncDir(filepath.Dir(output))
+}
+
+// linkOutput moves tmpName to output without replacing an existing file: a
+// hard link fails when output exists, where a rename would replace it.
+// Filesystems without hard links fall back to checking first and renaming,
+// which leaves only a short window.
+func linkOutput(tmpName, output string) error {
+	err := os.Link(tmpName, output)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s was created while it was being written; not replacing it", output)
+	}
+	if err == nil {
+		if err := os.Remove(tmpName); err != nil {
+			return fmt.Errorf("finalizing output: %w", err)
+		}
+		return nil
+	}
+	if _, statErr := os.Lstat(output); statErr == nil {
+		return fmt.Errorf("%s was created while it was being written; not replacing it", output)
+	}
+	if err := os.Rename(tmpName, output); err != nil {
+		return fmt.Errorf("finalizing output: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it onto
+// path with replaceOutput, so a failure never leaves a partial file. The temp
+// file is created 0600 and given opts.perm only once it is complete.
+func writeFileAtomic(path string, data []byte, pattern string, opts outputOptions) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), pattern)
+	if err != nil {
+		return fmt.Errorf("creating temp output: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpName)
+		}
+	}()
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+	return replaceOutput(tmpName, path, opts)
+}
+
+// maxSymlinkHops bounds resolveSymlink, as the kernel bounds path lookups.
+const maxSymlinkHops = 40
+
+// resolveSymlink follows the symlink chain at path to the final name, which
+// may not exist yet: writing through a dangling link creates its target.
+func resolveSymlink(path string) (string, error) {
+	for range maxSymlinkHops {
+		info, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) || (err == nil && info.Mode()&fs.ModeSymlink == 0) {
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", fmt.Errorf("resolving output symlink %s: %w", path, err)
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return "", fmt.Errorf("resolving output symlink %s: too many levels of symbolic links", path)
+}
+
+// backupOutput keeps the current output as output.bak, replacing an older
+// backup. A hard link preserves the file without copying it: the later rename
+// onto output replaces only the output name, so the backup keeps the old
+// contents. Filesystems without hard links get a copy.
+func backupOutput(output string) error {
+	backup := output + ".bak"
+	if err := os.Remove(backup); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("replacing backup %s: %w", backup, err)
+	}
+	if err := os.Link(output, backup); err == nil {
+		return nil
+	}
+	if err := copyFile(output, backup); err != nil {
+		return fmt.Errorf("backing up %s: %w", output, err)
+	}
+	return nil
+}
+
+// copyFile copies src to a new file dst with src's permissions.
+func copyFile(src, dst string) (err error) {
+	// #nosec G304 -- src is an existing output path chosen by the user
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	// #nosec G304 -- dst is src with a .bak suffix
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// isTerminal reports whether stream, a command's stdin or stderr, is an
+// interactive terminal.
+func isTerminal(stream any) bool {
+	f, ok := stream.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd())) // #nosec G115 -- file descriptors fit in an int
+}
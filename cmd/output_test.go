@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decryptOver decrypts enc with priv onto out, with the extra boolean flags.
+func decryptOver(t *testing.T, enc, out, priv string, flags ...string) error {
+	t.Helper()
+	c := Decrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", enc))
+	require.NoError(t, c.Flags().Set("output", out))
+	require.NoError(t, c.Flags().Set("ssh-key", priv))
+	for _, f := range flags {
+		require.NoError(t, c.Flags().Set(f, "true"))
+	}
+	c.SetIn(strings.NewReader("y\n")) // not a terminal: never consulted
+	return c.RunE(c, nil)
+}
+
+func TestDecryptCmd_OverwriteProtection(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(in, []byte("from backup"), 0o600))
+	recips, err := resolveRefs(t, []string{pub}, discardLogger())
+	require.NoError(t, err)
+	enc := in + ".age"
+	require.NoError(t, encryptFile(context.Background(), in, enc, recips, outputOptions{}))
+	require.NoError(t, os.WriteFile(in, []byte("edited since"), 0o600))
+
+	err = decryptOver(t, enc, in, priv)
+	assert.ErrorContains(t, err, "already exists; use --force")
+	got, err := os.ReadFile(in) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "edited since", string(got), "the edited plaintext is untouched")
+
+	// A failed decrypt does not touch an older backup.
+	require.NoError(t, os.WriteFile(in+".bak", []byte("older backup"), 0o600))
+	wrongPriv, _ := makeSSHKey(t, t.TempDir())
+	require.Error(t, decryptOver(t, enc, in, wrongPriv, "backup"))
+	bak, err := os.ReadFile(in + ".bak") // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "older backup", string(bak))
+
+	require.NoError(t, decryptOver(t, enc, in, priv, "backup"))
+	got, err = os.ReadFile(in) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "from backup", string(got))
+	bak, err = os.ReadFile(in + ".bak") // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "edited since", string(bak), "the backup keeps the previous contents")
+
+	require.NoError(t, os.WriteFile(in, []byte("again"), 0o600))
+	require.NoError(t, decryptOver(t, enc, in, priv, "force"))
+	got, err = os.ReadFile(in) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "from backup", string(got))
+}
+
+func TestEncryptCmd_OverwriteProtection(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+	require.NoError(t, os.WriteFile(in+".age", []byte("older ciphertext"), 0o600))
+
+	c := Encrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("recipient", pub))
+	assert.ErrorContains(t, c.RunE(c, nil), "already exists")
+
+	require.NoError(t, c.Flags().Set("force", "true"))
+	require.NoError(t, c.RunE(c, nil))
+	got, err := os.ReadFile(in + ".age") // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.NotEqual(t, "older ciphertext", string(got))
+}
+
+// encryptIO runs encrypt from in to out for the key at pub, with the extra
+// boolean flags.
+func encryptIO(t *testing.T, in, out, pub string, flags ...string) error {
+	t.Helper()
+	c := Encrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("output", out))
+	require.NoError(t, c.Flags().Set("recipient", pub))
+	for _, f := range flags {
+		require.NoError(t, c.Flags().Set(f, "true"))
+	}
+	return c.RunE(c, nil)
+}
+
+func TestResolveIO_SafetyChecks(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+
+	assert.ErrorContains(t, encryptIO(t, dir, filepath.Join(dir, "d.age"), pub), "input "+dir+" is a directory")
+	assert.ErrorContains(t, encryptIO(t, in, dir, pub, "force"), "output "+dir+" is a directory")
+
+	// The same file under another name is still the same file.
+	alias := filepath.Join(dir, "alias.txt")
+	require.NoError(t, os.Link(in, alias))
+	assert.ErrorContains(t, encryptIO(t, in, alias, pub, "force"), "input and output are the same file")
+
+}
+
+func TestResolveIO_SymlinkedOutput(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+	target := filepath.Join(dir, "real.age")
+	link := filepath.Join(dir, "link.age")
+	require.NoError(t, os.Symlink(target, link))
+
+	assert.ErrorContains(t, encryptIO(t, in, link, pub), "is a symlink; pass --follow-symlinks")
+	assert.NoFileExists(t, target)
+
+	require.NoError(t, encryptIO(t, in, link, pub, "follow-symlinks"))
+	assert.FileExists(t, target, "the target is written")
+	info, err := os.Lstat(link)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeSymlink, "the link is left in place")
+
+	// A link pointing back at the input is caught once resolved.
+	back := filepath.Join(dir, "back.age")
+	require.NoError(t, os.Symlink(in, back))
+	assert.ErrorContains(t, encryptIO(t, in, back, pub, "follow-symlinks", "force"), "same file")
+
+	loop := filepath.Join(dir, "loop.age")
+	require.NoError(t, os.Symlink(loop, loop))
+	assert.ErrorContains(t, encryptIO(t, in, loop, pub, "follow-symlinks"), "too many levels")
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.WriteFile(src, []byte("data"), 0o640))
+	dst := filepath.Join(dir, "dst")
+	require.NoError(t, copyFile(src, dst))
+	got, err := os.ReadFile(dst) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(got))
+	info, err := os.Stat(dst)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	assert.Error(t, copyFile(src, dst), "an existing destination is never replaced")
+}
+
+// writeFileAtomic keeps the replaced file only when the options ask for it, and
+// gives the new file their mode.
+func TestWriteFileAtomic_Options(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out")
+	require.NoError(t, writeFileAtomic(path, []byte("one"), ".a-test-*", outputOptions{}))
+	require.NoError(t, writeFileAtomic(path, []byte("two"), ".a-test-*", outputOptions{}))
+	assert.NoFileExists(t, path+".bak")
+
+	require.NoError(t, writeFileAtomic(path, []byte("three"), ".a-test-*", outputOptions{backup: true, perm: 0o644}))
+	backup, err := os.ReadFile(path + ".bak") // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(backup))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+}
+
+// An exclusive write fails rather than replace a file that appeared at the
+// output name after guardOutput found it free.
+func TestReplaceOutput_Exclusive(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	require.NoError(t, writeFileAtomic(out, []byte("new"), ".a-test-*", outputOptions{exclusive: true}))
+	got, err := os.ReadFile(out) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(got))
+
+	err = writeFileAtomic(out, []byte("newer"), ".a-test-*", outputOptions{exclusive: true})
+	require.ErrorContains(t, err, "was created while it was being written")
+	got, err = os.ReadFile(out) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(got))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "the temp file is removed")
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveIO_SpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+
+	fifo := filepath.Join(dir, "fifo")
+	require.NoError(t, syscall.Mkfifo(fifo, 0o600))
+	assert.ErrorContains(t, encryptIO(t, fifo, in+".age", pub), "pass --allow-special")
+	assert.ErrorContains(t, encryptIO(t, in, fifo, pub, "force"), "output "+fifo+" is not a regular file")
+	c := Encrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("allow-special", "true"))
+	info, err := os.Stat(fifo)
+	require.NoError(t, err)
+	assert.NoError(t, checkInput(c, fifo, info))
+}
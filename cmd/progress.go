@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Values of the --progress flag.
+const (
+	progressAuto = "auto" // a status line on stderr when it is a terminal
+	progressJSON = "json" // one JSON object per line on stderr
+	progressOff  = "off"
+)
+
+// progressInterval is how often the status line or a JSON line is written.
+const progressInterval = 250 * time.Millisecond
+
+// progressOptions says how copies started with them report progress. Timing is
+// always logged at debug level, whatever the mode.
+type progressOptions struct {
+	mode string // progressJSON, progressAuto (terminal only) or progressOff
+	w    io.Writer
+	log  *slog.Logger
+	now  func() time.Time
+}
+
+// addProgressFlag registers --progress on cmd.
+func addProgressFlag(cmd *cobra.Command) {
+	cmd.Flags().String("progress", progressAuto,
+		"Progress on stderr: auto (a status line on a terminal), json (one object per line) or off")
+}
+
+// progressFlag returns the progressOptions set by cmd's --progress flag, which
+// outputFlags hands to encryptWithHeader and decryptFile for their copies.
+func progressFlag(cmd *cobra.Command, log *slog.Logger) (*progressOptions, error) {
+	mode, _ := cmd.Flags().GetString("progress")
+	switch mode {
+	case progressAuto:
+		// --quiet leaves only errors on the console, so no status line either.
+		if Quiet(cmd) || !isTerminal(cmd.ErrOrStderr()) {
+			mode = progressOff
+		}
+	case progressJSON, progressOff:
+	default:
+		return nil, fmt.Errorf("unknown --progress %q: want auto, json or off", mode)
+	}
+	return &progressOptions{mode: mode, w: cmd.ErrOrStderr(), log: log, now: time.Now}, nil
+}
+
+// progress tracks one copy. A nil *progress (no options) does nothing, so
+// callers need no checks.
+type progress struct {
+	opts  *progressOptions
+	op    string
+	file  string
+	total int64 // input size in bytes, or 0 when unknown (e.g. a FIFO)
+	start time.Time
+	last  time.Time // when a line was last written
+
+	mu   sync.Mutex
+	done int64
+}
+
+// startProgress begins tracking a copy of f for op ("encrypt" or "decrypt"),
+// or returns nil without opts. The input's size gives the percentage and ETA.
+func startProgress(opts *progressOptions, op string, f *os.File) *progress {
+	if opts == nil {
+		return nil
+	}
+	var total int64
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		total = info.Size()
+	}
+	now := opts.now()
+	return &progress{opts: opts, op: op, file: f.Name(), total: total, start: now, last: now}
+}
+
+// reader counts the bytes read through r.
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+// progressReader reports every read to its progress.
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+// Read implements io.Reader.
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.add(int64(n))
+	return n, err
+}
+
+// add records n more bytes and writes a line when progressInterval has passed.
+func (p *progress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	now := p.opts.now()
+	if now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+	p.write(now, false)
+}
+
+// finish ends the copy: a successful one writes the final line and logs its
+// timing and throughput, a failed one only ends the status line.
+func (p *progress) finish(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.opts.now()
+	if err != nil {
+		if p.opts.mode == progressAuto {
+			_, _ = fmt.Fprintln(p.opts.w)
+		}
+		return
+	}
+	p.write(now, true)
+	elapsed := now.Sub(p.start)
+	p.opts.log.Debug("Copy finished", "op", p.op, "file", p.file, "bytes", p.done,
+		"duration", elapsed, "bytesPerSecond", int64(rate(p.done, elapsed)))
+}
+
+// progressLine is one --progress=json line.
+type progressLine struct {
+	Op             string  `json:"op"`
+	File           string  `json:"file"`
+	Bytes          int64   `json:"bytes"`
+	Total          int64   `json:"total,omitempty"`
+	Percent        float64 `json:"percent,omitempty"`
+	BytesPerSecond int64   `json:"bytes_per_second"`
+	ETASeconds     float64 `json:"eta_seconds,omitempty"`
+	Done           bool    `json:"done"`
+}
+
+// write prints the current state in the configured mode. Write errors are
+// ignored: progress must never fail the copy.
+func (p *progress) write(now time.Time, done bool) {
+	line := progressLine{Op: p.op, File: p.file, Bytes: p.done, Total: p.total, Done: done}
+	line.BytesPerSecond = int64(rate(p.done, now.Sub(p.start)))
+	var eta time.Duration
+	if p.total > 0 {
+		line.Percent = min(100, float64(p.done)*100/float64(p.total))
+		if line.BytesPerSecond > 0 && !done {
+			eta = time.Duration(float64(max(0, p.total-p.done)) / float64(line.BytesPerSecond) * float64(time.Second))
+			line.ETASeconds = eta.Round(time.Second).Seconds()
+		}
+	}
+
+	switch p.opts.mode {
+	case progressJSON:
+		_ = json.NewEncoder(p.opts.w).Encode(line)
+	case progressAuto:
+		status := formatBytes(p.done)
+		if p.total > 0 {
+			status += fmt.Sprintf(" / %s %3.0f%%", formatBytes(p.total), line.Percent)
+		}
+		status += fmt.Sprintf("  %s/s", formatBytes(line.BytesPerSecond))
+		if eta > 0 {
+			status += "  ETA " + eta.Round(time.Second).String()
+		}
+		end := ""
+		if done {
+			end = "\n"
+		}
+		// \033[K clears what a longer previous line left behind.
+		_, _ = fmt.Fprintf(p.opts.w, "\r%s %s\033[K%s", p.op, status, end)
+	}
+}
+
+// rate is n bytes over d in bytes per second, or 0 for no elapsed time.
+func rate(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// formatBytes renders n with a binary unit, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "0 B", formatBytes(0))
+	assert.Equal(t, "1023 B", formatBytes(1023))
+	assert.Equal(t, "1.0 KiB", formatBytes(1024))
+	assert.Equal(t, "1.5 MiB", formatBytes(3<<19))
+	assert.Equal(t, "40.0 GiB", formatBytes(40<<30))
+}
+
+func TestProgressFlag_Modes(t *testing.T) {
+	c := &cobra.Command{}
+	addProgressFlag(c)
+	var stderr bytes.Buffer
+	c.SetErr(&stderr)
+
+	// auto falls back to off when stderr is not a terminal.
+	opts, err := progressFlag(c, discardLogger())
+	require.NoError(t, err)
+	assert.Equal(t, progressOff, opts.mode)
+
+	require.NoError(t, c.Flags().Set("progress", "bogus"))
+	_, err = progressFlag(c, discardLogger())
+	assert.ErrorContains(t, err, "unknown --progress")
+
+	// Without options a copy is not tracked.
+	assert.Nil(t, startProgress(nil, "encrypt", os.Stdin))
+}
+
+// A tracked copy writes JSON lines at most every progressInterval, ends with a
+// done line, and logs its timing at debug level.
+func TestProgress_JSONLines(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "in")) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+	_, err = f.Write(make([]byte, 1000))
+	require.NoError(t, err)
+
+	clock := time.Unix(0, 0)
+	var out, logs bytes.Buffer
+	opts := &progressOptions{
+		mode: progressJSON,
+		w:    &out,
+		log:  slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		now:  func() time.Time { return clock },
+	}
+	p := startProgress(opts, "encrypt", f)
+
+	p.add(100) // too soon for a line
+	clock = clock.Add(time.Second)
+	p.add(150)
+	clock = clock.Add(time.Second)
+	p.add(750)
+	p.finish(nil)
+
+	var lines []progressLine
+	for l := range strings.Lines(out.String()) {
+		var line progressLine
+		require.NoError(t, json.Unmarshal([]byte(l), &line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, progressLine{
+		Op: "encrypt", File: f.Name(), Bytes: 250, Total: 1000, Percent: 25, BytesPerSecond: 250, ETASeconds: 3,
+	}, lines[0])
+	assert.True(t, lines[2].Done)
+	assert.Equal(t, 100.0, lines[2].Percent)
+	assert.Contains(t, logs.String(), `"msg":"Copy finished"`)
+	assert.Contains(t, logs.String(), `"bytesPerSecond":500`)
+}
+
+// encrypt and decrypt report on stderr with --progress=json.
+func TestProgress_EncryptDecryptCommands(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("progress"), 0o600))
+
+	var stderr bytes.Buffer
+	e := Encrypt(&Config{}, discardLogger())
+	e.SetErr(&stderr)
+	for k, v := range map[string]string{"input": in, "recipient": pub, "progress": "json"} {
+		require.NoError(t, e.Flags().Set(k, v))
+	}
+	require.NoError(t, e.RunE(e, nil))
+	assert.Contains(t, stderr.String(), `"op":"encrypt"`)
+	assert.Contains(t, stderr.String(), `"done":true`)
+
+	stderr.Reset()
+	d := Decrypt(&Config{}, discardLogger())
+	d.SetErr(&stderr)
+	flags := map[string]string{"input": in + ".age", "output": in + ".out", "ssh-key": priv, "progress": "json"}
+	for k, v := range flags {
+		require.NoError(t, d.Flags().Set(k, v))
+	}
+	require.NoError(t, d.RunE(d, nil))
+	assert.Contains(t, stderr.String(), `"op":"decrypt"`)
+	assert.Contains(t, stderr.String(), `"done":true`)
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// checkRemoveSource validates encrypt --remove-source before anything is
+// written, so a source that would be refused is not encrypted first. resolveIO
+// has already ruled out an output that is the input itself.
+func checkRemoveSource(cmd *cobra.Command, input string) error {
+	remove, _ := cmd.Flags().GetBool("remove-source")
+	if !remove {
+		for _, flag := range []string{"verify-decrypt", "overwrite"} {
+			if set, _ := cmd.Flags().GetBool(flag); set {
+				return fmt.Errorf("--%s requires --remove-source", flag)
+			}
+		}
+		return nil
+	}
+	return checkRemovable(input)
+}
+
+// checkRemovable refuses anything but a regular file with a single link.
+// Deleting a symlink or one of several hard links leaves the plaintext
+// reachable elsewhere, and devices, FIFOs and sockets are not files to shred.
+func checkRemovable(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("refusing to remove %s: not a regular file (%s)", path, info.Mode().Type())
+	}
+	if n := linkCount(info); n > 1 {
+		return fmt.Errorf("refusing to remove %s: it has %d hard links, which would keep the plaintext", path, n)
+	}
+	return nil
+}
+
+// removeSourceAfterEncrypt deletes the plaintext once encryptFile has synced
+// and renamed the ciphertext into place. With --verify-decrypt one of the
+// user's own keys must decrypt the output first; with --overwrite the contents
+// are overwritten before the unlink.
+func removeSourceAfterEncrypt(cmd *cobra.Command, cfg *Config, input, output string, log *slog.Logger) error {
+	if remove, _ := cmd.Flags().GetBool("remove-source"); !remove {
+		return nil
+	}
+	if verify, _ := cmd.Flags().GetBool("verify-decrypt"); verify {
+		keyPath, err := decryptableBy(commandContext(cmd), ownKeyFiles(cfg, log), output)
+		if err != nil {
+			return fmt.Errorf("keeping %s: %w", input, err)
+		}
+		log.Info("Verified ciphertext decrypts", "key", keyPath)
+	}
+	// The source is checked again: it may have been replaced while encrypting.
+	if err := checkRemovable(input); err != nil {
+		return err
+	}
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+	if overwrite {
+		if err := overwriteFile(input); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(input); err != nil {
+		return fmt.Errorf("removing source: %w", err)
+	}
+	log.Info("Removed source", "path", input, "overwritten", overwrite)
+	return nil
+}
+
+// decryptableBy returns the first of keys that fully decrypts the file at path.
+// The plaintext is discarded; reading it to the end authenticates every chunk.
+func decryptableBy(ctx context.Context, keys []string, path string) (string, error) {
+	for _, keyPath := range keys {
+		identities, err := parseIdentityFile(keyPath)
+		if err != nil {
+			continue
+		}
+		if decryptsWith(ctx, path, identities) {
+			return keyPath, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("none of your local keys decrypt %s", path)
+}
+
+// decryptsWith reports whether identities decrypt the whole file at path.
+func decryptsWith(ctx context.Context, path string, identities []age.Identity) bool {
+	// #nosec G304 -- path is the ciphertext just written by encrypt
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+	return agewrap.Decrypt(ctx, io.Discard, f, identities...) == nil
+}
+
+// overwriteFile replaces the contents of the regular file at path with random
+// bytes and syncs them. This is best effort only: SSDs remap writes, and
+// copy-on-write or journaling filesystems and snapshots keep old blocks, so the
+// plaintext may survive on the device.
+func overwriteFile(path string) error {
+	// #nosec G304 -- path is the encrypt input, checked by checkRemovable
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("overwriting source: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("overwriting source: %w", err)
+	}
+	if _, err := io.CopyN(f, rand.Reader, info.Size()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("overwriting source: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("overwriting source: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encryptRemoving runs encrypt on in for the key at pub with --remove-source
+// and the extra boolean flags.
+func encryptRemoving(t *testing.T, cfg *Config, in, pub string, flags ...string) error {
+	t.Helper()
+	c := Encrypt(cfg, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("recipient", pub))
+	require.NoError(t, c.Flags().Set("remove-source", "true"))
+	for _, f := range flags {
+		require.NoError(t, c.Flags().Set(f, "true"))
+	}
+	return c.RunE(c, nil)
+}
+
+func TestEncryptCmd_RemoveSource(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "secret.txt")
+	require.NoError(t, os.WriteFile(in, []byte("forget me"), 0o600))
+
+	require.NoError(t, encryptRemoving(t, &Config{SSHKeyPath: priv}, in, pub, "verify-decrypt", "overwrite"))
+	assert.NoFileExists(t, in)
+	_, err := decryptFile(context.Background(), priv, in, in+".age", outputOptions{})
+	require.NoError(t, err, "the ciphertext still decrypts")
+	got, err := os.ReadFile(in) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "forget me", string(got))
+}
+
+// The source stays when none of the user's keys can decrypt the output.
+func TestEncryptCmd_RemoveSourceVerifyFails(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	otherPriv, _ := makeSSHKey(t, t.TempDir())
+	in := filepath.Join(dir, "secret.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+
+	err := encryptRemoving(t, &Config{SSHKeyPath: otherPriv}, in, pub, "verify-decrypt")
+	assert.ErrorContains(t, err, "none of your local keys decrypt")
+	assert.FileExists(t, in)
+	assert.FileExists(t, in+".age")
+}
+
+func TestEncryptCmd_RemoveSourceRefusals(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "secret.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+
+	link := filepath.Join(dir, "link.txt")
+	require.NoError(t, os.Link(in, link))
+	assert.ErrorContains(t, encryptRemoving(t, &Config{}, in, pub), "2 hard links")
+	assert.NoFileExists(t, in+".age", "a refused source is not encrypted")
+	require.NoError(t, os.Remove(link))
+
+	sym := filepath.Join(dir, "sym.txt")
+	require.NoError(t, os.Symlink(in, sym))
+	assert.ErrorContains(t, encryptRemoving(t, &Config{}, sym, pub), "not a regular file")
+
+	c := Encrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("output", in))
+	require.NoError(t, c.Flags().Set("force", "true"))
+	require.NoError(t, c.Flags().Set("recipient", pub))
+	require.NoError(t, c.Flags().Set("remove-source", "true"))
+	assert.ErrorContains(t, c.RunE(c, nil), "input and output are the same file")
+
+	c = Encrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("recipient", pub))
+	require.NoError(t, c.Flags().Set("overwrite", "true"))
+	assert.ErrorContains(t, c.RunE(c, nil), "--overwrite requires --remove-source")
+	assert.FileExists(t, in)
+}
+
+func TestOverwriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	require.NoError(t, os.WriteFile(path, []byte("plaintext!"), 0o600))
+	require.NoError(t, overwriteFile(path))
+	got, err := os.ReadFile(path) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Len(t, got, len("plaintext!"))
+	assert.NotEqual(t, "plaintext!", string(got))
+}
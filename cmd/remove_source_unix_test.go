@@ -0,0 +1,18 @@
+//go:build unix
+
+package cmd
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRemovable_FIFO(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "fifo")
+	require.NoError(t, syscall.Mkfifo(fifo, 0o600))
+	assert.ErrorContains(t, checkRemovable(fifo), "not a regular file")
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runRoot runs args under a root command carrying the global flags, as main
+// does, and returns stdout.
+func runRoot(t *testing.T, sub *cobra.Command, args ...string) (string, error) {
+	t.Helper()
+	root := &cobra.Command{Use: "a", SilenceErrors: true, SilenceUsage: true}
+	AddOutputFormatFlag(root)
+	root.AddCommand(sub)
+	var stdout bytes.Buffer
+	root.SetOut(&stdout)
+	root.SetErr(&bytes.Buffer{})
+	root.SetArgs(args)
+	err := root.Execute()
+	return stdout.String(), err
+}
+
+func TestOutputFormatJSON(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("json result"), 0o600))
+
+	out, err := runRoot(t, Encrypt(&Config{}, discardLogger()),
+		"--output-format", "json", "encrypt", in, "-r", pub)
+	require.NoError(t, err)
+	var res Result
+	require.NoError(t, json.Unmarshal([]byte(out), &res))
+	assert.Equal(t, "encrypt", res.Operation)
+	assert.Equal(t, in, res.Input)
+	assert.Equal(t, in+".age", res.Output)
+	assert.Equal(t, []string{pub}, res.Recipients)
+	assert.Positive(t, res.Bytes)
+	assert.Nil(t, res.Error)
+
+	dec := filepath.Join(dir, "out.txt")
+	out, err = runRoot(t, Decrypt(&Config{}, discardLogger()),
+		"--output-format", "json", "decrypt", in+".age", "-o", dec, "--ssh-key", priv)
+	require.NoError(t, err)
+	res = Result{}
+	require.NoError(t, json.Unmarshal([]byte(out), &res))
+	assert.Equal(t, "decrypt", res.Operation)
+	assert.Equal(t, priv, res.Identity)
+	assert.Equal(t, int64(len("json result")), res.Bytes)
+
+	// A failure still prints its result, with the error code and exit status.
+	otherPriv, _ := makeSSHKey(t, t.TempDir())
+	out, err = runRoot(t, Decrypt(&Config{}, discardLogger()),
+		"--output-format", "json", "decrypt", in+".age", "-o", dec, "--ssh-key", otherPriv, "--force")
+	require.Error(t, err)
+	assert.Equal(t, ExitNoMatchingKey, ExitCode(err))
+	res = Result{}
+	require.NoError(t, json.Unmarshal([]byte(out), &res))
+	require.NotNil(t, res.Error)
+	assert.Equal(t, "no_matching_key", res.Error.Code)
+	assert.Equal(t, ExitNoMatchingKey, res.Error.ExitCode)
+
+	_, err = runRoot(t, Encrypt(&Config{}, discardLogger()), "--output-format", "xml", "encrypt", in)
+	assert.ErrorContains(t, err, "unknown --output-format")
+}
+
+// Text mode prints nothing on stdout, and commands built without the root
+// command behave the same.
+func TestOutputFormatText(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+	out, err := runRoot(t, Encrypt(&Config{}, discardLogger()), "encrypt", in)
+	assert.Equal(t, ExitNoRecipients, ExitCode(err))
+	assert.Empty(t, out)
+
+	asJSON, err := jsonOutput(&cobra.Command{})
+	require.NoError(t, err)
+	assert.False(t, asJSON)
+}
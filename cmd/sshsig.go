@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// Detached signatures follow the OpenSSH SSHSIG format (PROTOCOL.sshsig), so a
+// file signed by `a encrypt --sign` verifies with
+//
+//	ssh-keygen -Y verify -f allowed_signers -I <who> -n a -s file.age.sig < file.age
+//
+// and signatures made by `ssh-keygen -Y sign -n a` verify with `a decrypt`.
+const (
+	sshsigMagic     = "SSHSIG"
+	sshsigVersion   = 1
+	sshsigNamespace = "a"
+	sshsigPEMType   = "SSH SIGNATURE"
+)
+
+// sshsigBlob is the wire form of an SSHSIG signature, after the magic preamble.
+type sshsigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshsigSignedData is the structure the signature is computed over.
+type sshsigSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// sshsigHash returns the hash for an SSHSIG hash algorithm name.
+func sshsigHash(name string) (hash.Hash, error) {
+	switch name {
+	case "sha512":
+		return sha512.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported signature hash algorithm %q", name)
+	}
+}
+
+// sshsigMessage hashes the file at path and returns the data an SSHSIG
+// signature over it covers.
+func sshsigMessage(path, hashAlgorithm string) ([]byte, error) {
+	h, err := sshsigHash(hashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	// #nosec G304 -- path is the ciphertext named on the command line
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("hashing %s: %w", path, err)
+	}
+	return append([]byte(sshsigMagic), ssh.Marshal(sshsigSignedData{
+		Namespace:     sshsigNamespace,
+		HashAlgorithm: hashAlgorithm,
+		Hash:          h.Sum(nil),
+	})...), nil
+}
+
+// loadSigner returns a signer for the SSH private key at keyPath. A
+// passphrase-protected key cannot be opened without prompting, so it is used
+// through ssh-agent instead, matched by its .pub file.
+func loadSigner(keyPath string) (ssh.Signer, error) {
+	// #nosec G304 -- keyPath comes from --sign-key or ssh_key_path
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err == nil {
+		return signer, nil
+	}
+	if _, ok := errors.AsType[*ssh.PassphraseMissingError](err); !ok {
+		return nil, fmt.Errorf("parsing signing key %s: %w", keyPath, err)
+	}
+	pub, err := sshPublicKey(keyPath, data)
+	if err != nil {
+		return nil, err
+	}
+	return agentSigner(pub)
+}
+
+// agentSigner returns the ssh-agent signer for pub. The agent connection stays
+// open for the life of the process, which is one command.
+func agentSigner(pub ssh.PublicKey) (ssh.Signer, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("signing key is passphrase-protected: %w", errNoAgent)
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to ssh-agent: %w", err)
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("listing ssh-agent keys: %w", err)
+	}
+	for _, s := range signers {
+		if sameKey(s.PublicKey(), pub) {
+			return s, nil
+		}
+	}
+	_ = conn.Close()
+	return nil, fmt.Errorf("signing key is passphrase-protected and not loaded in ssh-agent (run ssh-add)")
+}
+
+// signFile writes an armored SSHSIG signature over the file at path to sigPath.
+// RSA keys sign with rsa-sha2-512, as ssh-keygen does; SHA-1 RSA signatures
+// are not accepted by current OpenSSH. An existing sigPath is replaced as opts
+// says, so --backup keeps it.
+func signFile(signer ssh.Signer, path, sigPath string, opts outputOptions) error {
+	message, err := sshsigMessage(path, "sha512")
+	if err != nil {
+		return err
+	}
+	var sig *ssh.Signature
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, message, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = signer.Sign(rand.Reader, message)
+	}
+	if err != nil {
+		return fmt.Errorf("signing %s: %w", path, err)
+	}
+	blob := append([]byte(sshsigMagic), ssh.Marshal(sshsigBlob{
+		Version:       sshsigVersion,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     sshsigNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...)
+	// A signature is public, like the .pub key it names.
+	opts.perm = 0o644
+	if err := writeFileAtomic(sigPath, armorSignature(blob), ".a-sig-*", opts); err != nil {
+		return fmt.Errorf("writing signature: %w", err)
+	}
+	return nil
+}
+
+// armorSignature PEM-encodes blob with 70-column lines, matching ssh-keygen.
+func armorSignature(blob []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("-----BEGIN " + sshsigPEMType + "-----\n")
+	enc := base64.StdEncoding.EncodeToString(blob)
+	for len(enc) > 70 {
+		b.WriteString(enc[:70] + "\n")
+		enc = enc[70:]
+	}
+	b.WriteString(enc + "\n-----END " + sshsigPEMType + "-----\n")
+	return b.Bytes()
+}
+
+// parseSignature decodes an armored SSHSIG signature.
+func parseSignature(data []byte) (*sshsigBlob, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != sshsigPEMType {
+		return nil, errors.New("not an SSH signature")
+	}
+	raw, ok := bytes.CutPrefix(block.Bytes, []byte(sshsigMagic))
+	if !ok {
+		return nil, errors.New("not an SSH signature: bad magic")
+	}
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(raw, &blob); err != nil {
+		return nil, fmt.Errorf("malformed SSH signature: %w", err)
+	}
+	if blob.Version != sshsigVersion {
+		return nil, fmt.Errorf("unsupported SSH signature version %d", blob.Version)
+	}
+	return &blob, nil
+}
+
+// verifyFile checks the SSHSIG signature at sigPath over the file at path. The
+// signing key must be one of allowed; the key embedded in the signature is
+// only trusted once it matches. It returns the key that signed.
+func verifyFile(path, sigPath string, allowed []ssh.PublicKey) (ssh.PublicKey, error) {
+	// #nosec G304 -- sigPath is <input>.sig or the --signature flag
+	data, err := os.ReadFile(sigPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading signature: %w", err)
+	}
+	blob, err := parseSignature(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", sigPath, err)
+	}
+	if blob.Namespace != sshsigNamespace {
+		return nil, fmt.Errorf("signature namespace is %q, not %q", blob.Namespace, sshsigNamespace)
+	}
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signature key: %w", err)
+	}
+	if !slices.ContainsFunc(allowed, func(k ssh.PublicKey) bool { return sameKey(k, pub) }) {
+		return nil, fmt.Errorf("signed by %s, which is not an allowed signer", ssh.FingerprintSHA256(pub))
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	// ssh.PublicKey.Verify still accepts SHA-1 ssh-rsa signatures, which
+	// ssh-keygen -Y verify rejects; so do we.
+	if pub.Type() == ssh.KeyAlgoRSA && sig.Format != ssh.KeyAlgoRSASHA256 && sig.Format != ssh.KeyAlgoRSASHA512 {
+		return nil, fmt.Errorf("signature by %s uses %s; RSA signatures must be rsa-sha2-256 or rsa-sha2-512",
+			ssh.FingerprintSHA256(pub), sig.Format)
+	}
+	message, err := sshsigMessage(path, blob.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := pub.Verify(message, &sig); err != nil {
+		return nil, fmt.Errorf("bad signature by %s: %w", ssh.FingerprintSHA256(pub), err)
+	}
+	return pub, nil
+}
+
+// allowedSigners resolves a --verify-from value into public keys:
+// "github:<user>" for the user's GitHub keys, otherwise an SSH public key line
+// or a file of them (a .pub or authorized_keys file). cert-authority lines are
+// skipped, as agewrap.ParseAuthorizedKey skips them as recipients.
+func allowedSigners(
+	ctx context.Context,
+	cfg *Config,
+	from string,
+	log *slog.Logger,
+	extra ...agewrap.Option,
+) ([]ssh.PublicKey, error) {
+	var lines []string
+	if ghUser, ok := strings.CutPrefix(from, "github:"); ok {
+		if !agewrap.ValidGitHubUser(ghUser) {
+			return nil, fmt.Errorf("invalid GitHub username %q", ghUser)
+		}
+		lines = fetchGitHubKeys(ctx, cfg, ghUser, log, extra...)
+	} else {
+		var err error
+		if lines, err = agewrap.ReadRecipientLines(from); err != nil {
+			return nil, err
+		}
+	}
+	var keys []ssh.PublicKey
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pub, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			log.Warn("Skipping unparsable signer key", "source", from, "error", err)
+			continue
+		}
+		// A CA key vouches for certificates; it does not sign files itself.
+		if slices.ContainsFunc(options, func(o string) bool { return strings.EqualFold(o, "cert-authority") }) {
+			log.Warn("Skipping cert-authority signer key", "source", from, "key", ssh.FingerprintSHA256(pub))
+			continue
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signer keys found for %q", from)
+	}
+	return keys, nil
+}
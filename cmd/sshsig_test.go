@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// encryptSigned encrypts in to in.age for the key at pub and signs it with the
+// key at signKey, through the encrypt command.
+func encryptSigned(t *testing.T, in, pub, signKey string) string {
+	t.Helper()
+	c := Encrypt(&Config{SSHKeyPath: signKey}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("recipient", pub))
+	require.NoError(t, c.Flags().Set("sign", "true"))
+	require.NoError(t, c.RunE(c, nil))
+	return in + ".age"
+}
+
+// decryptVerified decrypts enc with priv, requiring a signature from verifyFrom.
+func decryptVerified(
+	t *testing.T,
+	cfg *Config,
+	enc, priv, verifyFrom string,
+	extra ...agewrap.Option,
+) (string, error) {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "plain.txt")
+	c := Decrypt(cfg, discardLogger(), extra...)
+	require.NoError(t, c.Flags().Set("input", enc))
+	require.NoError(t, c.Flags().Set("output", out))
+	require.NoError(t, c.Flags().Set("ssh-key", priv))
+	require.NoError(t, c.Flags().Set("verify-from", verifyFrom))
+	return out, c.RunE(c, nil)
+}
+
+func TestSignVerify_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "msg.txt")
+	require.NoError(t, os.WriteFile(in, []byte("signed secret"), 0o600))
+	enc := encryptSigned(t, in, pub, priv)
+	require.FileExists(t, enc+".sig")
+
+	out, err := decryptVerified(t, &Config{}, enc, priv, pub)
+	require.NoError(t, err)
+	got, err := os.ReadFile(out) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "signed secret", string(got))
+
+	github := githubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintln(w, pubKeyLine(t, pub))
+	})
+	_, err = decryptVerified(t, &Config{}, enc, priv, "github:alice", github...)
+	require.NoError(t, err, "GitHub keys are allowed signers")
+
+	// A different signer is rejected before any plaintext is written.
+	_, otherPub := makeSSHKey(t, t.TempDir())
+	out, err = decryptVerified(t, &Config{}, enc, priv, otherPub)
+	assert.ErrorContains(t, err, "not an allowed signer")
+	assert.NoFileExists(t, out)
+
+	// So is a ciphertext changed after signing.
+	data, err := os.ReadFile(enc) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(enc, append(data, 0), 0o600))
+	out, err = decryptVerified(t, &Config{}, enc, priv, pub)
+	assert.ErrorContains(t, err, "bad signature")
+	assert.NoFileExists(t, out)
+
+	require.NoError(t, os.Remove(enc+".sig"))
+	_, err = decryptVerified(t, &Config{}, enc, priv, pub)
+	assert.ErrorContains(t, err, "reading signature")
+}
+
+// Signatures interoperate with ssh-keygen -Y in both directions, for ed25519
+// and RSA keys.
+func TestSignVerify_SSHKeygenCompatible(t *testing.T) {
+	for _, keyType := range []string{"ed25519", "rsa"} {
+		t.Run(keyType, func(t *testing.T) {
+			dir := t.TempDir()
+			priv := filepath.Join(dir, "id_"+keyType)
+			// #nosec G204 -- test helper; the path is a test temp dir
+			out, err := exec.Command("ssh-keygen", "-t", keyType, "-N", "", "-f", priv).CombinedOutput()
+			require.NoError(t, err, string(out))
+			signer, err := loadSigner(priv)
+			require.NoError(t, err)
+
+			file := filepath.Join(dir, "data.age")
+			require.NoError(t, os.WriteFile(file, []byte("ciphertext"), 0o600))
+			require.NoError(t, signFile(signer, file, file+".sig", outputOptions{}))
+
+			allowedSignersFile := filepath.Join(dir, "allowed_signers")
+			require.NoError(t, os.WriteFile(allowedSignersFile, []byte("me "+pubKeyLine(t, priv+".pub")+"\n"), 0o600))
+			verify := exec.Command("ssh-keygen", "-Y", "verify", "-f", allowedSignersFile, "-I", "me",
+				"-n", "a", "-s", file+".sig") // #nosec G204 -- test temp paths
+			verify.Stdin, err = os.Open(file) // #nosec G304 -- test temp path
+			require.NoError(t, err)
+			out, err = verify.CombinedOutput()
+			require.NoError(t, err, string(out))
+
+			require.NoError(t, os.Remove(file+".sig"))
+			// #nosec G204 -- test temp paths
+			out, err = exec.Command("ssh-keygen", "-Y", "sign", "-f", priv, "-n", "a", file).CombinedOutput()
+			require.NoError(t, err, string(out))
+			got, err := verifyFile(file, file+".sig", []ssh.PublicKey{signer.PublicKey()})
+			require.NoError(t, err)
+			assert.True(t, sameKey(got, signer.PublicKey()))
+
+			// A signature for another namespace does not count.
+			require.NoError(t, os.Remove(file+".sig"))
+			// #nosec G204 -- test temp paths
+			out, err = exec.Command("ssh-keygen", "-Y", "sign", "-f", priv, "-n", "git", file).CombinedOutput()
+			require.NoError(t, err, string(out))
+			_, err = verifyFile(file, file+".sig", []ssh.PublicKey{signer.PublicKey()})
+			assert.ErrorContains(t, err, `namespace is "git"`)
+		})
+	}
+}
+
+// SHA-1 RSA signatures verify with ssh.PublicKey.Verify but not with
+// ssh-keygen -Y verify, so they are refused.
+func TestVerifyFile_RejectsSHA1RSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "data.age")
+	require.NoError(t, os.WriteFile(file, []byte("ciphertext"), 0o600))
+
+	sign := func(algo string) {
+		message, err := sshsigMessage(file, "sha512")
+		require.NoError(t, err)
+		sig, err := signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, message, algo)
+		require.NoError(t, err)
+		blob := append([]byte(sshsigMagic), ssh.Marshal(sshsigBlob{
+			Version: sshsigVersion, PublicKey: signer.PublicKey().Marshal(), Namespace: sshsigNamespace,
+			HashAlgorithm: "sha512", Signature: ssh.Marshal(sig),
+		})...)
+		require.NoError(t, os.WriteFile(file+".sig", armorSignature(blob), 0o600))
+	}
+	allowed := []ssh.PublicKey{signer.PublicKey()}
+
+	sign(ssh.KeyAlgoRSA)
+	_, err = verifyFile(file, file+".sig", allowed)
+	assert.ErrorContains(t, err, "must be rsa-sha2-256 or rsa-sha2-512")
+
+	for _, algo := range []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512} {
+		sign(algo)
+		_, err = verifyFile(file, file+".sig", allowed)
+		assert.NoError(t, err, algo)
+	}
+}
+
+// A cert-authority line in a signers file is not a signer, as it is not a
+// recipient either.
+func TestAllowedSigners_SkipsCertAuthority(t *testing.T) {
+	dir := t.TempDir()
+	_, caPub := makeSSHKey(t, dir)
+	_, pub := makeSSHKey(t, t.TempDir())
+	signers := filepath.Join(dir, "signers")
+	require.NoError(t, os.WriteFile(signers,
+		[]byte("cert-authority "+pubKeyLine(t, caPub)+"\n"+pubKeyLine(t, pub)+"\n"), 0o600))
+
+	keys, err := allowedSigners(t.Context(), &Config{}, signers, discardLogger())
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, pubKeyLine(t, pub), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(keys[0]))))
+}
+
+// A passphrase-protected signing key is used through ssh-agent.
+func TestLoadSigner_PassphraseUsesAgent(t *testing.T) {
+	dir := t.TempDir()
+	priv := filepath.Join(dir, "id_ed25519")
+	// #nosec G204 -- test helper; the path is a test temp dir
+	out, err := exec.Command("ssh-keygen", "-t", "ed25519", "-N", "hunter2", "-f", priv).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, err = loadSigner(priv)
+	assert.ErrorContains(t, err, "passphrase-protected")
+
+	startTestAgent(t)
+	_, err = loadSigner(priv)
+	assert.ErrorContains(t, err, "not loaded in ssh-agent")
+
+	data, err := os.ReadFile(priv) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	raw, err := ssh.ParseRawPrivateKeyWithPassphrase(data, []byte("hunter2"))
+	require.NoError(t, err)
+	added, _ := newAgentEd25519(t, "", "")
+	added.PrivateKey = raw
+	startTestAgent(t, added)
+	signer, err := loadSigner(priv)
+	require.NoError(t, err)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKeyLine(t, priv+".pub")))
+	require.NoError(t, err)
+	assert.True(t, sameKey(pub, signer.PublicKey()))
+}
+
+func TestEncryptCmd_SignWithoutKey(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+	c := Encrypt(&Config{}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("recipient", pub))
+	require.NoError(t, c.Flags().Set("sign", "true"))
+	assert.ErrorContains(t, c.RunE(c, nil), "--sign needs an SSH key")
+	assert.NoFileExists(t, in+".age", "nothing is written when signing cannot happen")
+}
+
+// An existing signature is protected like the output itself.
+func TestEncryptCmd_SignatureOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "in.txt")
+	require.NoError(t, os.WriteFile(in, []byte("x"), 0o600))
+	require.NoError(t, os.WriteFile(in+".age.sig", []byte("older signature"), 0o600))
+
+	c := Encrypt(&Config{SSHKeyPath: priv}, discardLogger())
+	require.NoError(t, c.Flags().Set("input", in))
+	require.NoError(t, c.Flags().Set("recipient", pub))
+	require.NoError(t, c.Flags().Set("sign", "true"))
+	assert.ErrorContains(t, c.RunE(c, nil), "in.txt.age.sig already exists")
+	assert.NoFileExists(t, in+".age", "nothing is written when the signature cannot be")
+
+	require.NoError(t, c.Flags().Set("backup", "true"))
+	require.NoError(t, c.RunE(c, nil))
+	bak, err := os.ReadFile(in + ".age.sig.bak") // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, "older signature", string(bak))
+	info, err := os.Stat(in + ".age.sig")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+}
+
+func TestAllowedSigners_Errors(t *testing.T) {
+	_, err := allowedSigners(context.Background(), &Config{}, "github:-bad-", discardLogger())
+	assert.ErrorContains(t, err, "invalid GitHub username")
+	_, err = allowedSigners(context.Background(), &Config{}, "age1notansshkey", discardLogger())
+	assert.ErrorContains(t, err, "no signer keys found")
+	_, err = parseSignature([]byte("garbage"))
+	assert.ErrorContains(t, err, "not an SSH signature")
+}
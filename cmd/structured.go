@@ -0,0 +1,391 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// Structured encryption (encrypt/decrypt --structured) encrypts the values of
+// a YAML, JSON or dotenv file one by one and leaves keys, comments and layout
+// readable, so encrypted configuration still diffs and reviews well:
+//
+//	db:
+//	  host: db.internal            # not selected by --structured-keys
+//	  password: ENC[age:YWdlLWVuY3J5cHRpb24ub3JnL3Yx...]
+//	a_structured: {"version":1,"recipients":["SHA256:..."]}
+//
+// Each value is a complete age file in base64 (the body of age's ASCII armor
+// without line breaks) holding a structuredValue: the value's source text, so
+// decryption splices back the original bytes, quoting and type included, and
+// its path, so a value moved to another key is caught. The trailer records the
+// recipients; in dotenv files it is a comment line.
+
+// Values of --structured.
+const (
+	structuredAuto   = "auto"
+	structuredYAML   = "yaml"
+	structuredJSON   = "json"
+	structuredDotenv = "dotenv"
+)
+
+// An encrypted value is encValuePrefix, the base64 age file, encValueSuffix.
+const (
+	encValuePrefix = "ENC[age:"
+	encValueSuffix = "]"
+)
+
+// structuredTrailerKey names the trailer: a top-level key in YAML and JSON, a
+// "# a_structured: " comment in dotenv files.
+const structuredTrailerKey = "a_structured"
+
+// structuredVersion is the trailer version this build writes and reads.
+const structuredVersion = 1
+
+// structuredTrailer is the metadata added to a structured file. NoFinalNewline
+// records that the original lacked the newline added before the trailer.
+type structuredTrailer struct {
+	Version        int      `json:"version" yaml:"version"`
+	Recipients     []string `json:"recipients" yaml:"recipients"`
+	KeyRegex       string   `json:"key_regex,omitempty" yaml:"key_regex,omitempty"`
+	NoFinalNewline bool     `json:"no_final_newline,omitempty" yaml:"no_final_newline,omitempty"`
+}
+
+// structuredValue is the plaintext of one encrypted value.
+type structuredValue struct {
+	Path string `json:"path"`
+	Raw  string `json:"raw"`
+}
+
+// addStructuredFlag registers --structured on an encrypt or decrypt command;
+// a bare --structured picks the format from the file name.
+func addStructuredFlag(cmd *cobra.Command) {
+	cmd.Flags().String("structured", "",
+		"Encrypt or decrypt each value of a YAML, JSON or dotenv file (yaml|json|dotenv; bare: from the file name)")
+	cmd.Flags().Lookup("structured").NoOptDefVal = structuredAuto
+}
+
+// encryptStructuredOptions reads encrypt's --structured and --structured-keys
+// for input. The format is "" without --structured.
+func encryptStructuredOptions(cmd *cobra.Command, input string) (string, *regexp.Regexp, error) {
+	flag, _ := cmd.Flags().GetString("structured")
+	keys, _ := cmd.Flags().GetString("structured-keys")
+	format, err := structuredFormat(flag, input)
+	if err != nil || format == "" {
+		if err == nil && keys != "" {
+			err = errors.New("--structured-keys needs --structured")
+		}
+		return "", nil, err
+	}
+	for _, other := range []string{"envelope", "verify-decrypt"} {
+		if set, _ := cmd.Flags().GetBool(other); set {
+			return "", nil, fmt.Errorf("--structured cannot be combined with --%s", other)
+		}
+	}
+	if keys == "" {
+		return format, nil, nil
+	}
+	keyRe, err := regexp.Compile(keys)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid --structured-keys: %w", err)
+	}
+	return format, keyRe, nil
+}
+
+// structuredFormat returns the format for --structured=flag and the file at
+// path, or "" when the flag is unset.
+func structuredFormat(flag, path string) (string, error) {
+	switch flag {
+	case "":
+		return "", nil
+	case structuredYAML, structuredJSON, structuredDotenv:
+		return flag, nil
+	case structuredAuto:
+	default:
+		return "", fmt.Errorf("unknown --structured format %q: want yaml, json or dotenv", flag)
+	}
+	base := strings.ToLower(filepath.Base(path))
+	base = strings.TrimSuffix(base, ".enc")
+	switch {
+	case strings.HasSuffix(base, ".yaml"), strings.HasSuffix(base, ".yml"):
+		return structuredYAML, nil
+	case strings.HasSuffix(base, ".json"):
+		return structuredJSON, nil
+	case base == ".env", strings.HasPrefix(base, ".env."), strings.HasSuffix(base, ".env"):
+		return structuredDotenv, nil
+	}
+	return "", fmt.Errorf("cannot tell the format of %s: use --structured=yaml, json or dotenv", path)
+}
+
+// structuredOutput derives encrypt --structured's output name, keeping the
+// extension so editors still recognize the file: values.yaml becomes
+// values.enc.yaml, and .env becomes .env.enc.
+func structuredOutput(input string) string {
+	dir, base := filepath.Split(input)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if ext == "" || stem == "" {
+		return input + ".enc"
+	}
+	return dir + stem + ".enc" + ext
+}
+
+// structuredDecryptOutput reverses structuredOutput; other names get ".dec"
+// as with decryptOutput.
+func structuredDecryptOutput(input string) string {
+	dir, base := filepath.Split(input)
+	if i := strings.LastIndex(base, ".enc."); i > 0 {
+		return dir + base[:i] + base[i+len(".enc"):]
+	}
+	if stem, ok := strings.CutSuffix(base, ".enc"); ok && stem != "" {
+		return dir + stem
+	}
+	return input + ".dec"
+}
+
+// encryptStructured encrypts the values of the format document input, or only
+// those under a key matching keyRe when it is set, and writes the result with
+// its trailer to output.
+func encryptStructured(
+	ctx context.Context,
+	input, output, format string,
+	keyRe *regexp.Regexp,
+	recipients []age.Recipient,
+	opts outputOptions,
+) error {
+	// #nosec G304 -- input path is a validated CLI flag/argument
+	src, err := os.ReadFile(input)
+	if err != nil {
+		return fmt.Errorf("opening input: %w", err)
+	}
+	doc, err := scanStructured(format, src)
+	if err != nil {
+		return err
+	}
+	if doc.trailer != nil {
+		return fmt.Errorf("%s is already encrypted (it has an %s trailer)", input, structuredTrailerKey)
+	}
+
+	var edits []structuredEdit
+	encrypted := make(map[string]bool)
+	for _, sp := range doc.spans {
+		if keyRe != nil && !slices.ContainsFunc(sp.keys, keyRe.MatchString) {
+			continue
+		}
+		enc, err := encryptValue(ctx, structuredValue{Path: sp.path, Raw: string(src[sp.start:sp.end])}, recipients)
+		if err != nil {
+			return fmt.Errorf("encrypting %s: %w", sp.path, err)
+		}
+		if sp.quote {
+			enc = `"` + enc + `"`
+		}
+		edits = append(edits, structuredEdit{sp.start, sp.end, enc})
+		encrypted[sp.path] = true
+	}
+	out := applyEdits(src, edits)
+
+	// Splicing relies on the scanner finding each value's exact source, so
+	// the result is parsed again before anything is written.
+	outDoc, err := scanStructured(format, out)
+	if err != nil {
+		return fmt.Errorf("encrypted document does not parse: %w", err)
+	}
+	if err := checkEncryptedDoc(doc, outDoc, encrypted); err != nil {
+		return err
+	}
+
+	trailer := structuredTrailer{Version: structuredVersion, Recipients: recipientFingerprints(recipients)}
+	if keyRe != nil {
+		trailer.KeyRegex = keyRe.String()
+	}
+	if out, err = appendTrailer(format, out, outDoc, &trailer); err != nil {
+		return err
+	}
+	if withTrailer, err := scanStructured(format, out); err != nil || withTrailer.trailer == nil {
+		return fmt.Errorf("could not add the %s trailer to %s (is the top level indented?)",
+			structuredTrailerKey, input)
+	}
+	return writeFileAtomic(output, out, ".a-encrypt-*", opts)
+}
+
+// checkEncryptedDoc compares the values found in the original and encrypted
+// documents: the same paths, the encrypted ones now ENC[...], the rest
+// unchanged.
+func checkEncryptedDoc(orig, enc *structuredDoc, encrypted map[string]bool) error {
+	if len(orig.spans) != len(enc.spans) {
+		return fmt.Errorf("encrypted document has %d values, the original %d", len(enc.spans), len(orig.spans))
+	}
+	for i, sp := range orig.spans {
+		got := enc.spans[i]
+		switch {
+		case got.path != sp.path:
+			return fmt.Errorf("encrypted document has %s where the original has %s", got.path, sp.path)
+		case encrypted[sp.path] && !isEncValue(got.value):
+			return fmt.Errorf("%s was not replaced by its encrypted value", sp.path)
+		case !encrypted[sp.path] && got.value != sp.value:
+			return fmt.Errorf("%s changed although it was not encrypted", sp.path)
+		}
+	}
+	return nil
+}
+
+// decryptStructured restores the document input encrypted by
+// encryptStructured and writes it to output. It returns the key file whose
+// identity opened the values.
+func decryptStructured(
+	ctx context.Context,
+	input, output, format string,
+	identities []recordingIdentity,
+	opts outputOptions,
+) (string, error) {
+	// #nosec G304 -- input path is a validated CLI flag/argument
+	src, err := os.ReadFile(input)
+	if err != nil {
+		return "", fmt.Errorf("opening input: %w", err)
+	}
+	doc, err := scanStructured(format, src)
+	if err != nil {
+		return "", err
+	}
+	if doc.trailer == nil {
+		return "", fmt.Errorf("%s has no %s trailer: it was not encrypted with --structured",
+			input, structuredTrailerKey)
+	}
+	if doc.trailer.Version > structuredVersion {
+		return "", fmt.Errorf("%s uses structured version %d; this build of a reads up to %d",
+			input, doc.trailer.Version, structuredVersion)
+	}
+	body := slices.Concat(src[:doc.trailerStart], src[doc.trailerEnd:])
+	if doc.trailer.NoFinalNewline {
+		body = bytes.TrimSuffix(body, []byte("\n"))
+	}
+	bodyDoc, err := scanStructured(format, body)
+	if err != nil {
+		return "", err
+	}
+
+	var matched string
+	ids := make([]age.Identity, len(identities))
+	for i, id := range identities {
+		id.matched = &matched
+		ids[i] = id
+	}
+	var edits []structuredEdit
+	for _, sp := range bodyDoc.spans {
+		if !isEncValue(sp.value) {
+			continue
+		}
+		v, err := decryptValue(ctx, sp.value, ids)
+		if err != nil {
+			return "", fmt.Errorf("decrypting %s: %w", sp.path, err)
+		}
+		if v.Path != sp.path {
+			return "", withClass(classTampered,
+				fmt.Errorf("the value at %s was encrypted for %s: values were moved", sp.path, v.Path))
+		}
+		edits = append(edits, structuredEdit{sp.start, sp.end, v.Raw})
+	}
+	if err := writeFileAtomic(output, applyEdits(body, edits), ".a-decrypt-*", opts); err != nil {
+		return "", err
+	}
+	return matched, nil
+}
+
+// isEncValue reports whether a document value is an encrypted value.
+func isEncValue(v string) bool {
+	return strings.HasPrefix(v, encValuePrefix) && strings.HasSuffix(v, encValueSuffix)
+}
+
+// encryptValue encrypts v to recipients and returns it as ENC[age:<base64>].
+func encryptValue(ctx context.Context, v structuredValue, recipients []age.Recipient) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := agewrap.Encrypt(ctx, &buf, bytes.NewReader(payload), recipients); err != nil {
+		return "", err
+	}
+	return encValuePrefix + base64.StdEncoding.EncodeToString(buf.Bytes()) + encValueSuffix, nil
+}
+
+// decryptValue opens an ENC[age:...] value with identities.
+func decryptValue(ctx context.Context, enc string, identities []age.Identity) (structuredValue, error) {
+	b64 := strings.TrimSuffix(strings.TrimPrefix(enc, encValuePrefix), encValueSuffix)
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return structuredValue{}, withClass(classTampered, fmt.Errorf("malformed encrypted value: %w", err))
+	}
+	r, err := agewrap.NewDecryptReader(ctx, bytes.NewReader(data), identities...)
+	if err != nil {
+		return structuredValue{}, err
+	}
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return structuredValue{}, payloadError(err)
+	}
+	var v structuredValue
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return structuredValue{}, withClass(classTampered, fmt.Errorf("malformed encrypted value: %w", err))
+	}
+	return v, nil
+}
+
+// structuredEdit replaces src[start:end] with text.
+type structuredEdit struct {
+	start, end int
+	text       string
+}
+
+// applyEdits applies edits, which are in order and do not overlap, to src.
+func applyEdits(src []byte, edits []structuredEdit) []byte {
+	var out bytes.Buffer
+	pos := 0
+	for _, e := range edits {
+		out.Write(src[pos:e.start])
+		out.WriteString(e.text)
+		pos = e.end
+	}
+	out.Write(src[pos:])
+	return out.Bytes()
+}
+
+// appendTrailer adds t to the format document src, whose scan is doc.
+func appendTrailer(format string, src []byte, doc *structuredDoc, t *structuredTrailer) ([]byte, error) {
+	if format != structuredJSON && len(src) > 0 && src[len(src)-1] != '\n' {
+		src = append(src, '\n')
+		t.NoFinalNewline = true
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case structuredYAML:
+		// JSON is a YAML flow mapping, so one line serves both.
+		return fmt.Appendf(src, "%s: %s\n", structuredTrailerKey, data), nil
+	case structuredDotenv:
+		return fmt.Appendf(src, "# %s: %s\n", structuredTrailerKey, data), nil
+	default:
+		member := fmt.Sprintf("%s%q: %s", doc.trailerPrefix, structuredTrailerKey, data)
+		return slices.Concat(src[:doc.trailerAt], []byte(member), src[doc.trailerAt:]), nil
+	}
+}
+
+// errStructuredRoot is returned for documents whose top level cannot carry the
+// trailer.
+var errStructuredRoot = errors.New("the top level of a structured file must be a mapping (object)")
@@ -0,0 +1,496 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// structuredDoc is what a scanner finds in a document: its scalar values and
+// its trailer.
+type structuredDoc struct {
+	spans []scalarSpan
+
+	// trailer is the parsed trailer, at src[trailerStart:trailerEnd]; nil
+	// when the document has none.
+	trailer                  *structuredTrailer
+	trailerStart, trailerEnd int
+
+	// trailerAt and trailerPrefix say where and after what a trailer is
+	// inserted into a JSON object (the other formats append it).
+	trailerAt     int
+	trailerPrefix string
+}
+
+// scalarSpan is one scalar value: its source text src[start:end], the keys on
+// its path, its path (e.g. db.hosts[0]) and its decoded value. quote means the
+// replacement must be a quoted string: always in JSON, and inside YAML flow
+// collections.
+type scalarSpan struct {
+	start, end int
+	keys       []string
+	path       string
+	value      string
+	quote      bool
+}
+
+// scanStructured finds the values and trailer of a document in format. Null
+// and empty values are left out: there is nothing to encrypt.
+func scanStructured(format string, src []byte) (*structuredDoc, error) {
+	switch format {
+	case structuredYAML:
+		return scanYAML(src)
+	case structuredJSON:
+		return scanJSON(src)
+	default:
+		return scanDotenv(src)
+	}
+}
+
+// scanYAML scans a single YAML document with a block mapping at the top.
+//
+// yaml.v3 reports where each node starts but not where it ends, so the end is
+// found in the source from the node's style. Explicit tags are rejected: an
+// encrypted value could no longer satisfy them. Anchors stay in place, in
+// front of the encrypted value.
+func scanYAML(src []byte) (*structuredDoc, error) {
+	var root yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(src))
+	if err := dec.Decode(&root); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+	var next yaml.Node
+	if err := dec.Decode(&next); !errors.Is(err, io.EOF) {
+		if err != nil {
+			return nil, fmt.Errorf("parsing YAML: %w", err)
+		}
+		return nil, errors.New("multi-document YAML is not supported")
+	}
+
+	doc := &structuredDoc{}
+	if len(root.Content) == 0 {
+		return doc, nil
+	}
+	top := root.Content[0]
+	if top.Kind != yaml.MappingNode || top.Style&yaml.FlowStyle != 0 {
+		return nil, errStructuredRoot
+	}
+	s := &yamlScanner{src: src, lines: lineStarts(src)}
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		k, v := top.Content[i], top.Content[i+1]
+		if k.Value == structuredTrailerKey {
+			if i+2 != len(top.Content) {
+				return nil, fmt.Errorf("the %s trailer must be the last key", structuredTrailerKey)
+			}
+			doc.trailer = &structuredTrailer{}
+			if err := v.Decode(doc.trailer); err != nil {
+				return nil, fmt.Errorf("parsing the %s trailer: %w", structuredTrailerKey, err)
+			}
+			doc.trailerStart, doc.trailerEnd = s.offset(k.Line, 1), len(src)
+			break
+		}
+		if err := s.walk(v, []string{k.Value}, k.Value, k.Column-1, false); err != nil {
+			return nil, err
+		}
+	}
+	doc.spans = s.spans
+	return doc, nil
+}
+
+// yamlScanner collects the scalar spans of a YAML document.
+type yamlScanner struct {
+	src   []byte
+	lines []int // byte offset of each line's start
+	spans []scalarSpan
+}
+
+// walk visits n at path. indent is the indentation of the key or sequence
+// owning n, which bounds the continuation lines of multi-line scalars.
+func (s *yamlScanner) walk(n *yaml.Node, keys []string, path string, indent int, flow bool) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		flow = flow || n.Style&yaml.FlowStyle != 0
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			childKeys := slices.Concat(keys, []string{k.Value})
+			if err := s.walk(v, childKeys, path+"."+k.Value, k.Column-1, flow); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		flow = flow || n.Style&yaml.FlowStyle != 0
+		for i, item := range n.Content {
+			if err := s.walk(item, keys, fmt.Sprintf("%s[%d]", path, i), n.Column-1, flow); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return nil
+		}
+		if n.Style&yaml.TaggedStyle != 0 {
+			return fmt.Errorf("%s: values with explicit tags are not supported", path)
+		}
+		start, end, err := s.scalarBounds(n, indent, flow)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		s.spans = append(s.spans, scalarSpan{
+			start: start, end: end, keys: keys, path: path, value: n.Value, quote: flow,
+		})
+	}
+	// Aliases point at a value encrypted where it is defined.
+	return nil
+}
+
+// scalarBounds returns the source span of the scalar n, after any anchor.
+func (s *yamlScanner) scalarBounds(n *yaml.Node, indent int, flow bool) (start, end int, err error) {
+	src := s.src
+	start = s.offset(n.Line, n.Column)
+	if n.Anchor != "" && start < len(src) && src[start] == '&' {
+		for start < len(src) && !isYAMLSpace(src[start]) {
+			start++
+		}
+		for start < len(src) && (isYAMLSpace(src[start]) || src[start] == '\n') {
+			start++
+		}
+	}
+
+	switch {
+	case n.Style&yaml.DoubleQuotedStyle != 0:
+		for i := start + 1; i < len(src); i++ {
+			switch src[i] {
+			case '\\':
+				i++
+			case '"':
+				return start, i + 1, nil
+			}
+		}
+		return 0, 0, errors.New("unterminated double-quoted string")
+	case n.Style&yaml.SingleQuotedStyle != 0:
+		for i := start + 1; i < len(src); i++ {
+			if src[i] != '\'' {
+				continue
+			}
+			if i+1 < len(src) && src[i+1] == '\'' {
+				i++
+				continue
+			}
+			return start, i + 1, nil
+		}
+		return 0, 0, errors.New("unterminated single-quoted string")
+	case n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0:
+		// The header line, then every blank or more-indented line; trailing
+		// blank lines stay outside.
+		return start, s.continuation(start, lineEnd(src, start), indent, false), nil
+	case flow:
+		end = start
+		for end < len(src) && !strings.ContainsRune(",]}\n", rune(src[end])) && !isComment(src, end) {
+			end++
+		}
+		return start, trimRightSpace(src, start, end), nil
+	default:
+		return start, s.continuation(start, commentCut(src, start), indent, true), nil
+	}
+}
+
+// continuation extends a scalar ending at end over the following lines that
+// are indented past indent. For plain scalars, comment lines end the scalar
+// and trailing comments are cut.
+func (s *yamlScanner) continuation(start, end, indent int, plain bool) int {
+	src := s.src
+	for pos := lineEnd(src, start) + 1; pos < len(src); pos = lineEnd(src, pos) + 1 {
+		content := pos
+		for content < len(src) && src[content] == ' ' {
+			content++
+		}
+		eol := lineEnd(src, pos)
+		if len(bytes.TrimSpace(src[content:eol])) == 0 {
+			continue
+		}
+		if content-pos <= indent || (plain && src[content] == '#') {
+			break
+		}
+		if plain {
+			end = commentCut(src, content)
+		} else {
+			end = trimRightSpace(src, content, eol)
+		}
+	}
+	return end
+}
+
+// offset converts a 1-based line and column (in characters) to a byte offset.
+func (s *yamlScanner) offset(line, column int) int {
+	i := s.lines[line-1]
+	for c := 1; c < column && i < len(s.src); c++ {
+		_, size := utf8.DecodeRune(s.src[i:])
+		i += size
+	}
+	return i
+}
+
+// lineStarts returns the byte offset at which each line of src starts.
+func lineStarts(src []byte) []int {
+	starts := []int{0}
+	for i, c := range src {
+		if c == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+// lineEnd returns the offset of the newline ending the line holding pos, or
+// len(src).
+func lineEnd(src []byte, pos int) int {
+	if i := bytes.IndexByte(src[pos:], '\n'); i >= 0 {
+		return pos + i
+	}
+	return len(src)
+}
+
+// commentCut returns where the plain value starting at start ends on its
+// line: before a " #" comment and trailing space.
+func commentCut(src []byte, start int) int {
+	end := start
+	for eol := lineEnd(src, start); end < eol && !isComment(src, end); end++ {
+	}
+	return trimRightSpace(src, start, end)
+}
+
+// isComment reports whether a comment starts at src[i]: a # after a space.
+func isComment(src []byte, i int) bool {
+	return src[i] == '#' && i > 0 && isYAMLSpace(src[i-1])
+}
+
+// trimRightSpace moves end back over spaces, tabs and carriage returns.
+func trimRightSpace(src []byte, start, end int) int {
+	for end > start && (isYAMLSpace(src[end-1]) || src[end-1] == '\r') {
+		end--
+	}
+	return end
+}
+
+func isYAMLSpace(c byte) bool { return c == ' ' || c == '\t' }
+
+// jsonFrame is an open JSON object or array while scanning.
+type jsonFrame struct {
+	object  bool
+	wantKey bool
+	key     string
+	index   int
+	members int
+	keys    []string
+	path    string
+	trailer bool // inside the trailer, whose values are not spans
+}
+
+// scanJSON scans a JSON document with an object at the top. Token offsets
+// come from json.Decoder.InputOffset; a token starts at the first byte after
+// the previous one that is not whitespace, ':' or ','.
+func scanJSON(src []byte) (*structuredDoc, error) {
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.UseNumber()
+	doc := &structuredDoc{}
+	var stack []*jsonFrame
+	var firstKeyStart, openEnd int
+	closed := false
+
+	for {
+		prevEnd := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing JSON: %w", err)
+		}
+		if closed {
+			return nil, errors.New("parsing JSON: more than one top-level value")
+		}
+		start := prevEnd
+		for start < len(src) && strings.IndexByte(" \t\r\n:,", src[start]) >= 0 {
+			start++
+		}
+		end := int(dec.InputOffset())
+
+		if len(stack) == 0 {
+			if tok != json.Delim('{') {
+				return nil, errStructuredRoot
+			}
+			stack = append(stack, &jsonFrame{object: true, wantKey: true})
+			openEnd = end
+			continue
+		}
+		top := stack[len(stack)-1]
+		if top.object && top.wantKey && tok != json.Delim('}') {
+			key, _ := tok.(string)
+			top.key, top.wantKey = key, false
+			if len(stack) == 1 {
+				if top.members == 0 {
+					firstKeyStart = start
+				}
+				if doc.trailer != nil {
+					return nil, fmt.Errorf("the %s trailer must be the last key", structuredTrailerKey)
+				}
+				if key == structuredTrailerKey {
+					doc.trailer, doc.trailerStart = &structuredTrailer{}, prevEnd
+				}
+			}
+			continue
+		}
+
+		keys, path := top.keys, top.path
+		if top.object {
+			keys = slices.Concat(keys, []string{top.key})
+			path = strings.TrimPrefix(path+"."+top.key, ".")
+		} else {
+			path = fmt.Sprintf("%s[%d]", path, top.index)
+		}
+		inTrailer := top.trailer || (len(stack) == 1 && doc.trailer != nil && doc.trailerEnd == 0)
+
+		switch t := tok.(type) {
+		case json.Delim:
+			if t == '{' || t == '[' {
+				stack = append(stack, &jsonFrame{object: t == '{', wantKey: t == '{', keys: keys, path: path,
+					trailer: inTrailer})
+				if inTrailer && len(stack) == 2 {
+					if err := json.Unmarshal(valueAt(src, start), doc.trailer); err != nil {
+						return nil, fmt.Errorf("parsing the %s trailer: %w", structuredTrailerKey, err)
+					}
+				}
+				continue
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				closed = true
+				doc.trailerAt = prevEnd
+				if top.members > 0 {
+					doc.trailerPrefix = "," + string(src[openEnd:firstKeyStart])
+				}
+				continue
+			}
+			top = stack[len(stack)-1]
+		default:
+			if inTrailer && len(stack) == 1 {
+				return nil, fmt.Errorf("the %s trailer must be an object", structuredTrailerKey)
+			}
+			if t != nil && !inTrailer {
+				value := fmt.Sprint(t)
+				if s, ok := t.(string); ok {
+					value = s
+				}
+				doc.spans = append(doc.spans, scalarSpan{
+					start: start, end: end, keys: keys, path: path, value: value, quote: true,
+				})
+			}
+		}
+		// A value of top is complete.
+		if top.object {
+			top.wantKey = true
+			top.members++
+		} else {
+			top.index++
+		}
+		if len(stack) == 1 && doc.trailer != nil && doc.trailerEnd == 0 {
+			doc.trailerEnd = end
+		}
+	}
+	if !closed {
+		return nil, errors.New("parsing JSON: empty document")
+	}
+	return doc, nil
+}
+
+// valueAt returns the JSON value starting at src[start].
+func valueAt(src []byte, start int) json.RawMessage {
+	var raw json.RawMessage
+	if err := json.NewDecoder(bytes.NewReader(src[start:])).Decode(&raw); err != nil {
+		return nil
+	}
+	return raw
+}
+
+// dotenvTrailerPrefix starts the trailer comment of a dotenv file.
+const dotenvTrailerPrefix = "# " + structuredTrailerKey + ": "
+
+// scanDotenv scans KEY=VALUE lines, optionally prefixed with "export".
+// Single- and double-quoted values may span lines; an unquoted value ends
+// before a " #" comment.
+func scanDotenv(src []byte) (*structuredDoc, error) {
+	doc := &structuredDoc{}
+	for pos, n := 0, 1; pos < len(src); n++ {
+		eol := lineEnd(src, pos)
+		indent := pos
+		for indent < eol && isYAMLSpace(src[indent]) {
+			indent++
+		}
+		line := string(src[indent:eol])
+		next := eol + 1
+
+		switch {
+		case strings.HasPrefix(line, dotenvTrailerPrefix):
+			if len(bytes.TrimSpace(src[eol:])) != 0 {
+				return nil, fmt.Errorf("line %d: the %s trailer must be the last line", n, structuredTrailerKey)
+			}
+			doc.trailer = &structuredTrailer{}
+			if err := json.Unmarshal([]byte(line[len(dotenvTrailerPrefix):]), doc.trailer); err != nil {
+				return nil, fmt.Errorf("line %d: parsing the %s trailer: %w", n, structuredTrailerKey, err)
+			}
+			doc.trailerStart, doc.trailerEnd = pos, len(src)
+		case strings.TrimSpace(line) == "", strings.HasPrefix(line, "#"):
+		default:
+			rest := strings.TrimPrefix(line, "export ")
+			eq := strings.IndexByte(rest, '=')
+			if eq <= 0 {
+				return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+			}
+			key := strings.TrimSpace(rest[:eq])
+			start := indent + len(line) - len(rest) + eq + 1
+			for start < eol && isYAMLSpace(src[start]) {
+				start++
+			}
+			end, value, err := dotenvValue(src, start, eol)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			if end > start {
+				doc.spans = append(doc.spans, scalarSpan{start: start, end: end, keys: []string{key}, path: key,
+					value: value})
+			}
+			next = lineEnd(src, end) + 1
+			n += bytes.Count(src[start:end], []byte("\n"))
+		}
+		pos = next
+	}
+	return doc, nil
+}
+
+// dotenvValue returns the end and the unquoted text of the value starting at
+// src[start]; eol ends its first line.
+func dotenvValue(src []byte, start, eol int) (int, string, error) {
+	if start == eol {
+		return start, "", nil
+	}
+	if q := src[start]; q == '"' || q == '\'' {
+		for i := start + 1; i < len(src); i++ {
+			switch {
+			case q == '"' && src[i] == '\\':
+				i++
+			case src[i] == q:
+				return i + 1, string(src[start+1 : i]), nil
+			}
+		}
+		return 0, "", fmt.Errorf("unterminated %c-quoted value", q)
+	}
+	end := commentCut(src, start)
+	return end, string(src[start:end]), nil
+}
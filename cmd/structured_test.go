@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// structuredRoundTrip encrypts name with contents using encrypt --structured
+// plus extra, decrypts the result, and returns the encrypted text.
+func structuredRoundTrip(t *testing.T, name, contents string, extra ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(in, []byte(contents), 0o600))
+
+	args := append([]string{"encrypt", "--structured", in, "-r", pub}, extra...)
+	_, err := runRoot(t, Encrypt(&Config{}, discardLogger()), args...)
+	require.NoError(t, err)
+	enc := structuredOutput(in)
+	encrypted, err := os.ReadFile(enc) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+
+	out := filepath.Join(dir, "restored")
+	_, err = runRoot(t, Decrypt(&Config{}, discardLogger()),
+		"decrypt", "--structured", enc, "-o", out, "--ssh-key", priv)
+	require.NoError(t, err)
+	restored, err := os.ReadFile(out) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	assert.Equal(t, contents, string(restored))
+	return string(encrypted)
+}
+
+func TestStructured_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		visible  []string
+		hidden   []string
+	}{
+		{
+			name: "yaml",
+			file: "values.yaml",
+			contents: `# database settings
+db:
+  password: "s3cret"   # rotate monthly
+  port: 5432
+  hosts: [a.example, 'b.example']
+  script: |
+    echo one
+    echo two
+  folded: >-
+    long
+    text
+empty:
+anchor: &pw hunter2
+alias: *pw
+`,
+			visible: []string{"# database settings", "# rotate monthly", "empty:\n", "alias: *pw", "&pw ENC[age:"},
+			hidden:  []string{"s3cret", "port: 5432", "b.example", "echo one", "hunter2", "long\n"},
+		},
+		{
+			name:     "yaml without final newline",
+			file:     "app.yml",
+			contents: "user: admin\npass: 'it''s'",
+			visible:  []string{"user: ENC[age:"},
+			hidden:   []string{"admin", "it''s"},
+		},
+		{
+			name: "json",
+			file: "config.json",
+			contents: "{\n  \"token\": \"abc\",\n" +
+				"  \"limits\": {\"max\": 10, \"tags\": [\"x\", true, null]},\n  \"e\": {}\n}\n",
+			visible: []string{`"limits": {"max": "ENC[age:`, `null]`, `"e": {}`},
+			hidden:  []string{`"abc"`, `"max": 10`, `"x"`, `true,`},
+		},
+		{
+			name:     "json one line",
+			file:     "c.json",
+			contents: `{"a":"é\n"}`,
+			visible:  []string{`{"a":"ENC[age:`},
+			hidden:   []string{`é`},
+		},
+		{
+			name:     "dotenv",
+			file:     ".env",
+			contents: "# service\nexport API_KEY=abc123\nQUOTED=\"multi\nline\" # note\nEMPTY=\n\nSINGLE='x y'\n",
+			visible:  []string{"# service", "export API_KEY=ENC[age:", "# note", "EMPTY=\n"},
+			hidden:   []string{"abc123", "multi", "x y"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := structuredRoundTrip(t, tt.file, tt.contents)
+			assert.Contains(t, enc, structuredTrailerKey)
+			for _, s := range tt.visible {
+				assert.Contains(t, enc, s)
+			}
+			for _, s := range tt.hidden {
+				assert.NotContains(t, enc, s)
+			}
+		})
+	}
+}
+
+func TestStructured_KeyRegex(t *testing.T) {
+	enc := structuredRoundTrip(t, "values.yaml",
+		"image: nginx\ndb:\n  password: s3cret\n  user: app\napi_token: t0k\n",
+		"--structured-keys", `(?i)password|token`)
+	assert.Contains(t, enc, "image: nginx\n")
+	assert.Contains(t, enc, "user: app\n")
+	assert.NotContains(t, enc, "s3cret")
+	assert.NotContains(t, enc, "t0k")
+	assert.Contains(t, enc, `"key_regex":"(?i)password|token"`)
+}
+
+// Swapping two encrypted values keeps each one decryptable, so the path bound
+// into every value is what catches it.
+func TestStructured_MovedValue(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	in := filepath.Join(dir, "values.yaml")
+	require.NoError(t, os.WriteFile(in, []byte("admin: alice\nguest: bob\n"), 0o600))
+	_, err := runRoot(t, Encrypt(&Config{}, discardLogger()), "encrypt", "--structured", in, "-r", pub)
+	require.NoError(t, err)
+
+	enc := filepath.Join(dir, "values.enc.yaml")
+	data, err := os.ReadFile(enc) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	values := regexp.MustCompile(`ENC\[age:[^\]]*\]`).FindAllString(string(data), -1)
+	require.Len(t, values, 2)
+	swapped := strings.NewReplacer(values[0], values[1], values[1], values[0]).Replace(string(data))
+	require.NoError(t, os.WriteFile(enc, []byte(swapped), 0o600))
+
+	out := filepath.Join(dir, "out.yaml")
+	_, err = runRoot(t, Decrypt(&Config{}, discardLogger()),
+		"decrypt", "--structured", enc, "-o", out, "--ssh-key", priv)
+	require.ErrorContains(t, err, "values were moved")
+	assert.Equal(t, ExitTampered, ExitCode(err))
+	assert.NoFileExists(t, out)
+
+	otherPriv, _ := makeSSHKey(t, t.TempDir())
+	require.NoError(t, os.WriteFile(enc, data, 0o600))
+	_, err = runRoot(t, Decrypt(&Config{}, discardLogger()),
+		"decrypt", "--structured", enc, "-o", out, "--ssh-key", otherPriv)
+	assert.Equal(t, ExitNoMatchingKey, ExitCode(err))
+}
+
+func TestStructured_Errors(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := makeSSHKey(t, dir)
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		return path
+	}
+	encrypt := func(args ...string) error {
+		_, err := runRoot(t, Encrypt(&Config{}, discardLogger()), append([]string{"encrypt", "-r", pub}, args...)...)
+		return err
+	}
+
+	plain := write("plain.yaml", "a: b\n")
+	require.NoError(t, encrypt("--structured", plain))
+	assert.ErrorContains(t, encrypt("--structured", filepath.Join(dir, "plain.enc.yaml"), "-o",
+		filepath.Join(dir, "twice.yaml")), "already encrypted")
+
+	assert.ErrorContains(t, encrypt("--structured", write("tag.yaml", "a: !!binary aGk=\n")), "explicit tags")
+	assert.ErrorContains(t, encrypt("--structured", write("list.json", "[1]")), "must be a mapping")
+	assert.ErrorContains(t, encrypt("--structured", write("notes.txt", "x")), "cannot tell the format")
+	assert.ErrorContains(t, encrypt("--structured=toml", plain), "unknown --structured format")
+	assert.ErrorContains(t, encrypt("--structured-keys", "x", plain), "needs --structured")
+	assert.ErrorContains(t, encrypt("--structured", "--structured-keys", "(", plain), "invalid --structured-keys")
+	assert.ErrorContains(t, encrypt("--structured", "--envelope", plain), "cannot be combined")
+
+	_, err := runRoot(t, Decrypt(&Config{}, discardLogger()), "decrypt", "--structured", plain)
+	assert.ErrorContains(t, err, "no a_structured trailer")
+}
+
+func TestStructuredNames(t *testing.T) {
+	tests := []struct {
+		input, encrypted, format string
+	}{
+		{"values.yaml", "values.enc.yaml", structuredYAML},
+		{"dir/app.yml", "dir/app.enc.yml", structuredYAML},
+		{"package.json", "package.enc.json", structuredJSON},
+		{".env", ".env.enc", structuredDotenv},
+		{".env.production", ".env.enc.production", structuredDotenv},
+		{"prod.env", "prod.enc.env", structuredDotenv},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.encrypted, structuredOutput(tt.input), tt.input)
+		assert.Equal(t, tt.input, structuredDecryptOutput(tt.encrypted), tt.encrypted)
+		for _, name := range []string{tt.input, tt.encrypted} {
+			format, err := structuredFormat(structuredAuto, name)
+			require.NoError(t, err, name)
+			assert.Equal(t, tt.format, format, name)
+		}
+	}
+	assert.Equal(t, "secrets.dec", structuredDecryptOutput("secrets"))
+	format, err := structuredFormat(structuredJSON, "notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, structuredJSON, format)
+}
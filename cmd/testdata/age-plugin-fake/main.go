@@ -0,0 +1,49 @@
+// Command age-plugin-fake is a test-only age plugin, built by the cmd tests.
+//
+// Its recipient and identity data wrap a native X25519 recipient and identity,
+// and every unwrap first asks the client for a PIN ("1234") through the plugin
+// protocol's request-secret interaction, exercising the interactive path.
+package main
+
+import (
+	"errors"
+	"os"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+)
+
+// pinIdentity gates an X25519 identity behind a PIN prompt.
+type pinIdentity struct {
+	p  *plugin.Plugin
+	id *age.X25519Identity
+}
+
+func (i *pinIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	pin, err := i.p.RequestValue("Enter PIN for fake token", true)
+	if err != nil {
+		return nil, err
+	}
+	if pin != "1234" {
+		return nil, errors.New("wrong PIN")
+	}
+	return i.id.Unwrap(stanzas)
+}
+
+func main() {
+	p, err := plugin.New("fake")
+	if err != nil {
+		os.Exit(1)
+	}
+	p.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		return age.ParseX25519Recipient(string(data))
+	})
+	p.HandleIdentity(func(data []byte) (age.Identity, error) {
+		id, err := age.ParseX25519Identity(string(data))
+		if err != nil {
+			return nil, err
+		}
+		return &pinIdentity{p: p, id: id}, nil
+	})
+	os.Exit(p.Main())
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// Verification outcomes reported per file.
+const (
+	verifyOK         = "ok"
+	verifyNoMatch    = "no-match"   // none of the identities is a recipient
+	verifyCorrupt    = "corrupt"    // a recipient matched, but the header or payload is truncated or tampered
+	verifyUnreadable = "unreadable" // missing, unreadable, or not an age file
+)
+
+// verifyResult is the outcome of verifying one file.
+type verifyResult struct {
+	File     string `json:"file"`
+	Status   string `json:"status"`
+	Identity string `json:"identity,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// recordingIdentity reports which key file's identity unwrapped the file key,
+// so one pass over the file can both check it and name the matching key.
+type recordingIdentity struct {
+	age.Identity
+	path    string
+	matched *string
+}
+
+// Unwrap implements age.Identity.
+func (r recordingIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	key, err := r.Identity.Unwrap(stanzas)
+	if err == nil {
+		*r.matched = r.path
+	}
+	return key, err
+}
+
+// Verify returns a cobra.Command that checks age files decrypt completely with
+// the available identities, without writing any plaintext.
+func Verify(cfg *Config, log *slog.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify <file>...",
+		Short: "Check that files decrypt with your keys, without writing plaintext",
+		Long: `Decrypt each file into nothing, authenticating every chunk, and report the
+key that matched. Keys are found as for decrypt (--identity, identity_files,
+--ssh-key, ssh_key_path or a ~/.ssh scan, and --agent).
+
+The exit status is 0 only when every file verified, so a cron job can alert on
+anything else, with the status for no-match, corrupt or unreadable when every
+failure is of that kind. --json (or --output-format json) prints a JSON array
+with one result per file.`,
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keys, _, err := decryptKeys(cmd, cfg, log)
+			if err != nil {
+				return err
+			}
+			identities := loadVerifyIdentities(keys, log)
+			if len(identities) == 0 {
+				return fmt.Errorf("no usable keys to verify with")
+			}
+
+			ctx := commandContext(cmd)
+			results := make([]verifyResult, 0, len(args))
+			for _, file := range args {
+				res := checkAgeFile(ctx, file, identities)
+				// An interrupted check says nothing about the file.
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				results = append(results, res)
+			}
+			asJSON, err := jsonOutput(cmd)
+			if err != nil {
+				return err
+			}
+			if jsonFlag, _ := cmd.Flags().GetBool("json"); asJSON || jsonFlag {
+				err = printVerifyJSON(cmd.OutOrStdout(), results)
+			} else {
+				err = printVerifyText(cmd.OutOrStdout(), results)
+			}
+			if err != nil {
+				return err
+			}
+
+			return verifyError(results)
+		},
+	}
+	cmd.Flags().String("ssh-key", "", "SSH private key to verify with")
+	cmd.Flags().StringSlice("identity", nil,
+		"age identity file (native or plugin identities); replaces identity_files from the config")
+	cmd.Flags().Bool("agent", false, "Also try the key files of keys loaded in ssh-agent (SSH_AUTH_SOCK)")
+	cmd.Flags().Bool("json", false, "Print results as JSON")
+	return cmd
+}
+
+// loadVerifyIdentities parses every key file, skipping unusable ones with a
+// warning, and wraps each identity to record its key file on a match.
+func loadVerifyIdentities(keys []string, log *slog.Logger) []recordingIdentity {
+	var identities []recordingIdentity
+	for _, keyPath := range keys {
+		parsed, err := parseIdentityFile(keyPath)
+		if err != nil {
+			log.Warn("Skipping key", "key", keyPath, "error", err)
+			continue
+		}
+		for _, id := range parsed {
+			identities = append(identities, recordingIdentity{Identity: id, path: keyPath})
+		}
+	}
+	return identities
+}
+
+// checkAgeFile decrypts file into io.Discard. Reading to the end matters: age
+// authenticates each 64 KiB chunk as it is read and detects truncation only at
+// the end of the stream.
+func checkAgeFile(ctx context.Context, file string, identities []recordingIdentity) verifyResult {
+	res := verifyResult{File: file}
+	var matched string
+	ids := make([]age.Identity, len(identities))
+	for i, id := range identities {
+		id.matched = &matched
+		ids[i] = id
+	}
+
+	// #nosec G304 -- file is a CLI argument
+	f, err := os.Open(file)
+	if err != nil {
+		res.Status, res.Error = verifyUnreadable, err.Error()
+		return res
+	}
+	defer func() { _ = f.Close() }()
+
+	r, err := agewrap.NewDecryptReader(ctx, f, ids...)
+	if _, ok := errors.AsType[*age.NoIdentityMatchError](err); ok {
+		res.Status, res.Error = verifyNoMatch, err.Error()
+		return res
+	}
+	if errors.Is(err, agewrap.ErrHeaderMAC) {
+		res.Identity = matched
+		res.Status, res.Error = verifyCorrupt, err.Error()
+		return res
+	}
+	if err != nil {
+		res.Status, res.Error = verifyUnreadable, err.Error()
+		return res
+	}
+	res.Identity = matched
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		res.Status, res.Error = verifyCorrupt, err.Error()
+		return res
+	}
+	res.Status = verifyOK
+	return res
+}
+
+// verifyClasses maps failed statuses to their error classes.
+var verifyClasses = map[string]errorClass{
+	verifyNoMatch:    classNoMatchingKey,
+	verifyCorrupt:    classTampered,
+	verifyUnreadable: classIO,
+}
+
+// verifyError summarizes the failures in results, or returns nil when every
+// file verified. When all failures share a status the error carries its class,
+// so the exit status names the problem; a mix is a plain failure.
+func verifyError(results []verifyResult) error {
+	failed := 0
+	class := classFailure
+	for _, r := range results {
+		if r.Status == verifyOK {
+			continue
+		}
+		if failed == 0 {
+			class = verifyClasses[r.Status]
+		} else if verifyClasses[r.Status] != class {
+			class = classFailure
+		}
+		failed++
+	}
+	if failed == 0 {
+		return nil
+	}
+	return withClass(class, fmt.Errorf("%d of %d files failed verification", failed, len(results)))
+}
+
+// printVerifyText prints one line per result.
+func printVerifyText(w io.Writer, results []verifyResult) error {
+	for _, r := range results {
+		var err error
+		if r.Status == verifyOK {
+			_, err = fmt.Fprintf(w, "OK\t%s\t(%s)\n", r.File, r.Identity)
+		} else {
+			_, err = fmt.Fprintf(w, "FAIL\t%s\t%s: %s\n", r.File, r.Status, r.Error)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printVerifyJSON prints the results as a JSON array.
+func printVerifyJSON(w io.Writer, results []verifyResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
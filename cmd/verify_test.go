@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runVerify runs verify with the SSH key priv and args, returning stdout.
+func runVerify(t *testing.T, priv string, args ...string) (string, error) {
+	t.Helper()
+	c := Verify(&Config{}, discardLogger())
+	var out bytes.Buffer
+	c.SetOut(&out)
+	c.SetErr(&bytes.Buffer{})
+	c.SetArgs(append([]string{"--ssh-key", priv}, args...))
+	err := c.Execute()
+	return out.String(), err
+}
+
+func TestVerifyCmd(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := makeSSHKey(t, dir)
+	recips, err := resolveRefs(t, []string{pub}, discardLogger())
+	require.NoError(t, err)
+	plain := filepath.Join(dir, "backup.tar")
+	require.NoError(t, os.WriteFile(plain, bytes.Repeat([]byte("archive "), 20000), 0o600))
+	good := filepath.Join(dir, "good.age")
+	require.NoError(t, encryptFile(context.Background(), plain, good, recips, outputOptions{}))
+
+	out, err := runVerify(t, priv, good)
+	require.NoError(t, err)
+	assert.Equal(t, "OK\t"+good+"\t("+priv+")\n", out)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 4, "no plaintext is written")
+
+	data, err := os.ReadFile(good) // #nosec G304 -- test temp path
+	require.NoError(t, err)
+	truncated := filepath.Join(dir, "truncated.age")
+	require.NoError(t, os.WriteFile(truncated, data[:len(data)-100], 0o600))
+	tampered := filepath.Join(dir, "tampered.age")
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)-10] ^= 1
+	require.NoError(t, os.WriteFile(tampered, flipped, 0o600))
+	header := filepath.Join(dir, "header.age")
+	require.NoError(t, os.WriteFile(header, data, 0o600))
+	flipHeaderMAC(t, header)
+	otherPriv, otherPub := makeSSHKey(t, t.TempDir())
+	otherRecips, err := resolveRefs(t, []string{otherPub}, discardLogger())
+	require.NoError(t, err)
+	foreign := filepath.Join(dir, "foreign.age")
+	require.NoError(t, encryptFile(context.Background(), plain, foreign, otherRecips, outputOptions{}))
+
+	out, err = runVerify(t, priv, "--json",
+		good, truncated, tampered, header, foreign, plain, filepath.Join(dir, "missing"))
+	assert.ErrorContains(t, err, "6 of 7 files failed verification")
+	var results []verifyResult
+	require.NoError(t, json.Unmarshal([]byte(out), &results))
+	statuses := make([]string, 0, len(results))
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	assert.Equal(t, []string{
+		verifyOK, verifyCorrupt, verifyCorrupt, verifyCorrupt, verifyNoMatch, verifyUnreadable, verifyUnreadable,
+	}, statuses)
+	assert.Equal(t, priv, results[1].Identity, "the matching key is reported even for a corrupt file")
+	assert.Contains(t, results[3].Error, "bad header MAC")
+
+	// A forged header alone is tampering, like a corrupt payload.
+	_, err = runVerify(t, priv, header, tampered)
+	assert.Equal(t, ExitTampered, ExitCode(err))
+
+	out, err = runVerify(t, otherPriv, foreign, good)
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(out, "OK\t"+foreign), out)
+	assert.Contains(t, out, "FAIL\t"+good+"\tno-match")
+}
+
+func TestVerifyCmd_NoKeys(t *testing.T) {
+	bad := filepath.Join(t.TempDir(), "bad")
+	require.NoError(t, os.WriteFile(bad, []byte("not a key"), 0o600))
+	_, err := runVerify(t, bad, "x.age")
+	assert.ErrorContains(t, err, "no usable keys")
+}
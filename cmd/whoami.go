@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// ownRecipient is a recipient derived from one of the user's own key files.
+type ownRecipient struct {
+	recipient   string
+	source      string
+	fingerprint string        // SHA256 fingerprint, set for SSH keys only
+	sshKey      ssh.PublicKey // nil for native age recipients
+}
+
+// Whoami returns a cobra.Command that prints the recipients of the user's own
+// keys, so they can tell others what to encrypt to. extra is added to the
+// agewrap options GitHub keys are fetched with (see resolverOptions).
+func Whoami(cfg *Config, log *slog.Logger, extra ...agewrap.Option) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "whoami",
+		Aliases: []string{"recipients"},
+		Short:   "Print the recipients of your own keys and check them against GitHub",
+		Long: `Print the public recipient of every configured identity file, the
+configured SSH key and the id_* keys in ~/.ssh. The output is a valid
+recipients file: each recipient is preceded by a comment naming its key file
+and fingerprint. SSH keys are checked against github.com/<github_user>.keys,
+and keys published on GitHub that match no local key are reported as stale.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			own, err := ownRecipients(cfg, log)
+			if err != nil {
+				return err
+			}
+			ghUser, _ := cmd.Flags().GetString("github-user")
+			if ghUser == "" {
+				ghUser = cfg.GitHubUser
+			}
+			if offline, _ := cmd.Flags().GetBool("offline"); offline {
+				ghUser = ""
+			}
+			if ghUser != "" && !agewrap.ValidGitHubUser(ghUser) {
+				return fmt.Errorf("invalid GitHub username %q", ghUser)
+			}
+			out, errOut := cmd.OutOrStdout(), cmd.ErrOrStderr()
+			return printOwnRecipients(commandContext(cmd), out, errOut, cfg, own, ghUser, log, extra)
+		},
+	}
+	cmd.Flags().String("github-user", "", "GitHub user whose .keys listing to check (default: github_user from config)")
+	cmd.Flags().Bool("offline", false, "Skip the GitHub check")
+	return cmd
+}
+
+// ownKeyFiles lists the user's key files: the configured identity files, the
+// configured SSH key and every id_* key in ~/.ssh, without duplicates.
+func ownKeyFiles(cfg *Config, log *slog.Logger) []string {
+	keys := slices.Clone(cfg.IdentityFiles)
+	if cfg.SSHKeyPath != "" {
+		keys = append(keys, cfg.SSHKeyPath)
+	}
+	scanned, err := ScanSSHPrivateKeys()
+	if err != nil {
+		log.Debug("Could not scan ~/.ssh for private keys", "error", err)
+	}
+	for _, k := range scanned {
+		if !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// ownRecipients derives a recipient from each of the user's key files. Keys
+// whose recipient cannot be derived (plugin identities, unreadable files) are
+// skipped with a warning; having none at all is an error.
+func ownRecipients(cfg *Config, log *slog.Logger) ([]ownRecipient, error) {
+	var own []ownRecipient
+	for _, keyPath := range ownKeyFiles(cfg, log) {
+		recipients, err := identityRecipients(keyPath)
+		if err != nil {
+			log.Warn("Skipping key", "path", keyPath, "error", err)
+			continue
+		}
+		for _, r := range recipients {
+			o := ownRecipient{recipient: r, source: keyPath}
+			if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r)); err == nil {
+				o.sshKey = pub
+				o.fingerprint = ssh.FingerprintSHA256(pub)
+			}
+			own = append(own, o)
+		}
+	}
+	if len(own) == 0 {
+		return nil, fmt.Errorf("no keys found: set ssh_key_path or identity_files, or create one with `a keygen`")
+	}
+	return own, nil
+}
+
+// printOwnRecipients writes own to out as a commented recipients file. With a
+// GitHub user, each SSH key is marked as published or not, and keys GitHub
+// lists that match no local key are reported on errOut as likely stale. The
+// listing is fetched fresh, bypassing the key cache, since the point is to see
+// what GitHub serves right now, with extra passed on to fetchGitHubKeys.
+func printOwnRecipients(
+	ctx context.Context,
+	out, errOut io.Writer,
+	cfg *Config,
+	own []ownRecipient,
+	ghUser string,
+	log *slog.Logger,
+	extra []agewrap.Option,
+) error {
+	var published []ssh.PublicKey
+	if ghUser != "" {
+		uncached := *cfg
+		uncached.CacheTTLMinutes = 0
+		for _, line := range fetchGitHubKeys(ctx, &uncached, ghUser, log, extra...) {
+			if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil {
+				published = append(published, pub)
+			}
+		}
+		if len(published) == 0 {
+			_, err := fmt.Fprintf(errOut, "github.com/%s.keys lists no keys or could not be fetched\n", ghUser)
+			if err != nil {
+				return err
+			}
+			ghUser = ""
+		}
+	}
+
+	var b strings.Builder
+	for _, o := range own {
+		b.WriteString("# " + o.source)
+		if o.fingerprint != "" {
+			b.WriteString(" " + o.fingerprint)
+			if ghUser != "" {
+				if slices.ContainsFunc(published, func(p ssh.PublicKey) bool { return sameKey(p, o.sshKey) }) {
+					b.WriteString(" (on github.com/" + ghUser + ")")
+				} else {
+					b.WriteString(" (not on github.com/" + ghUser + ")")
+				}
+			}
+		}
+		b.WriteString("\n" + o.recipient + "\n")
+	}
+	if _, err := io.WriteString(out, b.String()); err != nil {
+		return err
+	}
+
+	for _, p := range published {
+		if slices.ContainsFunc(own, func(o ownRecipient) bool { return o.sshKey != nil && sameKey(p, o.sshKey) }) {
+			continue
+		}
+		if _, err := fmt.Fprintf(errOut, "github.com/%s.keys lists %s %s, which matches no local key (stale?)\n",
+			ghUser, p.Type(), ssh.FingerprintSHA256(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameKey reports whether a and b are the same SSH public key.
+func sameKey(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ivuorinen/a/pkg/agewrap"
+)
+
+// runWhoami runs whoami with cfg, the agewrap options github and args and
+// returns its stdout and stderr.
+func runWhoami(t *testing.T, cfg *Config, github []agewrap.Option, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	c := Whoami(cfg, discardLogger(), github...)
+	var out, errOut bytes.Buffer
+	c.SetOut(&out)
+	c.SetErr(&errOut)
+	c.SetArgs(args)
+	err = c.Execute()
+	return out.String(), errOut.String(), err
+}
+
+func TestWhoami_RecipientsAndGitHubCheck(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	sshDir := filepath.Join(home, ".ssh")
+	require.NoError(t, os.MkdirAll(sshDir, 0o700))
+	priv, pub := makeSSHKey(t, sshDir)
+	_, stalePub := makeSSHKey(t, t.TempDir())
+	key, stale := pubKeyLine(t, pub), pubKeyLine(t, stalePub)
+
+	ageKey := filepath.Join(t.TempDir(), "key.txt")
+	_, ageErr := runKeygen(t, "-o", ageKey)
+	ageRecipient := strings.TrimSpace(strings.TrimPrefix(ageErr, "Public key: "))
+
+	github := githubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s\n%s\n", key, stale)
+	})
+	cfg := &Config{GitHubUser: "alice", IdentityFiles: []string{ageKey}}
+	stdout, stderr, err := runWhoami(t, cfg, github)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "# "+ageKey+"\n"+ageRecipient+"\n")
+	onGitHub := regexp.QuoteMeta("# "+priv) + ` SHA256:\S+ \(on github.com/alice\)\n` + regexp.QuoteMeta(key) + `\n`
+	assert.Regexp(t, onGitHub, stdout)
+	assert.Contains(t, stderr, "matches no local key (stale?)")
+
+	// The output is itself a usable recipients file.
+	recipientsFile := filepath.Join(t.TempDir(), "me.txt")
+	require.NoError(t, os.WriteFile(recipientsFile, []byte(stdout), 0o600))
+	recips, err := resolveRefs(t, []string{recipientsFile}, discardLogger())
+	require.NoError(t, err)
+	assert.Len(t, recips, 2)
+
+	github = githubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintln(w, stale)
+	})
+	stdout, _, err = runWhoami(t, &Config{}, github, "--github-user", "bob")
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "(not on github.com/bob)")
+
+	stdout, stderr, err = runWhoami(t, &Config{GitHubUser: "alice"}, nil, "--offline")
+	require.NoError(t, err)
+	assert.NotContains(t, stdout, "github.com")
+	assert.Empty(t, stderr)
+}
+
+func TestWhoami_Errors(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	_, _, err := runWhoami(t, &Config{}, nil)
+	assert.ErrorContains(t, err, "no keys found")
+
+	ageKey := filepath.Join(t.TempDir(), "key.txt")
+	runKeygen(t, "-o", ageKey)
+	_, _, err = runWhoami(t, &Config{IdentityFiles: []string{ageKey}}, nil, "--github-user", "-bad-")
+	assert.ErrorContains(t, err, "invalid GitHub username")
+
+	github := githubKeysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	_, stderr, err := runWhoami(t, &Config{IdentityFiles: []string{ageKey}}, github, "--github-user", "ghost")
+	require.NoError(t, err)
+	assert.Contains(t, stderr, "lists no keys or could not be fetched")
+}
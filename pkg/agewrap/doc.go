@@ -0,0 +1,22 @@
+// Package agewrap is the library behind the a CLI: age encryption and
+// decryption over io.Reader/io.Writer, and resolution of recipients from
+// public-key lines, key files and GitHub users (with an on-disk cache).
+//
+// The API is stable: the CLI is a thin layer over it, handling flags, output
+// files and logging, so Go programs get the same recipient resolution and
+// caching without shelling out.
+//
+//	r := agewrap.NewRecipientResolver(agewrap.WithCache(cacheDir, 2*time.Hour))
+//	recipients, err := r.Resolve(ctx, []string{"github:alice", "age1..."})
+//	if err != nil { ... }
+//	err = agewrap.Encrypt(ctx, dst, src, recipients)
+//
+// Each kind of recipient reference is a KeySource registered in a Registry
+// under a prefix; register your own (an internal key server, a vault) with
+// RecipientResolver.Register.
+//
+// Errors are typed so callers can branch on them with errors.Is and
+// errors.As: see ErrNoRecipients, *RecipientError, *GitHubError and
+// *MixedRecipientsError. A file none of the identities can open fails with
+// age's own *age.NoIdentityMatchError.
+package agewrap
@@ -0,0 +1,75 @@
+package agewrap
+
+import (
+	"errors"
+	"fmt"
+
+	"filippo.io/age/plugin"
+)
+
+var (
+	// ErrNoRecipients is returned when resolution yields no usable recipient.
+	ErrNoRecipients = errors.New("no valid recipients found")
+	// ErrEmptyRecipient is returned for an empty recipient input.
+	ErrEmptyRecipient = errors.New("empty recipient")
+	// ErrNoIdentities is returned for identity data without any identity.
+	ErrNoIdentities = errors.New("no identities found")
+	// ErrInvalidGitHubUser is returned for a malformed GitHub username.
+	ErrInvalidGitHubUser = errors.New("invalid GitHub username")
+	// ErrHeaderMAC is returned when an identity unwrapped the file key but the
+	// header does not authenticate with it: the header was modified.
+	ErrHeaderMAC = errors.New("bad header MAC: the age header was modified")
+)
+
+// RecipientError reports a recipient line that could not be parsed.
+type RecipientError struct {
+	Line string
+	Err  error
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("invalid recipient %q: %v", e.Line, e.Err)
+}
+
+func (e *RecipientError) Unwrap() error { return e.Err }
+
+// GitHubError reports a failed GitHub key fetch. StatusCode is 0 when no
+// response was received.
+type GitHubError struct {
+	User       string
+	StatusCode int
+	Err        error
+}
+
+func (e *GitHubError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("fetching GitHub keys for %s: status %d", e.User, e.StatusCode)
+	}
+	return fmt.Sprintf("fetching GitHub keys for %s: %v", e.User, e.Err)
+}
+
+func (e *GitHubError) Unwrap() error { return e.Err }
+
+// MixedRecipientsError is returned when post-quantum hybrid recipients are
+// combined with classical (X25519 or SSH) ones. Anyone recording the file
+// today could later break the classical stanzas with a quantum computer, so
+// the mix forfeits the guarantee the post-quantum recipients were chosen for.
+type MixedRecipientsError struct {
+	PostQuantum, Classical int
+}
+
+func (e *MixedRecipientsError) Error() string {
+	return fmt.Sprintf("%d post-quantum recipient(s) are mixed with %d classical (X25519/SSH) recipient(s): "+
+		"the classical ones would leave the file open to future quantum attacks; "+
+		"encrypt to post-quantum (age1pq1...) recipients only", e.PostQuantum, e.Classical)
+}
+
+// PluginHint turns a missing-plugin error into an actionable message; other
+// errors are returned unchanged. The package applies it to the errors it
+// returns; it is exported for callers using age directly with plugin keys.
+func PluginHint(err error) error {
+	if nf, ok := errors.AsType[*plugin.NotFoundError](err); ok {
+		return fmt.Errorf("%w (install age-plugin-%s and make sure it is in PATH)", err, nf.Name)
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package agewrap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// githubUsernameRE matches a valid GitHub username (alphanumerics and hyphens, no
+// leading/trailing hyphen, max 39 chars).
+var githubUsernameRE = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,37}[a-zA-Z0-9])?$`)
+
+// maxKeysResponseBytes caps the GitHub .keys response we will read into memory.
+// Real responses are a few KB; the cap prevents a huge/hostile response from
+// exhausting memory. A user with more than this many keys is not a real case.
+const maxKeysResponseBytes = 1 << 20 // 1 MiB
+
+// ValidGitHubUser reports whether user is a valid GitHub username. Only a valid
+// name is safe to interpolate into the keys URL and the cache file name.
+func ValidGitHubUser(user string) bool {
+	return githubUsernameRE.MatchString(user)
+}
+
+// Keys returns the SSH public key lines published at github.com/<user>.keys.
+// With WithCache, a fresh cached listing is returned without network access
+// and a fetched one is cached (best effort). Failures are a *GitHubError, or
+// ErrInvalidGitHubUser for a malformed name.
+func (s *GitHubSource) Keys(ctx context.Context, user string) ([]string, error) {
+	if !ValidGitHubUser(user) {
+		return nil, fmt.Errorf("%w %q", ErrInvalidGitHubUser, user)
+	}
+	cachePath := ""
+	if s.o.cacheDir != "" && s.o.cacheTTL > 0 {
+		cachePath = filepath.Join(s.o.cacheDir, user+".keys")
+		if keys, ok := readKeyCache(cachePath, s.o.cacheTTL); ok {
+			s.o.logger.Debug("Using cached GitHub keys", "user", user)
+			return keys, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.o.keysURL(user), nil)
+	if err != nil {
+		return nil, &GitHubError{User: user, Err: err}
+	}
+	// #nosec G107 -- the host is fixed by the keys URL and user is validated above
+	resp, err := s.o.httpClient.Do(req)
+	if err != nil {
+		return nil, &GitHubError{User: user, Err: err}
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &GitHubError{User: user, StatusCode: resp.StatusCode}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeysResponseBytes))
+	if err != nil {
+		return nil, &GitHubError{User: user, Err: err}
+	}
+	if cachePath != "" {
+		s.writeKeyCache(cachePath, body)
+	}
+	return parseKeyLines(string(body)), nil
+}
+
+// parseKeyLines splits a GitHub .keys response into non-empty, trimmed key lines.
+func parseKeyLines(body string) []string {
+	var keys []string
+	for line := range strings.SplitSeq(body, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+// readKeyCache returns cached keys when cachePath exists and is younger than
+// ttl. The boolean is false when the cache is missing, stale, or unreadable.
+func readKeyCache(cachePath string, ttl time.Duration) ([]string, bool) {
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		return nil, false
+	}
+	if time.Since(info.ModTime()) > ttl {
+		return nil, false
+	}
+	// #nosec G304 -- cachePath is the cache dir joined with a validated GitHub username
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil, false
+	}
+	return parseKeyLines(string(data)), true
+}
+
+// writeKeyCache stores the raw .keys response; failures are non-fatal (best effort).
+func (s *GitHubSource) writeKeyCache(cachePath string, body []byte) {
+	// #nosec G703 -- cachePath is the cache dir joined with a validated GitHub username
+	if err := os.WriteFile(cachePath, body, 0o600); err != nil {
+		s.o.logger.Warn("Failed to cache GitHub keys", "path", cachePath, "error", err)
+	}
+}
@@ -0,0 +1,126 @@
+package agewrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keysServer returns resolver options pointing GitHub key fetches at handler.
+func keysServer(t *testing.T, handler http.HandlerFunc) Option {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return WithGitHubKeysURL(func(user string) string { return srv.URL + "/" + user + ".keys" })
+}
+
+func TestGitHubKeys(t *testing.T) {
+	calls := 0
+	urlOpt := keysServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/good.keys" {
+			_, _ = fmt.Fprintln(w, "ssh-ed25519 NETKEY")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	dir := t.TempDir()
+	r := NewRecipientResolver(urlOpt, WithCache(dir, time.Hour))
+
+	keys, err := r.GitHubKeys(context.Background(), "good")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ssh-ed25519 NETKEY"}, keys)
+	keys, err = r.GitHubKeys(context.Background(), "good")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ssh-ed25519 NETKEY"}, keys)
+	assert.Equal(t, 1, calls, "the second fetch is served from the cache")
+
+	_, err = r.GitHubKeys(context.Background(), "missing")
+	ghErr, ok := errors.AsType[*GitHubError](err)
+	require.True(t, ok, "got %v", err)
+	assert.Equal(t, http.StatusNotFound, ghErr.StatusCode)
+
+	_, err = r.GitHubKeys(context.Background(), "bad user!")
+	assert.ErrorIs(t, err, ErrInvalidGitHubUser)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewRecipientResolver(urlOpt).GitHubKeys(ctx, "good")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestResolve_GitHubUser(t *testing.T) {
+	line := sshKeyLine(t, "")
+	urlOpt := keysServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintln(w, line)
+	})
+	got, err := NewRecipientResolver(urlOpt).Resolve(context.Background(), []string{"github:octocat"})
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+}
+
+func TestValidGitHubUser(t *testing.T) {
+	assert.True(t, ValidGitHubUser("octo-cat"))
+	for _, bad := range []string{"", "-octo", "octo-", "../etc", "a b", string(make([]byte, 40))} {
+		assert.False(t, ValidGitHubUser(bad), bad)
+	}
+}
+
+func TestParseKeyLines(t *testing.T) {
+	got := parseKeyLines("ssh-ed25519 AAA\n\n  ssh-rsa BBB  \n")
+	assert.Equal(t, []string{"ssh-ed25519 AAA", "ssh-rsa BBB"}, got)
+	assert.Nil(t, parseKeyLines("\n   \n"), "blank body yields no keys")
+}
+
+func TestReadKeyCache(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "octocat.keys")
+	require.NoError(t, os.WriteFile(cachePath, []byte("ssh-ed25519 AAA\n"), 0o600))
+
+	keys, ok := readKeyCache(cachePath, time.Hour)
+	require.True(t, ok, "fresh cache should be a hit")
+	assert.Equal(t, []string{"ssh-ed25519 AAA"}, keys)
+
+	// Age the file beyond the TTL: it must now miss.
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(cachePath, old, old))
+	_, ok = readKeyCache(cachePath, time.Hour)
+	assert.False(t, ok, "stale cache should miss")
+
+	_, ok = readKeyCache(filepath.Join(dir, "missing.keys"), time.Hour)
+	assert.False(t, ok, "absent cache should miss")
+
+	// A directory at cachePath: Stat succeeds and is fresh, but ReadFile fails (EISDIR).
+	unreadable := filepath.Join(dir, "user.keys")
+	require.NoError(t, os.Mkdir(unreadable, 0o700))
+	_, ok = readKeyCache(unreadable, time.Hour)
+	assert.False(t, ok)
+}
+
+func TestWriteKeyCache(t *testing.T) {
+	src := NewGitHubSource()
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "user.keys")
+	src.writeKeyCache(cachePath, []byte("ssh-rsa X\n"))
+
+	data, err := os.ReadFile(cachePath) // #nosec G304 -- test-controlled temp path
+	require.NoError(t, err)
+	assert.Equal(t, "ssh-rsa X\n", string(data))
+	info, err := os.Stat(cachePath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "cache file must be 0600")
+
+	// Parent directory does not exist: write fails but must not panic.
+	badPath := filepath.Join(dir, "missing-dir", "u.keys")
+	src.writeKeyCache(badPath, []byte("ssh-rsa X\n"))
+	assert.NoFileExists(t, badPath)
+}
@@ -0,0 +1,61 @@
+package agewrap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/plugin"
+)
+
+// ParseIdentities parses the contents of a key file: an SSH private key, or an
+// age identity file with one identity per line. Lines may be native X25519
+// ("AGE-SECRET-KEY-1...") or post-quantum hybrid ("AGE-SECRET-KEY-PQ-1...")
+// keys, or plugin identities ("AGE-PLUGIN-<NAME>-1..."), which run
+// age-plugin-<name> from PATH when used. Blank lines and "#" comments are
+// ignored. Only WithPluginUI is consulted.
+//
+// Errors never include the offending line: it is secret key material.
+func ParseIdentities(data []byte, opts ...Option) ([]age.Identity, error) {
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		identity, err := agessh.ParseIdentity(data)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{identity}, nil
+	}
+
+	ui := newOptions(opts).pluginUI
+	var identities []age.Identity
+	for n, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		identity, err := parseIdentity(line, ui)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, ErrNoIdentities
+	}
+	return identities, nil
+}
+
+// parseIdentity parses a single age identity string.
+func parseIdentity(s string, ui *plugin.ClientUI) (age.Identity, error) {
+	switch {
+	case strings.HasPrefix(s, "AGE-PLUGIN-"):
+		return plugin.NewIdentity(s, ui)
+	case strings.HasPrefix(s, "AGE-SECRET-KEY-PQ-1"):
+		return age.ParseHybridIdentity(s)
+	case strings.HasPrefix(s, "AGE-SECRET-KEY-1"):
+		return age.ParseX25519Identity(s)
+	default:
+		return nil, errors.New("unknown identity type")
+	}
+}
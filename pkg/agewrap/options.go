@@ -0,0 +1,71 @@
+package agewrap
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"filippo.io/age/plugin"
+)
+
+// DefaultHTTPTimeout bounds a GitHub key fetch unless WithHTTPClient is used;
+// a slow or hostile server must not hang the caller indefinitely.
+const DefaultHTTPTimeout = 30 * time.Second
+
+// options holds the settings shared by the package's functions.
+type options struct {
+	logger     *slog.Logger
+	httpClient *http.Client
+	keysURL    func(user string) string
+	cacheDir   string
+	cacheTTL   time.Duration
+	pluginUI   *plugin.ClientUI
+}
+
+// Option configures a RecipientResolver, ParseIdentities or ParseRecipient.
+type Option func(*options)
+
+// newOptions applies opts over the defaults.
+func newOptions(opts []Option) *options {
+	o := &options{
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		httpClient: &http.Client{Timeout: DefaultHTTPTimeout},
+		keysURL:    func(user string) string { return fmt.Sprintf("https://github.com/%s.keys", user) },
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithLogger reports skipped keys, cache use and other non-fatal events to
+// logger. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithHTTPClient fetches GitHub keys with client instead of a default client
+// with DefaultHTTPTimeout.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) { o.httpClient = client }
+}
+
+// WithGitHubKeysURL overrides where a user's keys are fetched from (by default
+// https://github.com/<user>.keys), e.g. for GitHub Enterprise or tests.
+func WithGitHubKeysURL(url func(user string) string) Option {
+	return func(o *options) { o.keysURL = url }
+}
+
+// WithCache caches fetched GitHub keys as <dir>/<user>.keys for ttl. An empty
+// dir or a non-positive ttl disables the cache, which is the default.
+func WithCache(dir string, ttl time.Duration) Option {
+	return func(o *options) { o.cacheDir, o.cacheTTL = dir, ttl }
+}
+
+// WithPluginUI answers the prompts of age plugins (PINs, touch requests) used
+// by plugin recipients and identities. Without it, a plugin that prompts fails.
+func WithPluginUI(ui *plugin.ClientUI) Option {
+	return func(o *options) { o.pluginUI = ui }
+}
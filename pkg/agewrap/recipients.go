@@ -0,0 +1,191 @@
+package agewrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/plugin"
+	"golang.org/x/crypto/ssh"
+)
+
+// GitHubPrefix marks a recipient input naming a GitHub user ("github:alice")
+// whose published SSH keys are the recipients.
+const GitHubPrefix = "github:"
+
+// AuthorizedKey is one parsed authorized_keys (or .pub) line.
+type AuthorizedKey struct {
+	Recipient age.Recipient
+	// Name identifies the key in logs: its comment, or its fingerprint when it
+	// has none.
+	Name string
+	// Skip, when non-empty, is why the line cannot be a recipient. Such lines are
+	// warned about and ignored instead of failing the whole recipient list.
+	Skip string
+}
+
+// SSHKeyTypeSupported reports whether an SSH key type can be an age recipient.
+func SSHKeyTypeSupported(t string) bool {
+	return t == ssh.KeyAlgoED25519 || t == ssh.KeyAlgoRSA
+}
+
+// ParseAuthorizedKey parses an OpenSSH authorized_keys line: optional options
+// (from="...",no-pty,...), the key type, the base64 key and an optional comment.
+// ok is false when the line is not in that format at all, so the caller can
+// fall back to the other recipient syntaxes.
+func ParseAuthorizedKey(line string) (k AuthorizedKey, ok bool, err error) {
+	pub, comment, options, _, parseErr := ssh.ParseAuthorizedKey([]byte(line))
+	if parseErr != nil {
+		return AuthorizedKey{}, false, nil
+	}
+	k.Name = comment
+	if k.Name == "" {
+		k.Name = ssh.FingerprintSHA256(pub)
+	}
+	switch {
+	case slices.ContainsFunc(options, func(o string) bool { return strings.EqualFold(o, "cert-authority") }):
+		k.Skip = "cert-authority keys sign certificates and cannot be encryption recipients"
+	case !SSHKeyTypeSupported(pub.Type()):
+		k.Skip = fmt.Sprintf("key type %s is not supported by age (only ssh-ed25519 and ssh-rsa)", pub.Type())
+	default:
+		k.Recipient, err = NewSSHRecipient(pub)
+		if err != nil {
+			return AuthorizedKey{}, true, err
+		}
+	}
+	return k, true, nil
+}
+
+// SSHRecipient is an age recipient for an SSH public key (ssh-ed25519 or
+// ssh-rsa). Unlike the agessh types it wraps, it keeps the key, so the
+// recipient can be named by its fingerprint.
+type SSHRecipient struct {
+	age.Recipient
+	Key ssh.PublicKey
+}
+
+// NewSSHRecipient returns the recipient for an SSH public key.
+func NewSSHRecipient(pub ssh.PublicKey) (*SSHRecipient, error) {
+	r, err := agessh.ParseRecipient(string(ssh.MarshalAuthorizedKey(pub)))
+	if err != nil {
+		return nil, err
+	}
+	return &SSHRecipient{Recipient: r, Key: pub}, nil
+}
+
+// ParseSSHRecipient parses an SSH public key line ("ssh-ed25519 AAAA...").
+func ParseSSHRecipient(s string) (*SSHRecipient, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		// agessh's error names the unsupported or malformed key.
+		_, err = agessh.ParseRecipient(s)
+		return nil, err
+	}
+	return NewSSHRecipient(pub)
+}
+
+// String returns the key's SHA256 fingerprint.
+func (r *SSHRecipient) String() string {
+	return ssh.FingerprintSHA256(r.Key)
+}
+
+// Fingerprint names a recipient for logs and records: the SHA256 fingerprint
+// of an SSH key, or the recipient string of a native, hybrid or plugin
+// recipient (which is public and short).
+func Fingerprint(r age.Recipient) string {
+	if s, ok := r.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", r)
+}
+
+// ParseRecipient parses a single recipient line: an SSH public key ("ssh-..."),
+// a post-quantum hybrid recipient ("age1pq1..."), a plugin recipient
+// ("age1<name>1...", encrypted to by running age-plugin-<name> from PATH), or a
+// native age recipient ("age1..."). Only WithPluginUI is consulted.
+func ParseRecipient(s string, opts ...Option) (age.Recipient, error) {
+	switch {
+	case strings.HasPrefix(s, "ssh-"):
+		r, err := ParseSSHRecipient(s)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case strings.HasPrefix(s, "age1pq1"):
+		return age.ParseHybridRecipient(s)
+	case isPluginRecipient(s):
+		return plugin.NewRecipient(s, newOptions(opts).pluginUI)
+	default:
+		return age.ParseX25519Recipient(s)
+	}
+}
+
+// isPluginRecipient reports whether s is a plugin recipient ("age1<name>1...").
+func isPluginRecipient(s string) bool {
+	_, _, err := plugin.ParseRecipient(s)
+	return err == nil
+}
+
+// ReadRecipientLines resolves a single recipient input into candidate lines:
+// the lines of a file when input names one, otherwise the literal input.
+func ReadRecipientLines(input string) ([]string, error) {
+	// #nosec G304 G703 -- recipient paths are chosen by the caller by design
+	if info, statErr := os.Stat(input); statErr == nil && !info.IsDir() {
+		// #nosec G304 G703 -- recipient paths are chosen by the caller by design
+		data, readErr := os.ReadFile(input)
+		if readErr != nil {
+			return nil, fmt.Errorf("reading recipient file %s: %w", input, readErr)
+		}
+		return strings.Split(string(data), "\n"), nil
+	}
+	return []string{input}, nil
+}
+
+// RecipientResolver is a Registry preloaded with the built-in sources:
+// "github:<user>" (GitHubSource), public-key files (FileSource) and literal
+// recipients (LiteralSource). More sources, such as an AliasSource, can be
+// added with Register.
+type RecipientResolver struct {
+	*Registry
+	github *GitHubSource
+}
+
+// NewRecipientResolver returns a resolver whose built-in sources are
+// configured by opts.
+func NewRecipientResolver(opts ...Option) *RecipientResolver {
+	r := &RecipientResolver{Registry: NewRegistry(), github: NewGitHubSource(opts...)}
+	r.Register(GitHubPrefix, r.github)
+	r.Register("", NewFileSource(opts...))
+	r.Register("", NewLiteralSource(opts...))
+	return r
+}
+
+// GitHubKeys returns the SSH public key lines published by a GitHub user (see
+// GitHubSource.Keys).
+func (r *RecipientResolver) GitHubKeys(ctx context.Context, user string) ([]string, error) {
+	return r.github.Keys(ctx, user)
+}
+
+// CheckPostQuantumMix returns a *MixedRecipientsError when recipients mix
+// post-quantum hybrid recipients with classical ones (X25519 or SSH). age
+// refuses the mix too, but with a less actionable error. Plugin recipients are
+// left for age to judge, as their kind is only known once they run.
+func CheckPostQuantumMix(recipients []age.Recipient) error {
+	pq, classical := 0, 0
+	for _, r := range recipients {
+		switch r.(type) {
+		case *age.HybridRecipient:
+			pq++
+		case *age.X25519Recipient, *SSHRecipient, *agessh.Ed25519Recipient, *agessh.RSARecipient:
+			classical++
+		}
+	}
+	if pq == 0 || classical == 0 {
+		return nil
+	}
+	return &MixedRecipientsError{PostQuantum: pq, Classical: classical}
+}
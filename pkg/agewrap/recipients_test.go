@@ -0,0 +1,105 @@
+package agewrap
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKeyLine returns a fresh ssh-ed25519 public key line with an optional comment.
+func sshKeyLine(t *testing.T, comment string) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return strings.TrimSpace(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment)
+}
+
+func TestParseAuthorizedKey(t *testing.T) {
+	_, ok, err := ParseAuthorizedKey("age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p")
+	assert.False(t, ok, "native age keys are not authorized_keys lines")
+	require.NoError(t, err)
+
+	k, ok, err := ParseAuthorizedKey(sshKeyLine(t, ""))
+	require.True(t, ok)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(k.Name, "SHA256:"), "an uncommented key is named by its fingerprint")
+	assert.Empty(t, k.Skip)
+	assert.NotNil(t, k.Recipient)
+
+	k, ok, err = ParseAuthorizedKey("cert-authority " + sshKeyLine(t, "corp-ca"))
+	require.True(t, ok)
+	require.NoError(t, err)
+	assert.Equal(t, "corp-ca", k.Name)
+	assert.Contains(t, k.Skip, "cert-authority")
+}
+
+func TestFingerprint(t *testing.T) {
+	line := sshKeyLine(t, "alice@laptop")
+	r, err := ParseRecipient(line)
+	require.NoError(t, err)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	require.NoError(t, err)
+	assert.Equal(t, ssh.FingerprintSHA256(pub), Fingerprint(r), "SSH keys are named by fingerprint, not comment")
+
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	assert.Equal(t, id.Recipient().String(), Fingerprint(id.Recipient()))
+
+	_, err = ParseRecipient("ssh-dss AAAA")
+	assert.Error(t, err)
+}
+
+func TestResolve(t *testing.T) {
+	native, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "recipients.txt")
+	require.NoError(t, os.WriteFile(file, []byte("# team\n"+sshKeyLine(t, "alice")+"\n\n"+
+		"cert-authority "+sshKeyLine(t, "ca")+"\n"), 0o600))
+
+	var logs bytes.Buffer
+	r := NewRecipientResolver(WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	got, err := r.Resolve(context.Background(), []string{file, native.Recipient().String()})
+	require.NoError(t, err)
+	assert.Len(t, got, 2, "the cert-authority line is skipped")
+	assert.Contains(t, logs.String(), "name=ca")
+
+	_, err = r.Resolve(context.Background(), []string{""})
+	assert.ErrorIs(t, err, ErrEmptyRecipient)
+
+	_, err = r.Resolve(context.Background(), []string{"garbage-not-a-key"})
+	recipientErr, ok := errors.AsType[*RecipientError](err)
+	require.True(t, ok, "got %v", err)
+	assert.Equal(t, "garbage-not-a-key", recipientErr.Line)
+
+	_, err = r.Resolve(context.Background(), []string{"cert-authority " + sshKeyLine(t, "ca")})
+	assert.ErrorIs(t, err, ErrNoRecipients)
+}
+
+func TestCheckPostQuantumMix(t *testing.T) {
+	pq, err := age.GenerateHybridIdentity()
+	require.NoError(t, err)
+	classic, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	assert.NoError(t, CheckPostQuantumMix([]age.Recipient{pq.Recipient()}))
+	assert.NoError(t, CheckPostQuantumMix([]age.Recipient{classic.Recipient()}))
+
+	err = CheckPostQuantumMix([]age.Recipient{pq.Recipient(), classic.Recipient(), classic.Recipient()})
+	mixed, ok := errors.AsType[*MixedRecipientsError](err)
+	require.True(t, ok, "got %v", err)
+	assert.Equal(t, MixedRecipientsError{PostQuantum: 1, Classical: 2}, *mixed)
+}
@@ -0,0 +1,244 @@
+package agewrap
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+)
+
+// ErrUnsupportedRef is returned, possibly wrapped, by a KeySource for a
+// reference it does not handle, so the Registry tries the next source.
+var ErrUnsupportedRef = errors.New("unsupported recipient reference")
+
+// KeySource resolves one recipient reference, with any registered prefix
+// already removed, into recipients.
+type KeySource interface {
+	Resolve(ctx context.Context, ref string) ([]age.Recipient, error)
+}
+
+// KeySourceFunc adapts a function to the KeySource interface.
+type KeySourceFunc func(ctx context.Context, ref string) ([]age.Recipient, error)
+
+// Resolve implements KeySource.
+func (f KeySourceFunc) Resolve(ctx context.Context, ref string) ([]age.Recipient, error) {
+	return f(ctx, ref)
+}
+
+// registration is a KeySource and the reference prefix it is registered for.
+type registration struct {
+	prefix string
+	source KeySource
+}
+
+// Registry dispatches recipient references to KeySources by prefix, so new
+// kinds of reference can be added without changing the callers that resolve
+// them. It is safe for concurrent use.
+type Registry struct {
+	mu      sync.RWMutex
+	sources []registration
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds src for references starting with prefix ("github:", "@"). The
+// prefix is removed before src sees the reference. An empty prefix makes src a
+// fallback for every reference.
+//
+// Sources with the longest matching prefix are tried first, and among equal
+// prefixes in registration order; a source returning ErrUnsupportedRef passes
+// the reference on to the next one.
+func (r *Registry) Register(prefix string, src KeySource) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sources = append(r.sources, registration{prefix: prefix, source: src})
+	slices.SortStableFunc(r.sources, func(a, b registration) int {
+		return cmp.Compare(len(b.prefix), len(a.prefix))
+	})
+}
+
+// ResolveRef resolves a single reference through the registered sources.
+func (r *Registry) ResolveRef(ctx context.Context, ref string) ([]age.Recipient, error) {
+	if ref == "" {
+		return nil, ErrEmptyRecipient
+	}
+	r.mu.RLock()
+	sources := slices.Clone(r.sources)
+	r.mu.RUnlock()
+	for _, reg := range sources {
+		rest, ok := strings.CutPrefix(ref, reg.prefix)
+		if !ok {
+			continue
+		}
+		recipients, err := reg.source.Resolve(ctx, rest)
+		if errors.Is(err, ErrUnsupportedRef) {
+			continue
+		}
+		return recipients, err
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupportedRef, ref)
+}
+
+// Resolve resolves every reference and returns all their recipients, or
+// ErrNoRecipients when nothing usable remains.
+func (r *Registry) Resolve(ctx context.Context, refs []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, ref := range refs {
+		resolved, err := r.ResolveRef(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, resolved...)
+	}
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+	return recipients, nil
+}
+
+// FileSource resolves the path of a public-key file (an SSH .pub file, an
+// authorized_keys file, or a recipients file, one key per line). References
+// that are not an existing file are ErrUnsupportedRef.
+type FileSource struct {
+	o *options
+}
+
+// NewFileSource returns a FileSource. WithLogger and WithPluginUI are consulted.
+func NewFileSource(opts ...Option) *FileSource {
+	return &FileSource{o: newOptions(opts)}
+}
+
+// Resolve implements KeySource.
+func (s *FileSource) Resolve(_ context.Context, ref string) ([]age.Recipient, error) {
+	// #nosec G304 G703 -- recipient paths are chosen by the caller by design
+	if info, err := os.Stat(ref); err != nil || info.IsDir() {
+		return nil, fmt.Errorf("%w: no such file %q", ErrUnsupportedRef, ref)
+	}
+	lines, err := ReadRecipientLines(ref)
+	if err != nil {
+		return nil, err
+	}
+	return parseRecipientLines(lines, ref, s.o)
+}
+
+// LiteralSource resolves a literal recipient string: an SSH key line (in
+// authorized_keys format) or an "age1..." key.
+type LiteralSource struct {
+	o *options
+}
+
+// NewLiteralSource returns a LiteralSource. WithLogger and WithPluginUI are
+// consulted.
+func NewLiteralSource(opts ...Option) *LiteralSource {
+	return &LiteralSource{o: newOptions(opts)}
+}
+
+// Resolve implements KeySource.
+func (s *LiteralSource) Resolve(_ context.Context, ref string) ([]age.Recipient, error) {
+	return parseRecipientLines([]string{ref}, ref, s.o)
+}
+
+// GitHubSource resolves a GitHub username to the user's published SSH keys.
+type GitHubSource struct {
+	o *options
+}
+
+// NewGitHubSource returns a GitHubSource. WithHTTPClient, WithGitHubKeysURL,
+// WithCache, WithLogger and WithPluginUI are consulted.
+func NewGitHubSource(opts ...Option) *GitHubSource {
+	return &GitHubSource{o: newOptions(opts)}
+}
+
+// Resolve implements KeySource.
+func (s *GitHubSource) Resolve(ctx context.Context, user string) ([]age.Recipient, error) {
+	lines, err := s.Keys(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return parseRecipientLines(lines, GitHubPrefix+user, s.o)
+}
+
+// AliasSource resolves a named group of references, such as "team" for
+// ["github:alice", "age1..."], by resolving each member through a Registry.
+// Members may name other aliases; a cycle is an error.
+type AliasSource struct {
+	aliases  map[string][]string
+	registry *Registry
+}
+
+// NewAliasSource returns an AliasSource for aliases, resolving members through
+// registry (typically the one the source is registered in).
+func NewAliasSource(aliases map[string][]string, registry *Registry) *AliasSource {
+	return &AliasSource{aliases: aliases, registry: registry}
+}
+
+// aliasChainKey is the context key holding the aliases being expanded.
+type aliasChainKey struct{}
+
+// Resolve implements KeySource.
+func (s *AliasSource) Resolve(ctx context.Context, name string) ([]age.Recipient, error) {
+	members, ok := s.aliases[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown recipient alias %q", name)
+	}
+	chain, _ := ctx.Value(aliasChainKey{}).([]string)
+	if slices.Contains(chain, name) {
+		return nil, fmt.Errorf("recipient alias cycle: %s -> %s", strings.Join(chain, " -> "), name)
+	}
+	ctx = context.WithValue(ctx, aliasChainKey{}, append(slices.Clip(chain), name))
+	recipients, err := s.registry.Resolve(ctx, members)
+	if err != nil {
+		return nil, fmt.Errorf("alias %q: %w", name, err)
+	}
+	return recipients, nil
+}
+
+// parseRecipientLines parses recipient lines read from source, skipping blank
+// lines, comments and keys that cannot be recipients.
+func parseRecipientLines(lines []string, source string, o *options) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		recipient, ok, err := parseLine(line, source, o)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			recipients = append(recipients, recipient)
+		}
+	}
+	return recipients, nil
+}
+
+// parseLine parses one recipient line read from source. ok is false when the
+// line was skipped.
+func parseLine(line, source string, o *options) (recipient age.Recipient, ok bool, err error) {
+	if k, isKey, err := ParseAuthorizedKey(line); isKey {
+		if err != nil {
+			return nil, false, &RecipientError{Line: line, Err: err}
+		}
+		if k.Skip != "" {
+			o.logger.Warn("Skipping recipient key", "name", k.Name, "source", source, "reason", k.Skip)
+			return nil, false, nil
+		}
+		o.logger.Debug("Using recipient", "name", k.Name, "source", source)
+		return k.Recipient, true, nil
+	}
+	recipient, err = ParseRecipient(line, WithPluginUI(o.pluginUI))
+	if err != nil {
+		return nil, false, &RecipientError{Line: line, Err: err}
+	}
+	o.logger.Debug("Using recipient", "name", line, "source", source)
+	return recipient, true, nil
+}
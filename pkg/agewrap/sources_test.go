@@ -0,0 +1,67 @@
+package agewrap
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Dispatch(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	var seen []string
+	source := func(name string) KeySource {
+		return KeySourceFunc(func(_ context.Context, ref string) ([]age.Recipient, error) {
+			seen = append(seen, name+":"+ref)
+			if ref == "skip" {
+				return nil, ErrUnsupportedRef
+			}
+			return []age.Recipient{id.Recipient()}, nil
+		})
+	}
+	r := NewRegistry()
+	r.Register("", source("fallback"))
+	r.Register("vault:", source("vault"))
+	r.Register("vault:prod/", source("prod"))
+
+	got, err := r.Resolve(context.Background(), []string{"vault:prod/db", "vault:dev", "vault:skip", "plain"})
+	require.NoError(t, err)
+	assert.Len(t, got, 4)
+	assert.Equal(t, []string{
+		"prod:db", "vault:dev", "vault:skip", "fallback:vault:skip", "fallback:plain",
+	}, seen, "the longest prefix wins, and an unsupported ref falls through")
+
+	_, err = NewRegistry().ResolveRef(context.Background(), "x")
+	assert.ErrorIs(t, err, ErrUnsupportedRef)
+	_, err = r.ResolveRef(context.Background(), "")
+	assert.ErrorIs(t, err, ErrEmptyRecipient)
+}
+
+func TestAliasSource(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	b, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	r := NewRecipientResolver()
+	r.Register("@", NewAliasSource(map[string][]string{
+		"ops":   {a.Recipient().String()},
+		"team":  {"@ops", b.Recipient().String()},
+		"loop":  {"@loop2"},
+		"loop2": {"@loop"},
+	}, r.Registry))
+
+	got, err := r.Resolve(context.Background(), []string{"@team"})
+	require.NoError(t, err)
+	assert.Len(t, got, 2, "nested aliases expand")
+
+	_, err = r.Resolve(context.Background(), []string{"@loop"})
+	assert.ErrorContains(t, err, "recipient alias cycle: loop -> loop2 -> loop")
+
+	_, err = r.Resolve(context.Background(), []string{"@nobody"})
+	assert.ErrorContains(t, err, `unknown recipient alias "nobody"`)
+	assert.False(t, errors.Is(err, ErrUnsupportedRef), "an unknown alias is not passed on to other sources")
+}
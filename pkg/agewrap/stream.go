@@ -0,0 +1,77 @@
+package agewrap
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+)
+
+// ctxReader fails reads once ctx is done, so a long copy stops at the next
+// chunk instead of running to the end of the stream.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Encrypt encrypts src to recipients, writing the age file to dst. Nothing is
+// written to dst before the header, but a failure partway (including ctx being
+// cancelled) leaves a truncated ciphertext there, so callers writing to a file
+// should write to a temporary one and rename it on success.
+func Encrypt(ctx context.Context, dst io.Writer, src io.Reader, recipients []age.Recipient) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		return fmt.Errorf("initializing encryption: %w", PluginHint(err))
+	}
+	if _, err := io.Copy(w, ctxReader{ctx, src}); err != nil {
+		return fmt.Errorf("writing ciphertext: %w", err)
+	}
+	// Closing flushes the final chunk.
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("finalizing encryption: %w", err)
+	}
+	return nil
+}
+
+// NewDecryptReader returns a reader of the plaintext of the age file in src.
+// It fails with *age.NoIdentityMatchError when none of identities is a
+// recipient, and with ErrHeaderMAC when one is but the header was modified.
+// age authenticates each 64 KiB chunk as it is read and detects truncation only
+// at the end, so plaintext must not be trusted until the reader returns io.EOF.
+func NewDecryptReader(ctx context.Context, src io.Reader, identities ...age.Identity) (io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(ctxReader{ctx, src}, identities...)
+	if err != nil && err.Error() == "bad header MAC" { // age does not export this error
+		return nil, ErrHeaderMAC
+	}
+	if err != nil {
+		return nil, PluginHint(err) // wrong key, not an age file, or a missing plugin
+	}
+	return r, nil
+}
+
+// Decrypt decrypts the age file in src to dst. As with Encrypt, a failure
+// partway leaves partial plaintext in dst.
+func Decrypt(ctx context.Context, dst io.Writer, src io.Reader, identities ...age.Identity) error {
+	r, err := NewDecryptReader(ctx, src, identities...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		return fmt.Errorf("reading plaintext: %w", err)
+	}
+	return nil
+}
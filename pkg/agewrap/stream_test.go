@@ -0,0 +1,82 @@
+package agewrap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	plain := strings.Repeat("library secret ", 10000)
+
+	var ciphertext bytes.Buffer
+	require.NoError(t, Encrypt(context.Background(), &ciphertext, strings.NewReader(plain),
+		[]age.Recipient{id.Recipient()}))
+
+	var got bytes.Buffer
+	require.NoError(t, Decrypt(context.Background(), &got, bytes.NewReader(ciphertext.Bytes()), id))
+	assert.Equal(t, plain, got.String())
+
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	err = Decrypt(context.Background(), &got, bytes.NewReader(ciphertext.Bytes()), other)
+	_, ok := errors.AsType[*age.NoIdentityMatchError](err)
+	assert.True(t, ok, "got %v", err)
+
+	truncated := ciphertext.Bytes()[:ciphertext.Len()-100]
+	assert.Error(t, Decrypt(context.Background(), &bytes.Buffer{}, bytes.NewReader(truncated), id))
+
+	// The first character of the MAC after "--- " is a full base64 digit, so
+	// changing it always changes the MAC.
+	hdr := bytes.Clone(ciphertext.Bytes())
+	i := bytes.Index(hdr, []byte("\n--- ")) + len("\n--- ")
+	if hdr[i] == 'A' {
+		hdr[i] = 'B'
+	} else {
+		hdr[i] = 'A'
+	}
+	err = Decrypt(context.Background(), &bytes.Buffer{}, bytes.NewReader(hdr), id)
+	assert.ErrorIs(t, err, ErrHeaderMAC)
+}
+
+func TestEncrypt_Cancelled(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Encrypt(ctx, &bytes.Buffer{}, strings.NewReader("x"), []age.Recipient{id.Recipient()})
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = NewDecryptReader(ctx, strings.NewReader("x"), id)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// A context cancelled mid-stream stops the copy at the next read.
+func TestEncrypt_CancelledMidStream(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &cancellingReader{cancel: cancel}
+	err = Encrypt(ctx, &bytes.Buffer{}, src, []age.Recipient{id.Recipient()})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, src.reads)
+}
+
+// cancellingReader returns data forever, cancelling its context on the first read.
+type cancellingReader struct {
+	cancel context.CancelFunc
+	reads  int
+}
+
+func (c *cancellingReader) Read(p []byte) (int, error) {
+	c.reads++
+	c.cancel()
+	return len(p), nil
+}